@@ -0,0 +1,84 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package config
+
+import (
+	"math/big"
+	"regexp"
+)
+
+// DefaultExternalChainType is used for external chains configured without a type
+var DefaultExternalChainType = ChainTypeCosmosHub
+
+// an amount followed by a denom, e.g. 0.025uatom
+var gasPriceRegexp = regexp.MustCompile(`^[0-9]*\.?[0-9]+[a-zA-Z][a-zA-Z0-9/:._-]{2,127}$`)
+
+func init() {
+	RegisterChainOptions(ChainTypeStafiHub, func() ChainOptions { return &StafiHubOptions{} })
+	RegisterChainOptions(ChainTypeCosmosHub, func() ChainOptions { return &CosmosHubOptions{} })
+}
+
+// StafiHubOptions are the opts of the native stafihub chain
+type StafiHubOptions struct {
+	StartBlock int    `json:"startBlock" description:"block to start from when the blockstore is empty, 0 starts from the latest block"`
+	Account    string `json:"account" required:"true" description:"name of the relay key in the keystore"`
+	GasPrice   string `json:"gasPrice" required:"true" description:"gas price of the relay transactions, e.g. 0.00001ufis"`
+}
+
+func (o *StafiHubOptions) SetDefaults() {}
+
+func (o *StafiHubOptions) Validate() error {
+	r := &report{}
+	if o.StartBlock < 0 {
+		r.add("startBlock", "must not be negative")
+	}
+	if o.Account == "" {
+		r.add("account", "is required")
+	}
+	checkGasPrice(r, o.GasPrice, true)
+	return r.err()
+}
+
+// CosmosHubOptions are the opts of a cosmos external chain, its pools, rparams and
+// account prefix are queried from stafihub
+type CosmosHubOptions struct {
+	StartBlock          int               `json:"startBlock" description:"block to start from when the blockstore is empty, 0 starts from the latest block"`
+	Pools               map[string]string `json:"pools" description:"multisig pool key name => sub key name in the keystore, empty for ica pools only"`
+	MinUnDelegateAmount string            `json:"minUnDelegateAmount" description:"unbonds smaller than this amount are skipped"`
+	GasPrice            string            `json:"gasPrice,omitempty" description:"overrides the gas price of the stafihub rparams with a warning, e.g. 0.025uatom"`
+}
+
+func (o *CosmosHubOptions) SetDefaults() {
+	o.Pools = map[string]string{}
+	o.MinUnDelegateAmount = "0"
+}
+
+func (o *CosmosHubOptions) Validate() error {
+	r := &report{}
+	if o.StartBlock < 0 {
+		r.add("startBlock", "must not be negative")
+	}
+	for pool, subKey := range o.Pools {
+		if pool == "" || subKey == "" {
+			r.add("pools", "pool %q has an empty key name", pool)
+		}
+	}
+	if amount, ok := new(big.Int).SetString(o.MinUnDelegateAmount, 10); !ok || amount.Sign() < 0 {
+		r.add("minUnDelegateAmount", "must be a non negative integer, got %q", o.MinUnDelegateAmount)
+	}
+	checkGasPrice(r, o.GasPrice, false)
+	return r.err()
+}
+
+func checkGasPrice(r *report, gasPrice string, required bool) {
+	if gasPrice == "" {
+		if required {
+			r.add("gasPrice", "is required")
+		}
+		return
+	}
+	if !gasPriceRegexp.MatchString(gasPrice) {
+		r.add("gasPrice", "invalid gas price %q, e.g. 0.025uatom", gasPrice)
+	}
+}
@@ -4,10 +4,13 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 )
 
 const (
@@ -34,14 +37,71 @@ var (
 )
 
 type Config struct {
-	BlockstorePath string         `json:"blockstorePath"`
-	LogFilePath    string         `json:"logFilePath"`
-	NativeChain    RawChainConfig `json:"nativeChain"`
-	ExternalChain  RawChainConfig `json:"externalChain"`
+	BlockstorePath    string           `json:"blockstorePath"`
+	LogFilePath       string           `json:"logFilePath"`
+	LogLevel          string           `json:"logLevel"` // trace|debug|info|warn|error|fatal|panic, applied again on reload
+	MsgQueue          MsgQueueConfig   `json:"msgQueue"`
+	ShutdownTimeout   uint32           `json:"shutdownTimeout"`   // seconds to wait for in-flight messages on shutdown, only core.AckHandler chains are waited for until their work is done
+	EnableJournal     bool             `json:"enableJournal"`     // journal routed messages under BlockstorePath and replay them after a crash
+	EnableEraProgress bool             `json:"enableEraProgress"` // record the era steps of every pool under BlockstorePath and resume from them
+	Monitor           MonitorConfig    `json:"monitor"`
+	Supervisor        SupervisorConfig `json:"supervisor"`
+	PoolResync        uint32           `json:"poolResync"` // seconds between resyncs of the pools with stafihub, 0 uses the default
+	Retry             RetryConfig      `json:"retry"`
+	NativeChain       RawChainConfig   `json:"nativeChain"`
+	ExternalChain     RawChainConfig   `json:"externalChain"` // deprecated, use ExternalChains
+	ExternalChains    []RawChainConfig `json:"externalChains"`
+
+	path          string
+	unknownFields []string // keys of the config file not matching any field, reported by Validate
+	ignoredEnv    []string // RELAY_* variables not matching any field, reported by the caller
+}
+
+// ExternalChainList returns every configured external chain, the deprecated ExternalChain first
+func (c *Config) ExternalChainList() []RawChainConfig {
+	chains := make([]RawChainConfig, 0, len(c.ExternalChains)+1)
+	if c.ExternalChain.Rsymbol != "" {
+		chains = append(chains, c.ExternalChain)
+	}
+	return append(chains, c.ExternalChains...)
+}
+
+// IgnoredEnv returns the RELAY_* env variables which match no config field and were left out
+func (c *Config) IgnoredEnv() []string {
+	return c.ignoredEnv
+}
+
+// MsgQueueConfig bounds the message queue in front of every chain handler, zero values use the defaults
+type MsgQueueConfig struct {
+	Depth   int    `json:"depth"`   // max pending messages per chain
+	Workers int    `json:"workers"` // max messages handled concurrently per chain
+	Policy  string `json:"policy"`  // behaviour when full: block|dropOldest|error
+}
+
+// MonitorConfig configures the http server exposing prometheus metrics and the /healthz and /readyz probes
+type MonitorConfig struct {
+	ListenAddr string `json:"listenAddr"` // e.g. 127.0.0.1:9100, empty disables the server
+}
+
+// SupervisorConfig bounds the restarts of a failing external chain, zero values use the defaults
+type SupervisorConfig struct {
+	InitialBackoff uint32 `json:"initialBackoff"` // seconds to wait before the first restart, doubled on every failed attempt
+	MaxBackoff     uint32 `json:"maxBackoff"`     // seconds, cap of the wait
+	MaxRestarts    int    `json:"maxRestarts"`    // consecutive restarts before shutting down
+}
+
+// RetryConfig bounds the retries of the stafihub queries run at start and on pool resyncs,
+// zero values use the defaults
+type RetryConfig struct {
+	Attempts       int    `json:"attempts"`       // queries before giving up, over all endpoints of the native chain
+	InitialBackoff uint32 `json:"initialBackoff"` // seconds to wait once every endpoint failed, doubled after every round
+	MaxBackoff     uint32 `json:"maxBackoff"`     // seconds, cap of the wait
+	CallTimeout    uint32 `json:"callTimeout"`    // seconds before a query fails over to the next endpoint
 }
 
 // RawChainConfig is parsed directly from the config file and should be using to construct the core.ChainConfig
 type RawChainConfig struct {
+	Type         string      `json:"type"` // chain type registered in core, e.g. cosmosHub
 	Name         string      `json:"name"`
 	Rsymbol      string      `json:"rsymbol"`
 	EndpointList []string    `json:"endpointList"` // url for rpc endpoint
@@ -49,7 +109,22 @@ type RawChainConfig struct {
 	Opts         interface{} `json:"opts"`
 }
 
+// GetConfig loads the config file and validates it
 func GetConfig(filePath string) (*Config, error) {
+	cfg, err := LoadConfig(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Println("invalid config", "path", cfg.path)
+		return nil, err
+	}
+	fmt.Println("Loaded config", "path", cfg.path)
+	return cfg, nil
+}
+
+// LoadConfig loads the config file and fills defaults without validating it
+func LoadConfig(filePath string) (*Config, error) {
 	var cfg Config
 	path := defaultConfigPath
 	if filePath != "" {
@@ -57,33 +132,73 @@ func GetConfig(filePath string) (*Config, error) {
 	}
 	err := loadConfig(path, &cfg)
 	if err != nil {
-		fmt.Println("err loading json file", "err", err.Error())
+		fmt.Println("err loading config file", "err", err.Error())
 		return nil, err
 	}
 	if len(cfg.LogFilePath) == 0 {
 		cfg.LogFilePath = defaultLogFilePath
 	}
-	fmt.Println("Loaded config", "path", path)
+	cfg.path = path
 	return &cfg, nil
 }
 
-func loadConfig(file string, config *Config) (err error) {
+// SaveConfig writes cfg to filePath as json, yaml or toml following its extension, the
+// deprecated externalChain is left out when it is not set
+func SaveConfig(filePath string, cfg *Config) error {
+	bts, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	tree := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(bts))
+	decoder.UseNumber()
+	if err := decoder.Decode(&tree); err != nil {
+		return err
+	}
+	if cfg.ExternalChain.Rsymbol == "" {
+		delete(tree, "externalChain")
+	}
+	out, err := encodeConfigFile(filepath.Ext(filePath), tree)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, append(out, '\n'), 0600)
+}
+
+func loadConfig(file string, config *Config) error {
 	ext := filepath.Ext(file)
 	fp, err := filepath.Abs(file)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.Open(filepath.Clean(fp))
+	bts, err := os.ReadFile(filepath.Clean(fp))
 	if err != nil {
 		return err
 	}
-	defer func() {
-		err = f.Close()
-	}()
+	tree, err := decodeConfigFile(ext, bts)
+	if err != nil {
+		return err
+	}
+	ignoredEnv, err := applyEnv(tree, os.Environ())
+	if err != nil {
+		return err
+	}
+	config.ignoredEnv = ignoredEnv
 
-	if ext != ".json" {
-		return fmt.Errorf("unrecognized extention: %s", ext)
+	// the tree is decoded through the json tags, whatever the file format. Numbers are
+	// kept as written so free form opts decode into their typed options unchanged.
+	bts, err = json.Marshal(tree)
+	if err != nil {
+		return err
 	}
-	return json.NewDecoder(f).Decode(&config)
+	decoder := json.NewDecoder(bytes.NewReader(bts))
+	decoder.UseNumber()
+	if err := decoder.Decode(config); err != nil {
+		return err
+	}
+
+	config.unknownFields = unknownFields(tree, reflect.TypeOf(config), "")
+	sort.Strings(config.unknownFields)
+	return nil
 }
@@ -0,0 +1,127 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var ErrNoChainOptions = errors.New("no options registered for chain type")
+
+// ChainOptions is the typed opts of a chain type, decoded from RawChainConfig.Opts.
+// Fields are json tagged and may carry a description tag, shown in the json schema,
+// and a required:"true" tag.
+type ChainOptions interface {
+	// SetDefaults fills the fields a config may leave out, it is called before decoding
+	SetDefaults()
+	// Validate checks the decoded values, it may return a ValidationError whose fields
+	// are relative to opts
+	Validate() error
+}
+
+// ChainOptionsConstructor returns new empty options of a chain type
+type ChainOptionsConstructor func() ChainOptions
+
+var (
+	chainOptionsLock sync.RWMutex
+	chainOptions     = map[string]ChainOptionsConstructor{}
+)
+
+// RegisterChainOptions declares the opts of chainType, usually from the init function of
+// the package declaring them. It panics if chainType is registered twice.
+func RegisterChainOptions(chainType string, newOptions ChainOptionsConstructor) {
+	chainOptionsLock.Lock()
+	defer chainOptionsLock.Unlock()
+	if newOptions == nil {
+		panic("config: RegisterChainOptions constructor is nil")
+	}
+	if _, exist := chainOptions[chainType]; exist {
+		panic("config: RegisterChainOptions called twice for type " + chainType)
+	}
+	chainOptions[chainType] = newOptions
+}
+
+// NewChainOptions returns new options of chainType with their defaults set
+func NewChainOptions(chainType string) (ChainOptions, error) {
+	chainOptionsLock.RLock()
+	newOptions, exist := chainOptions[chainType]
+	chainOptionsLock.RUnlock()
+	if !exist {
+		return nil, fmt.Errorf("%w: %q", ErrNoChainOptions, chainType)
+	}
+	options := newOptions()
+	options.SetDefaults()
+	return options, nil
+}
+
+// ChainOptionsTypes returns the chain types having registered options, sorted
+func ChainOptionsTypes() []string {
+	chainOptionsLock.RLock()
+	defer chainOptionsLock.RUnlock()
+	types := make([]string, 0, len(chainOptions))
+	for chainType := range chainOptions {
+		types = append(types, chainType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// DecodeChainOptions decodes opts into the options of chainType over their defaults and
+// validates them. Unknown keys and values of the wrong type are errors.
+func DecodeChainOptions(chainType string, opts interface{}) (ChainOptions, error) {
+	options, err := NewChainOptions(chainType)
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil {
+		bts, err := json.Marshal(opts)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(bts))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(options); err != nil {
+			return nil, err
+		}
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// Options decodes the opts of c, chains configured without a type use defaultType
+func (c *RawChainConfig) Options(defaultType string) (ChainOptions, error) {
+	chainType := c.Type
+	if chainType == "" {
+		chainType = defaultType
+	}
+	return DecodeChainOptions(chainType, c.Opts)
+}
+
+// validateOptions reports the opts problems of c under prefix, types without registered
+// options keep free form opts
+func (c *RawChainConfig) validateOptions(r *report, prefix, defaultType string) {
+	_, err := c.Options(defaultType)
+	if err == nil || errors.Is(err, ErrNoChainOptions) {
+		return
+	}
+	field := "opts"
+	if prefix != "" {
+		field = prefix + ".opts"
+	}
+	var problems ValidationError
+	if errors.As(err, &problems) {
+		for _, fe := range problems {
+			r.add(field+"."+fe.Field, "%s", fe.Err)
+		}
+		return
+	}
+	r.add(field, "%s", err)
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package config
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDecodeChainOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		chainType  string
+		opts       interface{}
+		want       ChainOptions
+		wantFields []string
+		wantErr    error
+	}{
+		{
+			name:      "cosmos defaults",
+			chainType: ChainTypeCosmosHub,
+			want:      &CosmosHubOptions{Pools: map[string]string{}, MinUnDelegateAmount: "0"},
+		},
+		{
+			name:      "cosmos",
+			chainType: ChainTypeCosmosHub,
+			opts:      map[string]interface{}{"startBlock": 12, "pools": map[string]string{"pool1": "sub1"}, "gasPrice": "0.025uatom"},
+			want: &CosmosHubOptions{
+				StartBlock:          12,
+				Pools:               map[string]string{"pool1": "sub1"},
+				MinUnDelegateAmount: "0",
+				GasPrice:            "0.025uatom",
+			},
+		},
+		{
+			name:       "cosmos invalid values",
+			chainType:  ChainTypeCosmosHub,
+			opts:       map[string]interface{}{"startBlock": -1, "pools": map[string]string{"pool1": ""}, "minUnDelegateAmount": "1.5", "gasPrice": "cheap"},
+			wantFields: []string{"gasPrice", "minUnDelegateAmount", "pools", "startBlock"},
+		},
+		{
+			name:       "stafihub required fields",
+			chainType:  ChainTypeStafiHub,
+			opts:       map[string]interface{}{},
+			wantFields: []string{"account", "gasPrice"},
+		},
+		{
+			name:      "stafihub",
+			chainType: ChainTypeStafiHub,
+			opts:      map[string]interface{}{"account": "relay1", "gasPrice": "0.0025ufis"},
+			want:      &StafiHubOptions{Account: "relay1", GasPrice: "0.0025ufis"},
+		},
+		{
+			name:      "unknown key",
+			chainType: ChainTypeCosmosHub,
+			opts:      map[string]interface{}{"pool": "pool1"},
+			wantErr:   errors.New("json: unknown field \"pool\""),
+		},
+		{
+			name:      "wrong type",
+			chainType: ChainTypeCosmosHub,
+			opts:      map[string]interface{}{"startBlock": "12"},
+			wantErr:   errors.New("json: cannot unmarshal string into Go struct field CosmosHubOptions.startBlock of type int"),
+		},
+		{
+			name:      "unregistered type",
+			chainType: "substrate",
+			wantErr:   ErrNoChainOptions,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeChainOptions(tt.chainType, tt.opts)
+			var problems ValidationError
+			switch {
+			case tt.wantErr != nil:
+				if err == nil || !errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error() {
+					t.Fatalf("err %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantFields != nil:
+				if !errors.As(err, &problems) {
+					t.Fatalf("err %v, want a ValidationError", err)
+				}
+				var fields []string
+				for _, fe := range problems {
+					fields = append(fields, fe.Field)
+				}
+				sort.Strings(fields)
+				if !reflect.DeepEqual(fields, tt.wantFields) {
+					t.Fatalf("problems %v, want %v", fields, tt.wantFields)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case !reflect.DeepEqual(got, tt.want):
+				t.Fatalf("options %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterChainOptions(t *testing.T) {
+	if got := ChainOptionsTypes(); !reflect.DeepEqual(got, []string{ChainTypeCosmosHub, ChainTypeStafiHub}) {
+		t.Fatalf("types %v", got)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a type twice did not panic")
+		}
+	}()
+	RegisterChainOptions(ChainTypeCosmosHub, func() ChainOptions { return &CosmosHubOptions{} })
+}
+
+func TestSchema(t *testing.T) {
+	schema := Schema()
+	defs := schema["$defs"].(map[string]interface{})
+	for _, def := range []string{"nativeChain", "externalChain", optionsDef(ChainTypeStafiHub), optionsDef(ChainTypeCosmosHub)} {
+		if defs[def] == nil {
+			t.Fatalf("no $defs/%s", def)
+		}
+	}
+
+	properties := schema["properties"].(map[string]interface{})
+	if properties["externalChain"].(map[string]interface{})["deprecated"] != true {
+		t.Error("externalChain not deprecated")
+	}
+	if msgQueue := properties["msgQueue"].(map[string]interface{}); msgQueue["additionalProperties"] != false {
+		t.Errorf("msgQueue accepts unknown fields: %v", msgQueue)
+	}
+
+	native := defs["nativeChain"].(map[string]interface{})["properties"].(map[string]interface{})
+	if !reflect.DeepEqual(native["opts"], schemaRef(ChainTypeStafiHub)) {
+		t.Errorf("native chain opts %v", native["opts"])
+	}
+	// external chains without a type take the opts of the default type
+	conditions := defs["externalChain"].(map[string]interface{})["allOf"].([]interface{})
+	untyped := conditions[1].(map[string]interface{})["then"].(map[string]interface{})["properties"].(map[string]interface{})
+	if !reflect.DeepEqual(untyped["opts"], schemaRef(DefaultExternalChainType)) {
+		t.Errorf("untyped external chain opts %v", untyped["opts"])
+	}
+
+	stafihub := defs[optionsDef(ChainTypeStafiHub)].(map[string]interface{})
+	if !reflect.DeepEqual(stafihub["required"], []string{"account", "gasPrice"}) {
+		t.Errorf("stafihub opts required %v", stafihub["required"])
+	}
+}
+
+func TestChainOptionsSchema(t *testing.T) {
+	schema, err := ChainOptionsSchema(ChainTypeCosmosHub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties := schema["properties"].(map[string]interface{})
+	tests := []struct {
+		name string
+		want map[string]interface{}
+	}{
+		{name: "startBlock", want: map[string]interface{}{"type": "integer", "description": "block to start from when the blockstore is empty, 0 starts from the latest block"}},
+		{name: "minUnDelegateAmount", want: map[string]interface{}{"type": "string", "description": "unbonds smaller than this amount are skipped", "default": "0"}},
+		{name: "pools", want: map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": map[string]interface{}{"type": "string"},
+			"description":          "multisig pool key name => sub key name in the keystore, empty for ica pools only",
+			"default":              map[string]string{},
+		}},
+	}
+	for _, tt := range tests {
+		if got := properties[tt.name]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := ChainOptionsSchema("substrate"); !errors.Is(err, ErrNoChainOptions) {
+		t.Fatalf("err %v, want %v", err, ErrNoChainOptions)
+	}
+}
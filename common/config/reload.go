@@ -0,0 +1,155 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// the opts key which can be changed while running, every other opts change needs a restart
+const optGasPrice = "gasPrice"
+
+// Reload returns a copy of c taking the fields of next which can be applied while the relay
+// is running: logLevel, the endpointList of every chain and the gasPrice of their opts.
+// The other changed fields, e.g. a keystorePath or an rsymbol, are kept as in c and
+// returned as a ValidationError explaining that they need a restart. next should be valid.
+func (c *Config) Reload(next *Config) (*Config, error) {
+	r := &report{}
+	restart := func(field string, old, new interface{}) {
+		if !reflect.DeepEqual(old, new) {
+			r.add(field, "changed from %s to %s, requires a restart", showValue(old), showValue(new))
+		}
+	}
+
+	restart("blockstorePath", c.BlockstorePath, next.BlockstorePath)
+	restart("logFilePath", c.LogFilePath, next.LogFilePath)
+	restart("msgQueue", c.MsgQueue, next.MsgQueue)
+	restart("shutdownTimeout", c.ShutdownTimeout, next.ShutdownTimeout)
+	restart("enableJournal", c.EnableJournal, next.EnableJournal)
+	restart("enableEraProgress", c.EnableEraProgress, next.EnableEraProgress)
+	restart("monitor", c.Monitor, next.Monitor)
+	restart("supervisor", c.Supervisor, next.Supervisor)
+	restart("poolResync", c.PoolResync, next.PoolResync)
+	restart("retry", c.Retry, next.Retry)
+
+	merged := *c
+	merged.LogLevel = next.LogLevel
+	merged.NativeChain = c.NativeChain.reload(r, "nativeChain", &next.NativeChain)
+
+	// external chains are matched by rsymbol, adding or removing one needs a restart
+	nextChains := make(map[string]*RawChainConfig)
+	for _, chain := range next.ExternalChainList() {
+		chain := chain
+		nextChains[chain.Rsymbol] = &chain
+	}
+	current := make(map[string]bool)
+	for _, chain := range c.ExternalChainList() {
+		current[chain.Rsymbol] = true
+		if nextChains[chain.Rsymbol] == nil {
+			r.add("externalChains", "rsymbol %s removed, requires a restart", chain.Rsymbol)
+		}
+	}
+	for _, chain := range next.ExternalChainList() {
+		if !current[chain.Rsymbol] {
+			r.add("externalChains", "rsymbol %s added, requires a restart", chain.Rsymbol)
+		}
+	}
+
+	reloadChain := func(chain RawChainConfig, prefix string) RawChainConfig {
+		if nextChain := nextChains[chain.Rsymbol]; nextChain != nil {
+			return chain.reload(r, prefix, nextChain)
+		}
+		return chain
+	}
+	if c.ExternalChain.Rsymbol != "" {
+		merged.ExternalChain = reloadChain(c.ExternalChain, "externalChain")
+	}
+	merged.ExternalChains = make([]RawChainConfig, len(c.ExternalChains))
+	for i, chain := range c.ExternalChains {
+		merged.ExternalChains[i] = reloadChain(chain, fmt.Sprintf("externalChains[%d]", i))
+	}
+	return &merged, r.err()
+}
+
+// reload returns a copy of c taking the endpointList and opts gasPrice of next
+func (c *RawChainConfig) reload(r *report, prefix string, next *RawChainConfig) RawChainConfig {
+	restart := func(field string, old, new interface{}) {
+		if !reflect.DeepEqual(old, new) {
+			r.add(prefix+"."+field, "changed from %s to %s, requires a restart", showValue(old), showValue(new))
+		}
+	}
+	restart("type", c.Type, next.Type)
+	restart("name", c.Name, next.Name)
+	restart("rsymbol", c.Rsymbol, next.Rsymbol)
+	restart("keystorePath", c.KeystorePath, next.KeystorePath)
+
+	merged := *c
+	merged.EndpointList = append([]string(nil), next.EndpointList...)
+
+	opts, err := optsMap(c.Opts)
+	if err != nil {
+		r.add(prefix+".opts", "%s", err)
+		return merged
+	}
+	nextOpts, err := optsMap(next.Opts)
+	if err != nil {
+		r.add(prefix+".opts", "%s", err)
+		return merged
+	}
+	gasPrice, nextGasPrice := opts[optGasPrice], nextOpts[optGasPrice]
+	delete(opts, optGasPrice)
+	delete(nextOpts, optGasPrice)
+	if !reflect.DeepEqual(opts, nextOpts) {
+		r.add(prefix+".opts", "changed, only %s can be changed without a restart", optGasPrice)
+	}
+	if !reflect.DeepEqual(gasPrice, nextGasPrice) {
+		// copy opts so the old config keeps its value
+		mergedOpts, _ := optsMap(c.Opts)
+		if nextGasPrice == nil {
+			delete(mergedOpts, optGasPrice)
+		} else {
+			mergedOpts[optGasPrice] = nextGasPrice
+		}
+		merged.Opts = mergedOpts
+	}
+	return merged
+}
+
+// GasPrice returns the gasPrice set in opts, empty if it is not set
+func (c *RawChainConfig) GasPrice() string {
+	opts, err := optsMap(c.Opts)
+	if err != nil {
+		return ""
+	}
+	gasPrice, _ := opts[optGasPrice].(string)
+	return gasPrice
+}
+
+func showValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprintf("%+v", v)
+}
+
+// optsMap returns a json object copy of opts
+func optsMap(opts interface{}) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	if opts == nil {
+		return m, nil
+	}
+	bts, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bts, &m); err != nil {
+		return nil, fmt.Errorf("opts must be an object: %s", err)
+	}
+	if m == nil {
+		m = make(map[string]interface{})
+	}
+	return m, nil
+}
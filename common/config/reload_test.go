@@ -0,0 +1,100 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package config
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestConfigReload(t *testing.T) {
+	tests := []struct {
+		name       string
+		change     func(c *Config)
+		check      func(merged *Config) bool
+		wantFields []string
+	}{
+		{
+			name:   "unchanged",
+			change: func(c *Config) {},
+			check:  func(merged *Config) bool { return merged.ExternalChains[0].GasPrice() == "" },
+		},
+		{
+			name: "live fields",
+			change: func(c *Config) {
+				c.LogLevel = "debug"
+				c.NativeChain.EndpointList = []string{"http://127.0.0.2:26657"}
+				c.ExternalChains[0].Opts = map[string]interface{}{"pools": map[string]interface{}{"pool1": "sub1"}, "gasPrice": "0.01uatom"}
+			},
+			check: func(merged *Config) bool {
+				return merged.LogLevel == "debug" &&
+					reflect.DeepEqual(merged.NativeChain.EndpointList, []string{"http://127.0.0.2:26657"}) &&
+					merged.ExternalChains[0].GasPrice() == "0.01uatom"
+			},
+		},
+		{
+			name: "gas price removed",
+			change: func(c *Config) {
+				c.NativeChain.Opts = map[string]interface{}{"account": "relay1"}
+			},
+			check: func(merged *Config) bool { return merged.NativeChain.GasPrice() == "" },
+		},
+		{
+			name: "restart fields are kept",
+			change: func(c *Config) {
+				c.BlockstorePath = "/other"
+				c.MsgQueue.Depth = 5
+				c.NativeChain.KeystorePath = "/other"
+				c.ExternalChains[0].Opts = map[string]interface{}{"pools": map[string]interface{}{"pool2": "sub2"}}
+			},
+			check: func(merged *Config) bool {
+				return merged.BlockstorePath != "/other" && merged.MsgQueue.Depth == 0 &&
+					merged.NativeChain.KeystorePath != "/other" &&
+					reflect.DeepEqual(merged.ExternalChains[0].Opts, map[string]interface{}{"pools": map[string]interface{}{"pool1": "sub1"}})
+			},
+			wantFields: []string{"blockstorePath", "externalChains[0].opts", "msgQueue", "nativeChain.keystorePath"},
+		},
+		{
+			name: "external chain added and removed",
+			change: func(c *Config) {
+				c.ExternalChains[0].Rsymbol = "uiris"
+			},
+			check:      func(merged *Config) bool { return merged.ExternalChains[0].Rsymbol == "uatom" },
+			wantFields: []string{"externalChains", "externalChains"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig(t)
+			next := validConfig(t)
+			next.BlockstorePath, next.LogFilePath = c.BlockstorePath, c.LogFilePath
+			next.NativeChain.KeystorePath = c.NativeChain.KeystorePath
+			next.ExternalChains[0].KeystorePath = c.ExternalChains[0].KeystorePath
+			tt.change(next)
+
+			merged, err := c.Reload(next)
+			var got []string
+			var problems ValidationError
+			if errors.As(err, &problems) {
+				for _, fe := range problems {
+					got = append(got, fe.Field)
+				}
+			} else if err != nil {
+				t.Fatalf("err %v, want a ValidationError", err)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantFields) {
+				t.Fatalf("restart fields %v, want %v\n%v", got, tt.wantFields, err)
+			}
+			if !tt.check(merged) {
+				t.Fatalf("merged config %+v", merged)
+			}
+			if c.LogLevel != "" || c.NativeChain.GasPrice() != "0.0025ufis" {
+				t.Fatal("reload changed the running config")
+			}
+		})
+	}
+}
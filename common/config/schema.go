@@ -0,0 +1,167 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+const schemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema returns a json schema of the config file, the opts of every chain are checked
+// against the options registered for its type
+func Schema() map[string]interface{} {
+	defs := make(map[string]interface{})
+	for _, chainType := range ChainOptionsTypes() {
+		options, _ := NewChainOptions(chainType)
+		defs[optionsDef(chainType)] = optionsSchema(options)
+	}
+
+	// the native chain is always stafihub, external chains pick their opts by type
+	nativeChain := typeSchema(reflect.TypeOf(RawChainConfig{}))
+	if _, exist := defs[optionsDef(ChainTypeStafiHub)]; exist {
+		nativeChain["properties"].(map[string]interface{})["opts"] = schemaRef(ChainTypeStafiHub)
+	}
+	externalChain := typeSchema(reflect.TypeOf(RawChainConfig{}))
+	var conditions []interface{}
+	for _, chainType := range ChainOptionsTypes() {
+		conditions = append(conditions, map[string]interface{}{
+			"if": map[string]interface{}{
+				"properties": map[string]interface{}{"type": map[string]interface{}{"const": chainType}},
+				"required":   []string{"type"},
+			},
+			"then": map[string]interface{}{
+				"properties": map[string]interface{}{"opts": schemaRef(chainType)},
+			},
+		})
+		if chainType == DefaultExternalChainType {
+			conditions = append(conditions, map[string]interface{}{
+				"if":   map[string]interface{}{"not": map[string]interface{}{"required": []string{"type"}}},
+				"then": map[string]interface{}{"properties": map[string]interface{}{"opts": schemaRef(chainType)}},
+			})
+		}
+	}
+	if len(conditions) > 0 {
+		externalChain["allOf"] = conditions
+	}
+	defs["nativeChain"] = nativeChain
+	defs["externalChain"] = externalChain
+
+	schema := typeSchema(reflect.TypeOf(Config{}))
+	properties := schema["properties"].(map[string]interface{})
+	properties["nativeChain"] = map[string]interface{}{"$ref": "#/$defs/nativeChain"}
+	properties["externalChain"] = map[string]interface{}{"$ref": "#/$defs/externalChain", "deprecated": true}
+	properties["externalChains"] = map[string]interface{}{
+		"type":  "array",
+		"items": map[string]interface{}{"$ref": "#/$defs/externalChain"},
+	}
+	schema["$schema"] = schemaDraft
+	schema["title"] = "rtoken relay config"
+	schema["$defs"] = defs
+	return schema
+}
+
+// ChainOptionsSchema returns a json schema of the opts of chainType
+func ChainOptionsSchema(chainType string) (map[string]interface{}, error) {
+	options, err := NewChainOptions(chainType)
+	if err != nil {
+		return nil, err
+	}
+	schema := optionsSchema(options)
+	schema["$schema"] = schemaDraft
+	schema["title"] = chainType + " opts"
+	return schema, nil
+}
+
+func optionsDef(chainType string) string {
+	return chainType + "Opts"
+}
+
+func schemaRef(chainType string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/$defs/" + optionsDef(chainType)}
+}
+
+// optionsSchema describes options, with their non zero defaults
+func optionsSchema(options ChainOptions) map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(options))
+	value := reflect.Indirect(reflect.ValueOf(options))
+	properties := schema["properties"].(map[string]interface{})
+	for i := 0; i < value.NumField(); i++ {
+		name, ok := jsonName(value.Type().Field(i))
+		if !ok {
+			continue
+		}
+		if field := value.Field(i); !field.IsZero() {
+			properties[name].(map[string]interface{})["default"] = field.Interface()
+		}
+	}
+	return schema
+}
+
+// typeSchema describes t following its json encoding, interface{} fields accept any value
+func typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, ok := jsonName(f)
+			if !ok {
+				continue
+			}
+			property := typeSchema(f.Type)
+			if description := f.Tag.Get("description"); description != "" {
+				property["description"] = description
+			}
+			if f.Tag.Get("required") == "true" {
+				required = append(required, name)
+			}
+			properties[name] = property
+		}
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+// jsonName returns the json name of an exported field, false if json skips it
+func jsonName(f reflect.StructField) (string, bool) {
+	if !f.IsExported() {
+		return "", false
+	}
+	tag := strings.Split(f.Tag.Get("json"), ",")[0]
+	if tag == "-" {
+		return "", false
+	}
+	if tag == "" {
+		return f.Name, true
+	}
+	return tag, true
+}
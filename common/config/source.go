@@ -0,0 +1,346 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config values are read with this precedence: command flags > RELAY_* environment
+// variables > config file.
+//
+// An environment variable overrides the field at its path, segments are separated by a
+// double underscore and written in upper snake case, list entries are addressed by index:
+//
+//	RELAY_BLOCKSTORE_PATH=/data/blockstore
+//	RELAY_MSG_QUEUE__DEPTH=2048
+//	RELAY_NATIVE_CHAIN__ENDPOINT_LIST=http://a:26657,http://b:26657
+//	RELAY_EXTERNAL_CHAINS__0__OPTS__GAS_PRICE=0.025uatom
+//
+// RELAY_* variables matching no config field, e.g. ones used by the deployment, are ignored
+// with a warning.
+const (
+	EnvPrefix        = "RELAY_"
+	envPathSeparator = "__"
+
+	// read by the relay command itself before the config file is loaded
+	EnvConfigPath = EnvPrefix + "CONFIG"
+	// overrides logLevel like any other field
+	EnvLogLevel = EnvPrefix + "LOG_LEVEL"
+)
+
+var configType = reflect.TypeOf(Config{})
+
+// decodeConfigFile decodes a json, yaml or toml file into a json compatible tree
+func decodeConfigFile(ext string, bts []byte) (map[string]interface{}, error) {
+	var raw interface{}
+	switch ext {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(bts))
+		decoder.UseNumber()
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(bts, &raw); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		tree := map[string]interface{}{}
+		if err := toml.Unmarshal(bts, &tree); err != nil {
+			return nil, err
+		}
+		raw = tree
+	default:
+		return nil, fmt.Errorf("unrecognized extention: %s, supported: .json|.yaml|.yml|.toml", ext)
+	}
+
+	if raw == nil {
+		return map[string]interface{}{}, nil
+	}
+	tree, ok := normalizeTree(raw).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config file must contain an object, got %T", raw)
+	}
+	return tree, nil
+}
+
+// encodeConfigFile encodes a json compatible tree as json, yaml or toml
+func encodeConfigFile(ext string, tree map[string]interface{}) ([]byte, error) {
+	switch ext {
+	case ".json":
+		return json.MarshalIndent(tree, "", "  ")
+	case ".yaml", ".yml":
+		return yaml.Marshal(numbersToGo(tree))
+	case ".toml":
+		return toml.Marshal(numbersToGo(tree))
+	}
+	return nil, fmt.Errorf("unrecognized extention: %s, supported: .json|.yaml|.yml|.toml", ext)
+}
+
+// numbersToGo turns the json.Number values of a tree into int64 or float64, which yaml
+// and toml encode as numbers
+func numbersToGo(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, item := range value {
+			value[k] = numbersToGo(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = numbersToGo(item)
+		}
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		if f, err := value.Float64(); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// normalizeTree turns the maps of yaml documents into map[string]interface{} so the tree can be json encoded
+func normalizeTree(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, item := range value {
+			value[k] = normalizeTree(item)
+		}
+		return value
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			m[fmt.Sprint(k)] = normalizeTree(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range value {
+			value[i] = normalizeTree(item)
+		}
+		return value
+	}
+	return v
+}
+
+// applyEnv overrides tree with the RELAY_* variables of environ, it returns the variables
+// not matching any config field, which are left out
+func applyEnv(tree map[string]interface{}, environ []string) ([]string, error) {
+	var ignored []string
+	keys := make([]string, 0)
+	values := make(map[string]string)
+	for _, kv := range environ {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(key, EnvPrefix) || key == EnvConfigPath {
+			continue
+		}
+		keys = append(keys, key)
+		values[key] = value
+	}
+	// apply parents before their children, e.g. a list before one of its entries
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		segments := strings.Split(strings.TrimPrefix(key, EnvPrefix), envPathSeparator)
+		known, err := setPath(tree, configType, segments, values[key])
+		if err != nil {
+			return nil, fmt.Errorf("env %s: %w", key, err)
+		}
+		if !known {
+			ignored = append(ignored, key)
+		}
+	}
+	return ignored, nil
+}
+
+// setPath sets the value at segments below container, t is the type the container decodes to.
+// It returns false if a segment does not match a field of t.
+func setPath(container interface{}, t reflect.Type, segments []string, value string) (bool, error) {
+	segment := segments[0]
+	last := len(segments) == 1
+
+	switch c := container.(type) {
+	case map[string]interface{}:
+		key, next, ok := childKey(c, t, segment)
+		if !ok {
+			return false, nil
+		}
+		if last {
+			v, err := parseEnvValue(value, next, c[key])
+			if err != nil {
+				return true, err
+			}
+			c[key] = v
+			return true, nil
+		}
+		child, ok := c[key]
+		if !ok || child == nil {
+			child = newContainer(next, segments[1])
+			c[key] = child
+		}
+		return setPath(child, next, segments[1:], value)
+	case []interface{}:
+		i, err := strconv.Atoi(segment)
+		if err != nil || i < 0 || i >= len(c) {
+			return true, fmt.Errorf("invalid list index %s, the list has %d entries", segment, len(c))
+		}
+		next := elemType(t)
+		if last {
+			v, err := parseEnvValue(value, next, c[i])
+			if err != nil {
+				return true, err
+			}
+			c[i] = v
+			return true, nil
+		}
+		if c[i] == nil {
+			c[i] = newContainer(next, segments[1])
+		}
+		return setPath(c[i], next, segments[1:], value)
+	}
+	return true, fmt.Errorf("can not set %s below a %T value", segment, container)
+}
+
+// childKey finds the tree key and type of segment in a container decoding to t
+func childKey(m map[string]interface{}, t reflect.Type, segment string) (string, reflect.Type, bool) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	name := normalizeKey(segment)
+
+	if t != nil && t.Kind() == reflect.Struct {
+		for jsonName, ft := range jsonFields(t) {
+			if normalizeKey(jsonName) == name {
+				// keep the spelling already used in the file
+				for key := range m {
+					if normalizeKey(key) == name {
+						return key, ft, true
+					}
+				}
+				return jsonName, ft, true
+			}
+		}
+		return "", nil, false
+	}
+
+	// free form objects such as Opts keep existing keys and use camel case for new ones
+	next := elemType(t)
+	for key := range m {
+		if normalizeKey(key) == name {
+			return key, next, true
+		}
+	}
+	return camelCase(segment), next, true
+}
+
+func elemType(t reflect.Type) reflect.Type {
+	if t != nil && (t.Kind() == reflect.Map || t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		return t.Elem()
+	}
+	return nil
+}
+
+func newContainer(t reflect.Type, nextSegment string) interface{} {
+	if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		return []interface{}{}
+	}
+	if t == nil || t.Kind() == reflect.Interface {
+		if _, err := strconv.Atoi(nextSegment); err == nil {
+			return []interface{}{}
+		}
+	}
+	return map[string]interface{}{}
+}
+
+// parseEnvValue converts value to the type of the field it overrides, free form fields
+// follow the type of the current value or take json, falling back to a string
+func parseEnvValue(value string, t reflect.Type, current interface{}) (interface{}, error) {
+	if t != nil {
+		switch t.Kind() {
+		case reflect.String:
+			return value, nil
+		case reflect.Bool:
+			return strconv.ParseBool(value)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return strconv.ParseInt(value, 10, t.Bits())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return strconv.ParseUint(value, 10, t.Bits())
+		case reflect.Float32, reflect.Float64:
+			return strconv.ParseFloat(value, t.Bits())
+		case reflect.Slice:
+			if t.Elem().Kind() == reflect.String {
+				list := make([]interface{}, 0)
+				for _, item := range strings.Split(value, ",") {
+					if item = strings.TrimSpace(item); item != "" {
+						list = append(list, item)
+					}
+				}
+				return list, nil
+			}
+		}
+		if t.Kind() != reflect.Interface {
+			return parseJSONValue(value)
+		}
+	}
+
+	switch current.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.ParseBool(value)
+	case json.Number, int, int64, uint64, float64:
+		return json.Number(value), nil
+	}
+	if v, err := parseJSONValue(value); err == nil {
+		return v, nil
+	}
+	return value, nil
+}
+
+func parseJSONValue(value string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid json value: %s", err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("invalid json value: %s", value)
+	}
+	return v, nil
+}
+
+// normalizeKey makes BLOCKSTORE_PATH and blockstorePath compare equal
+func normalizeKey(s string) string {
+	return strings.ToLower(strings.ReplaceAll(s, "_", ""))
+}
+
+// camelCase turns GAS_PRICE into gasPrice
+func camelCase(s string) string {
+	parts := strings.Split(strings.ToLower(s), "_")
+	var b strings.Builder
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		if i > 0 && b.Len() > 0 {
+			r := []rune(part)
+			r[0] = unicode.ToUpper(r[0])
+			part = string(r)
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
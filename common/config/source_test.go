@@ -0,0 +1,196 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeConfigFile(t *testing.T) {
+	want := `{"blockstorePath":"/data","externalChains":[{"opts":{"gasPrice":"1uatom"},"rsymbol":"uatom"}],"msgQueue":{"depth":5}}`
+	tests := []struct {
+		name    string
+		ext     string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "json",
+			ext:     ".json",
+			content: `{"blockstorePath": "/data", "msgQueue": {"depth": 5}, "externalChains": [{"rsymbol": "uatom", "opts": {"gasPrice": "1uatom"}}]}`,
+			want:    want,
+		},
+		{
+			name:    "yaml",
+			ext:     ".yaml",
+			content: "blockstorePath: /data\nmsgQueue:\n  depth: 5\nexternalChains:\n  - rsymbol: uatom\n    opts:\n      gasPrice: 1uatom\n",
+			want:    want,
+		},
+		{
+			name:    "toml",
+			ext:     ".toml",
+			content: "blockstorePath = \"/data\"\n[msgQueue]\ndepth = 5\n[[externalChains]]\nrsymbol = \"uatom\"\n[externalChains.opts]\ngasPrice = \"1uatom\"\n",
+			want:    want,
+		},
+		{name: "empty yaml", ext: ".yml", content: "", want: `{}`},
+		{name: "not an object", ext: ".yaml", content: "- a\n- b\n", wantErr: true},
+		{name: "invalid json", ext: ".json", content: `{"blockstorePath":`, wantErr: true},
+		{name: "unknown extension", ext: ".ini", content: "a=b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree, err := decodeConfigFile(tt.ext, []byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := json.Marshal(tree)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("tree %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	file := `{"blockstorePath": "/data", "msgQueue": {"depth": 5}, "nativeChain": {"name": "hub"}, "externalChains": [{"rsymbol": "uatom", "opts": {"gasPrice": "1uatom"}}]}`
+	tests := []struct {
+		name        string
+		environ     []string
+		want        func(c *Config) interface{}
+		wantValue   interface{}
+		wantIgnored []string
+		wantErr     bool
+	}{
+		{
+			name:      "string field",
+			environ:   []string{"RELAY_BLOCKSTORE_PATH=/other"},
+			want:      func(c *Config) interface{} { return c.BlockstorePath },
+			wantValue: "/other",
+		},
+		{
+			name:      "nested number",
+			environ:   []string{"RELAY_MSG_QUEUE__DEPTH=2048"},
+			want:      func(c *Config) interface{} { return c.MsgQueue.Depth },
+			wantValue: 2048,
+		},
+		{
+			name:      "new nested field",
+			environ:   []string{"RELAY_MSG_QUEUE__POLICY=error"},
+			want:      func(c *Config) interface{} { return c.MsgQueue.Policy },
+			wantValue: "error",
+		},
+		{
+			name:      "bool",
+			environ:   []string{"RELAY_ENABLE_JOURNAL=true"},
+			want:      func(c *Config) interface{} { return c.EnableJournal },
+			wantValue: true,
+		},
+		{
+			name:      "string list",
+			environ:   []string{"RELAY_NATIVE_CHAIN__ENDPOINT_LIST=http://a:26657, http://b:26657"},
+			want:      func(c *Config) interface{} { return c.NativeChain.EndpointList },
+			wantValue: []string{"http://a:26657", "http://b:26657"},
+		},
+		{
+			name:      "list entry opts",
+			environ:   []string{"RELAY_EXTERNAL_CHAINS__0__OPTS__GAS_PRICE=0.025uatom"},
+			want:      func(c *Config) interface{} { return c.ExternalChains[0].Opts },
+			wantValue: map[string]interface{}{"gasPrice": "0.025uatom"},
+		},
+		{
+			name:      "new opts key in camel case",
+			environ:   []string{"RELAY_EXTERNAL_CHAINS__0__OPTS__START_BLOCK=12"},
+			want:      func(c *Config) interface{} { return c.ExternalChains[0].Opts },
+			wantValue: map[string]interface{}{"gasPrice": "1uatom", "startBlock": float64(12)},
+		},
+		{
+			name:        "unknown field ignored",
+			environ:     []string{"RELAY_DEPLOYMENT=blue", "RELAY_MSG_QUEUE__SIZE=1", "PATH=/bin"},
+			want:        func(c *Config) interface{} { return c.MsgQueue.Depth },
+			wantValue:   5,
+			wantIgnored: []string{"RELAY_DEPLOYMENT", "RELAY_MSG_QUEUE__SIZE"},
+		},
+		{
+			name:      "config path skipped",
+			environ:   []string{EnvConfigPath + "=/etc/relay.json"},
+			want:      func(c *Config) interface{} { return c.BlockstorePath },
+			wantValue: "/data",
+		},
+		{name: "invalid number", environ: []string{"RELAY_MSG_QUEUE__DEPTH=abc"}, wantErr: true},
+		{name: "index out of range", environ: []string{"RELAY_EXTERNAL_CHAINS__3__RSYMBOL=uosmo"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree, err := decodeConfigFile(".json", []byte(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ignored, err := applyEnv(tree, tt.environ)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(ignored, tt.wantIgnored) {
+				t.Errorf("ignored %v, want %v", ignored, tt.wantIgnored)
+			}
+			bts, err := json.Marshal(tree)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := &Config{}
+			if err := json.Unmarshal(bts, cfg); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.want(cfg); !reflect.DeepEqual(got, tt.wantValue) {
+				t.Fatalf("got %#v, want %#v", got, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		file    string
+		content string
+	}{
+		{file: "config.json", content: `{"msgQueue": {"depth": 5}, "logLevel": "info"}`},
+		{file: "config.yaml", content: "msgQueue:\n  depth: 5\nlogLevel: info\n"},
+		{file: "config.toml", content: "logLevel = \"info\"\n[msgQueue]\ndepth = 5\n"},
+	}
+	t.Setenv("RELAY_MSG_QUEUE__DEPTH", "2048")
+	t.Setenv(EnvLogLevel, "debug")
+	t.Setenv("RELAY_MSG_QUEUE__SIZE", "1")
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.MsgQueue.Depth != 2048 || cfg.LogLevel != "debug" {
+				t.Fatalf("depth %d, log level %s, want the env values", cfg.MsgQueue.Depth, cfg.LogLevel)
+			}
+			if want := []string{"RELAY_MSG_QUEUE__SIZE"}; !reflect.DeepEqual(cfg.IgnoredEnv(), want) {
+				t.Fatalf("ignored env %v, want %v", cfg.IgnoredEnv(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// same syntax as a cosmos-sdk denom
+var rsymbolRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9/:._-]{2,127}$`)
+
+// queue policies understood by core.ParseQueuePolicy
+var queuePolicies = map[string]bool{"": true, "block": true, "dropOldest": true, "error": true}
+
+var endpointSchemes = map[string]bool{"http": true, "https": true, "tcp": true, "ws": true, "wss": true}
+
+// FieldError is a problem found in one config field, Field is its json path
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Err)
+}
+
+// ValidationError reports every problem found by Validate
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	lines := make([]string, 0, len(e)+1)
+	lines = append(lines, fmt.Sprintf("%d config problem(s):", len(e)))
+	for _, fe := range e {
+		lines = append(lines, "  "+fe.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+type report struct {
+	errs ValidationError
+}
+
+func (r *report) add(field string, format string, args ...interface{}) {
+	r.errs = append(r.errs, FieldError{Field: field, Err: fmt.Errorf(format, args...)})
+}
+
+func (r *report) err() error {
+	if len(r.errs) == 0 {
+		return nil
+	}
+	return r.errs
+}
+
+// Validate checks c and its chain configs, returning a ValidationError listing every problem
+func (c *Config) Validate() error {
+	r := &report{}
+	for _, field := range c.unknownFields {
+		r.add(field, "unknown field")
+	}
+
+	checkWritableDir(r, "blockstorePath", c.BlockstorePath)
+	checkWritableDir(r, "logFilePath", c.LogFilePath)
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+			r.add("logLevel", "%s", err)
+		}
+	}
+
+	if c.MsgQueue.Depth < 0 {
+		r.add("msgQueue.depth", "must not be negative")
+	}
+	if c.MsgQueue.Workers < 0 {
+		r.add("msgQueue.workers", "must not be negative")
+	}
+	if !queuePolicies[c.MsgQueue.Policy] {
+		r.add("msgQueue.policy", "unknown policy %q, supported: block|dropOldest|error", c.MsgQueue.Policy)
+	}
+	if c.Monitor.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.Monitor.ListenAddr); err != nil {
+			r.add("monitor.listenAddr", "%s", err)
+		}
+	}
+	if c.Supervisor.MaxBackoff != 0 && c.Supervisor.MaxBackoff < c.Supervisor.InitialBackoff {
+		r.add("supervisor.maxBackoff", "must not be less than initialBackoff")
+	}
+	if c.Supervisor.MaxRestarts < 0 {
+		r.add("supervisor.maxRestarts", "must not be negative")
+	}
+	if c.Retry.Attempts < 0 {
+		r.add("retry.attempts", "must not be negative")
+	}
+	if c.Retry.MaxBackoff != 0 && c.Retry.MaxBackoff < c.Retry.InitialBackoff {
+		r.add("retry.maxBackoff", "must not be less than initialBackoff")
+	}
+
+	// the native chain rsymbol is always RFIS and set by the relay
+	c.NativeChain.validate(r, "nativeChain", false)
+	c.NativeChain.validateOptions(r, "nativeChain", ChainTypeStafiHub)
+	if c.NativeChain.KeystorePath == "" {
+		r.add("nativeChain.keystorePath", "is required")
+	}
+
+	if c.ExternalChain.Rsymbol != "" {
+		c.ExternalChain.validate(r, "externalChain", true)
+		c.ExternalChain.validateOptions(r, "externalChain", DefaultExternalChainType)
+	}
+	for i := range c.ExternalChains {
+		prefix := fmt.Sprintf("externalChains[%d]", i)
+		c.ExternalChains[i].validate(r, prefix, true)
+		c.ExternalChains[i].validateOptions(r, prefix, DefaultExternalChainType)
+	}
+	externalChains := c.ExternalChainList()
+	if len(externalChains) == 0 {
+		r.add("externalChains", "at least one external chain is required")
+	}
+	seen := make(map[string]bool)
+	for _, chain := range externalChains {
+		if chain.Rsymbol != "" && seen[chain.Rsymbol] {
+			r.add("externalChains", "duplicate rsymbol %s", chain.Rsymbol)
+		}
+		seen[chain.Rsymbol] = true
+	}
+	return r.err()
+}
+
+// Validate checks the fields and opts of an external chain config
+func (c *RawChainConfig) Validate() error {
+	r := &report{}
+	c.validate(r, "", true)
+	c.validateOptions(r, "", DefaultExternalChainType)
+	return r.err()
+}
+
+func (c *RawChainConfig) validate(r *report, prefix string, requireRsymbol bool) {
+	field := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + "." + name
+	}
+
+	if c.Name == "" {
+		r.add(field("name"), "is required")
+	}
+	if c.Rsymbol == "" {
+		if requireRsymbol {
+			r.add(field("rsymbol"), "is required")
+		}
+	} else if !rsymbolRegexp.MatchString(c.Rsymbol) {
+		r.add(field("rsymbol"), "invalid rsymbol %q", c.Rsymbol)
+	}
+
+	if len(c.EndpointList) == 0 {
+		r.add(field("endpointList"), "at least one endpoint is required")
+	}
+	for i, endpoint := range c.EndpointList {
+		if err := checkEndpoint(endpoint); err != nil {
+			r.add(fmt.Sprintf("%s[%d]", field("endpointList"), i), "%s", err)
+		}
+	}
+
+	if c.KeystorePath != "" {
+		checkReadableDir(r, field("keystorePath"), c.KeystorePath)
+	}
+}
+
+func checkEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if !endpointSchemes[u.Scheme] {
+		return fmt.Errorf("unsupported scheme %q in %s", u.Scheme, endpoint)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host in %s", endpoint)
+	}
+	return nil
+}
+
+// checkReadableDir checks that path is an existing directory which can be listed
+func checkReadableDir(r *report, field, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		r.add(field, "%s", err)
+		return
+	}
+	if !info.IsDir() {
+		r.add(field, "%s is not a directory", path)
+		return
+	}
+	if _, err := os.ReadDir(path); err != nil {
+		r.add(field, "%s", err)
+	}
+}
+
+// checkWritableDir checks that path, or its nearest existing parent if it is created on
+// demand, is a directory files can be created in. An empty path uses the default and is skipped.
+func checkWritableDir(r *report, field, path string) {
+	if path == "" {
+		return
+	}
+	dir := filepath.Clean(path)
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				r.add(field, "%s is not a directory", dir)
+				return
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			r.add(field, "%s", err)
+			return
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return
+		}
+		dir = parent
+	}
+
+	f, err := os.CreateTemp(dir, ".relay-validate-*")
+	if err != nil {
+		r.add(field, "%s is not writable: %s", dir, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// unknownFields returns the json paths of the keys in raw that t has no field for, the
+// content of interface{} fields such as Opts is not checked
+func unknownFields(raw interface{}, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var unknown []string
+	switch v := raw.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		fields := jsonFields(t)
+		for key, value := range v {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			ft, ok := lookupJSONField(fields, key)
+			if !ok {
+				unknown = append(unknown, path)
+				continue
+			}
+			unknown = append(unknown, unknownFields(value, ft, path)...)
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return nil
+		}
+		for i, value := range v {
+			unknown = append(unknown, unknownFields(value, t.Elem(), fmt.Sprintf("%s[%d]", prefix, i))...)
+		}
+	}
+	return unknown
+}
+
+// jsonFields maps the json names of the exported fields of t to their types
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name, ok := jsonName(f); ok {
+			fields[name] = f.Type
+		}
+	}
+	return fields
+}
+
+// lookupJSONField matches key like encoding/json does, preferring an exact match
+func lookupJSONField(fields map[string]reflect.Type, key string) (reflect.Type, bool) {
+	if t, ok := fields[key]; ok {
+		return t, true
+	}
+	for name, t := range fields {
+		if strings.EqualFold(name, key) {
+			return t, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// validConfig returns a config passing Validate, its directories are created under t.TempDir
+func validConfig(t *testing.T) *Config {
+	dir := t.TempDir()
+	return &Config{
+		BlockstorePath: filepath.Join(dir, "blockstore"),
+		LogFilePath:    filepath.Join(dir, "log"),
+		NativeChain: RawChainConfig{
+			Name:         "stafihub",
+			EndpointList: []string{"http://127.0.0.1:26657"},
+			KeystorePath: dir,
+			Opts:         map[string]interface{}{"account": "relay1", "gasPrice": "0.0025ufis"},
+		},
+		ExternalChains: []RawChainConfig{{
+			Name:         "cosmoshub",
+			Rsymbol:      "uatom",
+			EndpointList: []string{"https://rpc.cosmos.network:443"},
+			KeystorePath: dir,
+			Opts:         map[string]interface{}{"pools": map[string]interface{}{"pool1": "sub1"}},
+		}},
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		change     func(c *Config)
+		wantFields []string
+	}{
+		{name: "valid", change: func(c *Config) {}},
+		{
+			name:       "log level",
+			change:     func(c *Config) { c.LogLevel = "verbose" },
+			wantFields: []string{"logLevel"},
+		},
+		{
+			name: "queue, monitor, supervisor and retry",
+			change: func(c *Config) {
+				c.MsgQueue = MsgQueueConfig{Depth: -1, Workers: -1, Policy: "drop"}
+				c.Monitor.ListenAddr = "9100"
+				c.Supervisor = SupervisorConfig{InitialBackoff: 10, MaxBackoff: 5, MaxRestarts: -1}
+				c.Retry = RetryConfig{Attempts: -1, InitialBackoff: 10, MaxBackoff: 5}
+			},
+			wantFields: []string{
+				"monitor.listenAddr", "msgQueue.depth", "msgQueue.policy", "msgQueue.workers",
+				"retry.attempts", "retry.maxBackoff", "supervisor.maxBackoff", "supervisor.maxRestarts",
+			},
+		},
+		{
+			name: "native chain",
+			change: func(c *Config) {
+				c.NativeChain.Name = ""
+				c.NativeChain.KeystorePath = ""
+				c.NativeChain.EndpointList = []string{"ftp://127.0.0.1", "http://"}
+				c.NativeChain.Opts = map[string]interface{}{"gasPrice": "cheap"}
+			},
+			wantFields: []string{
+				"nativeChain.endpointList[0]", "nativeChain.endpointList[1]", "nativeChain.keystorePath",
+				"nativeChain.name", "nativeChain.opts.account", "nativeChain.opts.gasPrice",
+			},
+		},
+		{
+			name: "external chain",
+			change: func(c *Config) {
+				c.ExternalChains[0].Rsymbol = "1atom"
+				c.ExternalChains[0].EndpointList = nil
+				c.ExternalChains[0].KeystorePath = filepath.Join(c.ExternalChains[0].KeystorePath, "missing")
+				c.ExternalChains[0].Opts = map[string]interface{}{"minUnDelegateAmount": "-1", "unknown": 1}
+			},
+			wantFields: []string{
+				"externalChains[0].endpointList", "externalChains[0].keystorePath",
+				"externalChains[0].opts", "externalChains[0].rsymbol",
+			},
+		},
+		{
+			name:       "no external chain",
+			change:     func(c *Config) { c.ExternalChains = nil },
+			wantFields: []string{"externalChains"},
+		},
+		{
+			name: "duplicate rsymbol with the deprecated external chain",
+			change: func(c *Config) {
+				c.ExternalChain = c.ExternalChains[0]
+			},
+			wantFields: []string{"externalChains"},
+		},
+		{
+			name: "blockstore path is a file",
+			change: func(c *Config) {
+				path := filepath.Join(c.NativeChain.KeystorePath, "file")
+				if err := os.WriteFile(path, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+				c.BlockstorePath = path
+			},
+			wantFields: []string{"blockstorePath"},
+		},
+		{
+			name:       "unknown fields of the file",
+			change:     func(c *Config) { c.unknownFields = []string{"msgQueue.size"} },
+			wantFields: []string{"msgQueue.size"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig(t)
+			tt.change(c)
+			err := c.Validate()
+
+			var got []string
+			var problems ValidationError
+			if errors.As(err, &problems) {
+				for _, fe := range problems {
+					got = append(got, fe.Field)
+				}
+			} else if err != nil {
+				t.Fatalf("err %v, want a ValidationError", err)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantFields) {
+				t.Fatalf("problems %v, want %v\n%v", got, tt.wantFields, err)
+			}
+		})
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{
+		"blockstorePath": "/data",
+		"msgQueue": {"depth": 5, "size": 1},
+		"nativeChain": {"name": "stafihub", "opts": {"anything": 1}},
+		"externalChains": [{"rsymbol": "uatom", "endpoints": []}],
+		"Retry": {"attempts": 3},
+		"extra": true
+	}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"externalChains[0].endpoints", "extra", "msgQueue.size"}
+	if !reflect.DeepEqual(cfg.unknownFields, want) {
+		t.Fatalf("unknown fields %v, want %v", cfg.unknownFields, want)
+	}
+}
@@ -16,3 +16,35 @@ type Chain interface {
 	Name() string
 	Stop()
 }
+
+// ChainMetrics is implemented by chains exporting their own gauges to the metrics endpoint,
+// e.g. the latest block handled. Gauges is called on every scrape and must not block.
+type ChainMetrics interface {
+	Gauges() map[string]float64
+}
+
+// ChainHealth is implemented by chains that can tell whether they are still making progress,
+// Health returns an error once the chain has stalled, e.g. no new block for too long
+type ChainHealth interface {
+	Health() error
+}
+
+// ChainReloader is implemented by chains that can apply a changed config while running,
+// only the fields accepted by config.Config.Reload change, e.g. the endpointList and the
+// opts gasPrice. Chains not implementing it take the change on their next restart.
+type ChainReloader interface {
+	Reload(cfg *config.RawChainConfig) error
+}
+
+// ChainPools is implemented by chains that can take new pools while running, UpdatePools is
+// called with the registry snapshot when a resync finds pools of denom changed without an event
+type ChainPools interface {
+	UpdatePools(denom string, snapshot *PoolSnapshot) error
+}
+
+// ChainEraSteps is implemented by chains acknowledging the era events they handle with
+// Router.EraStepDone once the tx of the step landed. The era step of an event handed to
+// another chain is done once its handler returns.
+type ChainEraSteps interface {
+	AcknowledgesEraSteps() bool
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrUnsupportedChainType = errors.New("unsupported chain type")
+
+// ChainConstructor returns a new chain which the caller initializes
+type ChainConstructor func() Chain
+
+var (
+	chainTypesLock sync.RWMutex
+	chainTypes     = map[string]ChainConstructor{}
+)
+
+// RegisterChainType makes a chain implementation available by type name, usually from the
+// init function of the package registering it. It panics if typeName is registered twice.
+func RegisterChainType(typeName string, newChain ChainConstructor) {
+	chainTypesLock.Lock()
+	defer chainTypesLock.Unlock()
+	if newChain == nil {
+		panic("core: RegisterChainType constructor is nil")
+	}
+	if _, exist := chainTypes[typeName]; exist {
+		panic("core: RegisterChainType called twice for type " + typeName)
+	}
+	chainTypes[typeName] = newChain
+}
+
+// NewChainByType returns a new chain of the registered typeName
+func NewChainByType(typeName string) (Chain, error) {
+	chainTypesLock.RLock()
+	newChain, exist := chainTypes[typeName]
+	chainTypesLock.RUnlock()
+	if !exist {
+		return nil, fmt.Errorf("%w: %q, supported: %s", ErrUnsupportedChainType, typeName, strings.Join(SupportedChainTypes(), "|"))
+	}
+	return newChain(), nil
+}
+
+// SupportedChainTypes returns the registered type names sorted
+func SupportedChainTypes() []string {
+	chainTypesLock.RLock()
+	defer chainTypesLock.RUnlock()
+	types := make([]string, 0, len(chainTypes))
+	for typeName := range chainTypes {
+		types = append(types, typeName)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -4,64 +4,160 @@
 package core
 
 import (
-	"fmt"
 	sdk "github.com/cosmos/cosmos-sdk/types"
 	"github.com/stafihub/rtoken-relay-core/common/log"
-	"os"
-	"os/signal"
+	"net/http"
 	"sync"
-	"syscall"
+	"sync/atomic"
 )
 
 type Core struct {
-	Registry []Chain
-	route    *Router
-	log      log.Logger
-	sysErr   <-chan error
+	Registry      []Chain
+	chainsLock    sync.RWMutex
+	route         *Router
+	routerOpts    []RouterOption
+	log           log.Logger
+	sysErr        <-chan error
+	metrics       *Metrics
+	monitorAddr   string
+	monitor       *http.Server
+	started       atomic.Bool
+	supervisorCfg SupervisorConfig
+	supervised    map[RSymbol]*supervisedChain
+	failures      chan chainFailure
+	instances     atomic.Uint64
+	restarting    atomic.Int32
+	pools         *PoolRegistry
+	eraProgress   *EraProgress
+	restarts      chan restartRequest
+	stop          chan struct{} // closed once the core stops supervising
 }
 
-func NewCore(logger log.Logger, sysErr <-chan error) *Core {
-	return &Core{
-		Registry: make([]Chain, 0),
-		route:    NewRouter(logger),
-		log:      logger,
-		sysErr:   sysErr,
+// CoreOption customizes a Core created by NewCore
+type CoreOption func(*Core)
+
+// WithRouterOptions passes opts to the Router shared by all chains
+func WithRouterOptions(opts ...RouterOption) CoreOption {
+	return func(c *Core) {
+		c.routerOpts = append(c.routerOpts, opts...)
 	}
 }
 
+func NewCore(logger log.Logger, sysErr <-chan error, opts ...CoreOption) *Core {
+	c := &Core{
+		Registry:      make([]Chain, 0),
+		log:           logger,
+		sysErr:        sysErr,
+		supervisorCfg: DefaultSupervisorConfig(),
+		supervised:    make(map[RSymbol]*supervisedChain),
+		failures:      make(chan chainFailure),
+		restarts:      make(chan restartRequest),
+		stop:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.metrics == nil && c.monitorAddr != "" {
+		c.metrics = NewMetrics()
+	}
+	if c.metrics != nil {
+		c.routerOpts = append(c.routerOpts, WithInterceptors(c.metrics))
+	}
+	c.route = NewRouter(logger, c.routerOpts...)
+	if c.metrics != nil {
+		c.metrics.registry.MustRegister(newCoreCollector(c))
+	}
+	return c
+}
+
 // AddChain registers the chain in the Registry and calls Chain.SetRouter()
 func (c *Core) AddChain(chain Chain) {
+	c.chainsLock.Lock()
 	c.Registry = append(c.Registry, chain)
+	c.chainsLock.Unlock()
 	chain.SetRouter(c.route)
 }
 
-// Start will call all registered chains' Start methods and block forever (or until signal is received)
-func (c *Core) Start() {
+// chains returns a snapshot of the Registry
+func (c *Core) chains() []Chain {
+	c.chainsLock.RLock()
+	defer c.chainsLock.RUnlock()
+	return append([]Chain(nil), c.Registry...)
+}
+
+func (c *Core) chain(symbol RSymbol) Chain {
+	c.chainsLock.RLock()
+	defer c.chainsLock.RUnlock()
 	for _, chain := range c.Registry {
-		err := chain.Start()
-		if err != nil {
-			c.log.Error("failed to start chain", "chain", chain.RSymbol(), "err", err)
+		if chain.RSymbol() == symbol {
+			return chain
+		}
+	}
+	return nil
+}
+
+// replaceChain swaps the registered chain having the same RSymbol for chain
+func (c *Core) replaceChain(chain Chain) {
+	c.chainsLock.Lock()
+	defer c.chainsLock.Unlock()
+	for i, old := range c.Registry {
+		if old.RSymbol() == chain.RSymbol() {
+			c.Registry[i] = chain
 			return
 		}
-		c.log.Info(fmt.Sprintf("Started %s chain", chain.Name()))
 	}
+}
 
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
-	defer signal.Stop(sigc)
+// Start will call all registered chains' Start methods and block forever (or until signal is received).
+// If a chain fails to start, the chains already started are stopped.
+func (c *Core) Start() {
+	// messages left by a crash, then era events whose step was not done, go before
+	// anything the chains send
+	c.resumeEras(c.route.replayJournal())
 
-	// Block here and wait for a signal
-	select {
-	case err := <-c.sysErr:
-		c.log.Error("FATAL ERROR. Shutting down.", "err", err)
-	case sig := <-sigc:
-		c.log.Warn("Interrupt received, shutting down now. signal:", sig.String())
+	if err := c.startMonitor(); err != nil {
+		c.log.Error("failed to start monitor server", "addr", c.monitorAddr, "err", err)
+		return
 	}
+	defer c.stopMonitor()
+
+	started, err := c.startChains()
+	if err != nil {
+		c.log.Error("failed to start chain", "err", err)
+		close(c.stop)
+		c.shutdown(started)
+		return
+	}
+	c.started.Store(true)
+	stopResync := c.startPoolResync()
 
-	c.route.StopMsgHandler()
-	// Signal chains to shutdown
-	for _, chain := range c.Registry {
-		chain.Stop()
+	// Block here and wait for a signal or a fatal error
+	c.supervise()
+	close(c.stop)
+	close(stopResync)
+
+	c.started.Store(false)
+	c.shutdown(c.chains())
+}
+
+// shutdown waits for in-flight messages and stops chains
+func (c *Core) shutdown(chains []Chain) {
+	// Wait for in-flight messages before the chains they depend on are stopped
+	abandoned := c.route.StopMsgHandler()
+	for _, msg := range abandoned {
+		c.log.Warn("message abandoned on shutdown", "source", msg.Source, "dest", msg.Destination, "reason", msg.Reason, "content", msg.Content)
+	}
+	if len(abandoned) == 0 {
+		c.log.Info("all routed messages handled before shutdown")
+	}
+
+	// Signal chains to shutdown, in reverse start order
+	for i := len(chains) - 1; i >= 0; i-- {
+		// a chain interrupted while restarting is already stopped
+		if sc, ok := c.supervised[chains[i].RSymbol()]; ok && sc.restarting {
+			continue
+		}
+		chains[i].Stop()
 	}
 }
 
@@ -0,0 +1,495 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	"github.com/stafihub/rtoken-relay-core/common/utils"
+	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
+)
+
+const (
+	eraProgressBucket     = "era_progress"
+	eraProgressShotBucket = "era_progress_shots" // shot id => record key
+
+	// eras kept per pool, older records are pruned when a new era starts
+	eraProgressKeep = 8
+)
+
+// EraStep is a step of the era of a pool, in the order stafihub reports them
+type EraStep uint8
+
+const (
+	EraStepNone EraStep = iota
+	EraStepEraUpdated
+	EraStepBondReported
+	EraStepActiveReported
+	EraStepTransferReported
+)
+
+var eraStepNames = [...]string{"none", "eraUpdated", "bondReported", "activeReported", "transferReported"}
+
+func (s EraStep) String() string {
+	if int(s) < len(eraStepNames) {
+		return eraStepNames[s]
+	}
+	return fmt.Sprintf("EraStep(%d)", s)
+}
+
+// EraSignature is a proposal of the era stafihub reported signed by enough relayers
+type EraSignature struct {
+	TxType stafiHubXLedgerTypes.OriginalTxType `json:"txType"`
+	PropId string                              `json:"propId"`
+}
+
+// EraPendingEvent is the stafihub event of an era step handed to a chain whose step is not
+// done yet, it is sent again on the next start
+type EraPendingEvent struct {
+	Step        EraStep         `json:"step"`
+	Source      RSymbol         `json:"source"`
+	Destination RSymbol         `json:"destination"`
+	ContentType string          `json:"contentType"`
+	Content     json.RawMessage `json:"content"`
+}
+
+// message decodes the event back to the message handed to the chain
+func (e *EraPendingEvent) message() (*Message, error) {
+	content, err := DecodeContent(nil, e.ContentType, e.Content)
+	if err != nil {
+		return nil, err
+	}
+	payload, ok := content.(Payload)
+	if !ok {
+		return nil, fmt.Errorf("content type %s has no reason", e.ContentType)
+	}
+	return &Message{Source: e.Source, Destination: e.Destination, Reason: payload.Reason(), Content: content}, nil
+}
+
+// EraProgressRecord is how far the era of a pool went. Step is the last step done by the
+// chain, Pending the event of a later step handed to the chain.
+type EraProgressRecord struct {
+	Denom      string           `json:"denom"`
+	Pool       string           `json:"pool"`
+	Era        uint32           `json:"era"`
+	ShotId     string           `json:"shotId,omitempty"`
+	Step       EraStep          `json:"step"`
+	Pending    *EraPendingEvent `json:"pending,omitempty"`
+	Signatures []EraSignature   `json:"signatures,omitempty"`
+	UpdatedAt  time.Time        `json:"updatedAt"`
+}
+
+// Done tells the last step of the era is done
+func (r *EraProgressRecord) Done() bool {
+	return r.Step >= EraStepTransferReported
+}
+
+// done records step as done, a pending event of that step or an earlier one is no longer sent again
+func (r *EraProgressRecord) done(step EraStep) {
+	if step > r.Step {
+		r.Step = step
+	}
+	if r.Pending != nil && r.Pending.Step <= r.Step {
+		r.Pending = nil
+	}
+}
+
+func (r *EraProgressRecord) signature(propId string) *EraSignature {
+	for i := range r.Signatures {
+		if r.Signatures[i].PropId == propId {
+			return &r.Signatures[i]
+		}
+	}
+	return nil
+}
+
+// eraProgressKey orders the records of a pool by era
+func eraProgressKey(denom, pool string, era uint32) []byte {
+	return []byte(fmt.Sprintf("%s/%s/%010d", denom, pool, era))
+}
+
+func eraProgressPoolPrefix(denom, pool string) []byte {
+	return []byte(fmt.Sprintf("%s/%s/", denom, pool))
+}
+
+// EraProgress records in a state store the era steps of every pool. The stafihub event of a
+// step is pending from when it is handed to a chain until the step is done: when the handler
+// of the chain returns, or for chains implementing ChainEraSteps once they acknowledge it with
+// EraStepDone, sent after the tx of the step landed. Pending events are sent to the chain again
+// on the next start, so the relay resumes the era where it stopped, and the same events found
+// again by the rescan of the chains are dropped. Chains can read the records with
+// Router.EraProgress. Add it to a Core with WithEraProgress.
+type EraProgress struct {
+	BaseInterceptor
+	store utils.StateStore
+	log   log.Logger
+	lock  sync.Mutex // serializes the read-modify-write of records
+	// reports whether the chain of a symbol acknowledges its era steps, set by WithEraProgress
+	acknowledges func(symbol RSymbol) bool
+
+	resentLock sync.Mutex
+	resent     []*Message // pending events sent again on start, not found again by a rescan yet
+}
+
+func NewEraProgress(store utils.StateStore, logger log.Logger) *EraProgress {
+	return &EraProgress{store: store, log: logger}
+}
+
+// Progress returns the record of the era of pool, found is false if nothing was recorded
+func (p *EraProgress) Progress(denom, pool string, era uint32) (record EraProgressRecord, found bool, err error) {
+	err = p.store.View(func(tx utils.StateTx) error {
+		dat := tx.Bucket(eraProgressBucket).Get(eraProgressKey(denom, pool, era))
+		if dat == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(dat, &record)
+	})
+	return record, found, err
+}
+
+// Unfinished returns the latest era of every pool when its last step is not done yet
+func (p *EraProgress) Unfinished() ([]EraProgressRecord, error) {
+	latest := make(map[string]EraProgressRecord)
+	order := make([]string, 0)
+	err := p.store.View(func(tx utils.StateTx) error {
+		return tx.Bucket(eraProgressBucket).ForEach(func(key, value []byte) error {
+			record := EraProgressRecord{}
+			if err := json.Unmarshal(value, &record); err != nil {
+				return fmt.Errorf("era progress %s: %w", key, err)
+			}
+			pool := record.Denom + "/" + record.Pool
+			if _, exist := latest[pool]; !exist {
+				order = append(order, pool)
+			}
+			// keys are in era order
+			latest[pool] = record
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]EraProgressRecord, 0, len(order))
+	for _, pool := range order {
+		if record := latest[pool]; !record.Done() {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// eraEvent returns the era step reported by the content of an event, ok is false for other
+// contents or when the era of a transfer report is not known
+func eraEvent(tx utils.StateTx, content interface{}) (denom, pool string, era uint32, shotId string, step EraStep, ok bool) {
+	switch content := content.(type) {
+	case EventEraPoolUpdated:
+		return content.Denom, content.Snapshot.Pool, content.Snapshot.Era, content.ShotId, EraStepEraUpdated, true
+	case EventBondReported:
+		return content.Denom, content.Snapshot.Pool, content.Snapshot.Era, content.ShotId, EraStepBondReported, true
+	case EventActiveReported:
+		return content.Denom, content.Snapshot.Pool, content.Snapshot.Era, content.ShotId, EraStepActiveReported, true
+	case EventTransferReported:
+		// the transfer report only has the shot id of the era
+		key := tx.Bucket(eraProgressShotBucket).Get([]byte(content.ShotId))
+		if key == nil {
+			return "", "", 0, "", EraStepNone, false
+		}
+		dat := tx.Bucket(eraProgressBucket).Get(key)
+		record := EraProgressRecord{}
+		if dat == nil || json.Unmarshal(dat, &record) != nil {
+			return "", "", 0, "", EraStepNone, false
+		}
+		return record.Denom, record.Pool, record.Era, content.ShotId, EraStepTransferReported, true
+	}
+	return "", "", 0, "", EraStepNone, false
+}
+
+// PreSend records the era events handed to the chains as pending, a failure to record one is
+// logged and the event is still sent
+func (p *EraProgress) PreSend(msg *Message) error {
+	switch msg.Content.(type) {
+	case EventEraPoolUpdated, EventBondReported, EventActiveReported, EventTransferReported:
+	default:
+		return nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var updated *EraProgressRecord
+	err := p.store.Update(func(tx utils.StateTx) error {
+		denom, pool, era, shotId, step, ok := eraEvent(tx, msg.Content)
+		if !ok {
+			return nil
+		}
+		// era events carry no sdk.Msg, they encode without a codec
+		contentType, dat, err := EncodeContent(nil, msg.Content)
+		if err != nil {
+			return err
+		}
+		record, err := p.modify(tx, denom, pool, era, func(record *EraProgressRecord) {
+			if step > record.Step && (record.Pending == nil || step >= record.Pending.Step) {
+				record.Pending = &EraPendingEvent{
+					Step:        step,
+					Source:      msg.Source,
+					Destination: msg.Destination,
+					ContentType: contentType,
+					Content:     dat,
+				}
+			}
+			if record.ShotId == "" {
+				record.ShotId = shotId
+			}
+		})
+		if err == nil && shotId != "" {
+			err = tx.Bucket(eraProgressShotBucket).Put([]byte(shotId), eraProgressKey(denom, pool, era))
+		}
+		updated = &record
+		return err
+	})
+	if err != nil {
+		p.log.Error("record era progress failed", "reason", msg.Reason, "err", err)
+		return nil
+	}
+	if updated != nil {
+		p.logRecord("era event handed to chain", updated)
+	}
+	return nil
+}
+
+// PostHandle records the proposals stafihub reported signed enough, and the step of an era
+// event as done when its chain does not acknowledge the steps itself
+func (p *EraProgress) PostHandle(msg *Message, _ time.Duration) {
+	switch content := msg.Content.(type) {
+	case EventSignatureEnough:
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		var record EraProgressRecord
+		err := p.store.Update(func(tx utils.StateTx) error {
+			var err error
+			record, err = p.modify(tx, content.Denom, content.Pool, content.Era, func(record *EraProgressRecord) {
+				if record.signature(content.ProposalId) == nil {
+					record.Signatures = append(record.Signatures, EraSignature{TxType: content.TxType, PropId: content.ProposalId})
+				}
+			})
+			return err
+		})
+		if err != nil {
+			p.log.Error("record era progress failed", "reason", msg.Reason, "err", err)
+			return
+		}
+		p.logRecord("era signature recorded", &record)
+	case EventEraPoolUpdated, EventBondReported, EventActiveReported, EventTransferReported:
+		if p.acknowledges != nil && p.acknowledges(msg.Destination) {
+			return
+		}
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		var record *EraProgressRecord
+		err := p.store.Update(func(tx utils.StateTx) error {
+			denom, pool, era, _, step, ok := eraEvent(tx, msg.Content)
+			if !ok {
+				return nil
+			}
+			done, err := p.modify(tx, denom, pool, era, func(record *EraProgressRecord) { record.done(step) })
+			record = &done
+			return err
+		})
+		if err != nil {
+			p.log.Error("record era step failed", "reason", msg.Reason, "err", err)
+			return
+		}
+		if record != nil {
+			p.logRecord("era step handled by chain", record)
+		}
+	}
+}
+
+// stepDone records the step acknowledged by source as done
+func (p *EraProgress) stepDone(source RSymbol, done EraStepDone) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var record EraProgressRecord
+	err := p.store.Update(func(tx utils.StateTx) error {
+		var err error
+		record, err = p.modify(tx, done.Denom, done.Pool, done.Era, func(record *EraProgressRecord) { record.done(done.Step) })
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("record era step %s of pool %s era %d failed: %w", done.Step, done.Pool, done.Era, err)
+	}
+	p.log.Debug("era step done", "source", source, "denom", record.Denom, "pool", record.Pool, "era", record.Era, "step", record.Step)
+	return nil
+}
+
+// markResent remembers msg as a pending event sent again on start
+func (p *EraProgress) markResent(msg *Message) {
+	p.resentLock.Lock()
+	defer p.resentLock.Unlock()
+	p.resent = append(p.resent, msg)
+}
+
+// rescanned reports whether msg is a pending event sent again on start, found again by the
+// rescan of its chain. Every resent event is matched once.
+func (p *EraProgress) rescanned(msg *Message) bool {
+	p.resentLock.Lock()
+	defer p.resentLock.Unlock()
+	if len(p.resent) == 0 {
+		return false
+	}
+	// the resent events were decoded from the store, compare the encoded contents
+	_, dat, err := EncodeContent(nil, msg.Content)
+	if err != nil {
+		return false
+	}
+	for i, m := range p.resent {
+		if m.Destination != msg.Destination || m.Reason != msg.Reason {
+			continue
+		}
+		if _, resent, err := EncodeContent(nil, m.Content); err == nil && bytes.Equal(resent, dat) {
+			p.resent = append(p.resent[:i], p.resent[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *EraProgress) logRecord(msg string, record *EraProgressRecord) {
+	pending := EraStepNone
+	if record.Pending != nil {
+		pending = record.Pending.Step
+	}
+	p.log.Debug(msg, "denom", record.Denom, "pool", record.Pool, "era", record.Era, "step", record.Step, "pending", pending, "signatures", len(record.Signatures))
+}
+
+// modify applies fn to the record of the era of pool, creating it and pruning the old eras
+// of the pool if it is new
+func (p *EraProgress) modify(tx utils.StateTx, denom, pool string, era uint32, fn func(record *EraProgressRecord)) (EraProgressRecord, error) {
+	record, found, err := getEraProgress(tx, denom, pool, era)
+	if err != nil {
+		return record, err
+	}
+	if !found {
+		record = EraProgressRecord{Denom: denom, Pool: pool, Era: era}
+		if err := pruneEraProgress(tx, denom, pool, era); err != nil {
+			return record, err
+		}
+	}
+	fn(&record)
+	record.UpdatedAt = time.Now()
+	dat, err := json.Marshal(&record)
+	if err != nil {
+		return record, err
+	}
+	return record, tx.Bucket(eraProgressBucket).Put(eraProgressKey(denom, pool, era), dat)
+}
+
+func getEraProgress(tx utils.StateTx, denom, pool string, era uint32) (record EraProgressRecord, found bool, err error) {
+	dat := tx.Bucket(eraProgressBucket).Get(eraProgressKey(denom, pool, era))
+	if dat == nil {
+		return record, false, nil
+	}
+	return record, true, json.Unmarshal(dat, &record)
+}
+
+// pruneEraProgress deletes the records of pool more than eraProgressKeep eras before era
+func pruneEraProgress(tx utils.StateTx, denom, pool string, era uint32) error {
+	if era < eraProgressKeep {
+		return nil
+	}
+	prefix := string(eraProgressPoolPrefix(denom, pool))
+	oldest := string(eraProgressKey(denom, pool, era-eraProgressKeep))
+	bucket := tx.Bucket(eraProgressBucket)
+	var keys, shots []string
+	if err := bucket.ForEach(func(key, value []byte) error {
+		if !strings.HasPrefix(string(key), prefix) || string(key) >= oldest {
+			return nil
+		}
+		keys = append(keys, string(key))
+		record := EraProgressRecord{}
+		if err := json.Unmarshal(value, &record); err == nil && record.ShotId != "" {
+			shots = append(shots, record.ShotId)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := bucket.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	for _, shotId := range shots {
+		if err := tx.Bucket(eraProgressShotBucket).Delete([]byte(shotId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithEraProgress routes the chain messages through progress and gives it to the chains
+// with Router.EraProgress
+func WithEraProgress(progress *EraProgress) CoreOption {
+	return func(c *Core) {
+		c.eraProgress = progress
+		progress.acknowledges = c.acknowledgesEraSteps
+		c.routerOpts = append(c.routerOpts, WithInterceptors(progress), func(r *Router) {
+			r.eraProgress = progress
+		})
+	}
+}
+
+// acknowledgesEraSteps reports whether the chain of symbol acknowledges its era steps with EraStepDone
+func (c *Core) acknowledgesEraSteps(symbol RSymbol) bool {
+	steps, ok := c.chain(symbol).(ChainEraSteps)
+	return ok && steps.AcknowledgesEraSteps()
+}
+
+// resumeEras sends again the era events whose step was not done before the last
+// shutdown, except the ones the journal replayed
+func (c *Core) resumeEras(replayed []*Message) {
+	if c.eraProgress == nil {
+		return
+	}
+	records, err := c.eraProgress.Unfinished()
+	if err != nil {
+		c.log.Error("read era progress failed", "err", err)
+		return
+	}
+	for _, record := range records {
+		if record.Pending == nil {
+			continue
+		}
+		msg, err := record.Pending.message()
+		if err != nil {
+			c.log.Error("decode pending era event failed", "denom", record.Denom, "pool", record.Pool, "era", record.Era, "err", err)
+			continue
+		}
+		if containsMessage(replayed, msg) {
+			continue
+		}
+		c.log.Info("resume era", "denom", record.Denom, "pool", record.Pool, "era", record.Era, "done", record.Step, "resend", record.Pending.Step)
+		if err := c.route.Send(msg); err != nil {
+			c.log.Error("resume era failed", "denom", record.Denom, "pool", record.Pool, "era", record.Era, "err", err)
+			continue
+		}
+		c.eraProgress.markResent(msg)
+	}
+}
+
+func containsMessage(msgs []*Message, msg *Message) bool {
+	for _, m := range msgs {
+		if m.Destination == msg.Destination && m.Reason == msg.Reason && reflect.DeepEqual(m.Content, msg.Content) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	"github.com/stafihub/rtoken-relay-core/common/utils"
+	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
+)
+
+const (
+	testDenom = "uatom"
+	testPool  = "cosmos1pool"
+)
+
+func testSnapshot(era uint32) stafiHubXLedgerTypes.BondSnapshot {
+	return stafiHubXLedgerTypes.BondSnapshot{Denom: testDenom, Pool: testPool, Era: era}
+}
+
+// eraEventMsg returns the stafihub event content sent to the ATOM chain
+func eraEventMsg(content Payload) *Message {
+	return &Message{Source: HubRFIS, Destination: "ATOM", Reason: content.Reason(), Content: content}
+}
+
+// ackingChain acknowledges its era steps with EraStepDone
+type ackingChain struct {
+	testChain
+}
+
+func (c *ackingChain) AcknowledgesEraSteps() bool { return true }
+
+// newTestEraProgress returns a core with the ATOM chain, acknowledging its era steps if acks
+func newTestEraProgress(t *testing.T, acks bool) (*Core, *EraProgress, *recordHandler) {
+	t.Helper()
+	progress := NewEraProgress(utils.NewMemStore(), log.NewLog("module", "era progress"))
+	c := NewCore(log.NewLog("module", "core"), make(chan error), WithEraProgress(progress))
+	if acks {
+		chain := &ackingChain{testChain{symbol: "ATOM"}}
+		c.AddChain(chain)
+		return c, progress, &chain.recordHandler
+	}
+	chain := &testChain{symbol: "ATOM"}
+	c.AddChain(chain)
+	return c, progress, &chain.recordHandler
+}
+
+func TestEraProgressSteps(t *testing.T) {
+	tests := []struct {
+		name        string
+		acks        bool
+		unhandled   bool // the handler did not return
+		events      []Payload
+		done        []EraStep
+		wantStep    EraStep
+		wantPending EraStep
+	}{
+		{
+			name:     "handled event of a chain without acks is done",
+			events:   []Payload{EventEraPoolUpdated{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(20)}},
+			wantStep: EraStepEraUpdated,
+		},
+		{
+			name:        "event still handled stays pending",
+			unhandled:   true,
+			events:      []Payload{EventEraPoolUpdated{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(20)}},
+			wantPending: EraStepEraUpdated,
+		},
+		{
+			name:        "event without ack stays pending",
+			acks:        true,
+			events:      []Payload{EventEraPoolUpdated{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(20)}},
+			wantPending: EraStepEraUpdated,
+		},
+		{
+			name:     "ack clears the pending event",
+			acks:     true,
+			events:   []Payload{EventEraPoolUpdated{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(20)}},
+			done:     []EraStep{EraStepEraUpdated},
+			wantStep: EraStepEraUpdated,
+		},
+		{
+			name: "later event replaces the pending one",
+			acks: true,
+			events: []Payload{
+				EventEraPoolUpdated{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(20)},
+				EventBondReported{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(20)},
+			},
+			done:        []EraStep{EraStepEraUpdated},
+			wantStep:    EraStepEraUpdated,
+			wantPending: EraStepBondReported,
+		},
+		{
+			name: "transfer report found by shot id",
+			acks: true,
+			events: []Payload{
+				EventActiveReported{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(20)},
+				EventTransferReported{Denom: testDenom, ShotId: "shot"},
+			},
+			done:        []EraStep{EraStepActiveReported},
+			wantStep:    EraStepActiveReported,
+			wantPending: EraStepTransferReported,
+		},
+		{
+			name:     "rescanned event of an acknowledged step is not pending",
+			acks:     true,
+			events:   []Payload{EventBondReported{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(20)}},
+			done:     []EraStep{EraStepActiveReported},
+			wantStep: EraStepActiveReported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, progress, _ := newTestEraProgress(t, tt.acks)
+			for _, step := range tt.done {
+				if err := progress.stepDone("ATOM", EraStepDone{Denom: testDenom, Pool: testPool, Era: 20, Step: step}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, content := range tt.events {
+				msg := eraEventMsg(content)
+				if err := progress.PreSend(msg); err != nil {
+					t.Fatal(err)
+				}
+				if !tt.unhandled {
+					progress.PostHandle(msg, 0)
+				}
+			}
+
+			record, found, err := progress.Progress(testDenom, testPool, 20)
+			if err != nil || !found {
+				t.Fatalf("progress: found %v, err %v", found, err)
+			}
+			if record.Step != tt.wantStep {
+				t.Errorf("step %s, want %s", record.Step, tt.wantStep)
+			}
+			pending := EraStepNone
+			if record.Pending != nil {
+				pending = record.Pending.Step
+			}
+			if pending != tt.wantPending {
+				t.Errorf("pending %s, want %s", pending, tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestEraProgressNeverDropsEvents(t *testing.T) {
+	c, _, h := newTestEraProgress(t, true)
+	event := EventBondReported{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(20)}
+	if err := c.route.EraStepDone("ATOM", testDenom, testPool, 20, EraStepTransferReported); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.route.Send(NewMessage(HubRFIS, "ATOM", event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return h.count() == 2 })
+}
+
+func TestEraProgressResume(t *testing.T) {
+	c, progress, h := newTestEraProgress(t, true)
+	if err := c.route.EraStepDone("ATOM", testDenom, testPool, 20, EraStepEraUpdated); err != nil {
+		t.Fatal(err)
+	}
+	event := EventBondReported{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(20)}
+	if err := progress.PreSend(eraEventMsg(event)); err != nil {
+		t.Fatal(err)
+	}
+
+	c.resumeEras(nil)
+	waitFor(t, func() bool { return h.count() == 1 })
+	h.lock.Lock()
+	got := h.handled[0]
+	h.lock.Unlock()
+	if got.Reason != ReasonBondReportedEvent || got.Source != HubRFIS {
+		t.Fatalf("resumed %s from %s", got.Reason, got.Source)
+	}
+	if content := got.Content.(EventBondReported); content.ShotId != "shot" || content.Snapshot.Era != 20 {
+		t.Fatalf("resumed content %+v", content)
+	}
+
+	// found again by the rescan of the chain, dropped once
+	for i := 0; i < 2; i++ {
+		if err := c.route.Send(NewMessage(HubRFIS, "ATOM", event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return h.count() == 2 })
+
+	// replayed by the journal, not sent twice
+	c.resumeEras([]*Message{got})
+	if err := c.route.EraStepDone("ATOM", testDenom, testPool, 20, EraStepBondReported); err != nil {
+		t.Fatal(err)
+	}
+	c.resumeEras(nil)
+	// a message sent by mistake would be handled by now
+	time.Sleep(50 * time.Millisecond)
+	if n := h.count(); n != 2 {
+		t.Fatalf("%d messages handled, want 2", n)
+	}
+}
+
+func TestEraProgressRestartWithoutDuplicates(t *testing.T) {
+	store := utils.NewMemStore()
+	event := EventEraPoolUpdated{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(20)}
+
+	// the relay stops while the chain handles the event
+	before := NewCore(log.NewLog("module", "core"), nil, WithEraProgress(NewEraProgress(store, log.NewLog())))
+	release := make(chan struct{})
+	defer close(release)
+	before.AddChain(&testChain{symbol: "ATOM", recordHandler: recordHandler{release: release}})
+	if err := before.route.Send(NewMessage(HubRFIS, "ATOM", event)); err != nil {
+		t.Fatal(err)
+	}
+
+	sysErr := make(chan error)
+	progress := NewEraProgress(store, log.NewLog())
+	c := NewCore(log.NewLog("module", "core"), sysErr, WithEraProgress(progress))
+	chain := &testChain{symbol: "ATOM"}
+	c.AddChain(chain)
+	stopped := make(chan struct{})
+	go func() {
+		c.Start()
+		close(stopped)
+	}()
+	waitFor(t, func() bool { return c.Ready() == nil })
+	// the chain rescans the block of the event
+	if err := c.route.Send(NewMessage(HubRFIS, "ATOM", event)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return chain.count() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if n := chain.count(); n != 1 {
+		t.Fatalf("%d messages handled, want 1", n)
+	}
+	sysErr <- errors.New("stop")
+	<-stopped
+
+	// handled once, nothing left to resend on the next start
+	record, _, err := progress.Progress(testDenom, testPool, 20)
+	if err != nil || record.Step != EraStepEraUpdated || record.Pending != nil {
+		t.Fatalf("record %+v, err %v, want the step done", record, err)
+	}
+}
+
+func TestEraProgressPrune(t *testing.T) {
+	_, progress, _ := newTestEraProgress(t, false)
+	for era := uint32(20); era < 40; era++ {
+		msg := eraEventMsg(EventEraPoolUpdated{Denom: testDenom, ShotId: "shot", Snapshot: testSnapshot(era)})
+		if err := progress.PreSend(msg); err != nil {
+			t.Fatal(err)
+		}
+		progress.PostHandle(msg, 0)
+	}
+	tests := []struct {
+		era   uint32
+		found bool
+	}{
+		{era: 20, found: false},
+		{era: 30, found: false},
+		{era: 31, found: true},
+		{era: 39, found: true},
+	}
+	for _, tt := range tests {
+		if _, found, err := progress.Progress(testDenom, testPool, tt.era); err != nil || found != tt.found {
+			t.Errorf("era %d: found %v, want %v, err %v", tt.era, found, tt.found, err)
+		}
+	}
+	unfinished, err := progress.Unfinished()
+	if err != nil || len(unfinished) != 1 || unfinished[0].Era != 39 {
+		t.Fatalf("unfinished %+v, err %v", unfinished, err)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	ErrNotStarted = errors.New("chains not started")
+	ErrStalled    = errors.New("chain stalled")
+	ErrRestarting = errors.New("chain restarting")
+)
+
+// Ready returns nil once every chain returned from Start and has a handler registered in the router,
+// and no chain is being restarted
+func (c *Core) Ready() error {
+	if !c.started.Load() {
+		return ErrNotStarted
+	}
+	if n := c.restarting.Load(); n > 0 {
+		return fmt.Errorf("%w: %d", ErrRestarting, n)
+	}
+	var errs []error
+	for _, chain := range c.chains() {
+		if !c.route.HasHandler(chain.RSymbol()) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrNoHandler, chain.RSymbol()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Live returns nil unless a chain implementing ChainHealth reports it has stalled
+func (c *Core) Live() error {
+	var errs []error
+	for _, chain := range c.chains() {
+		h, ok := chain.(ChainHealth)
+		if !ok {
+			continue
+		}
+		if err := h.Health(); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s: %s", ErrStalled, chain.RSymbol(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// probeHandler answers 200 if check passes and 503 with the reason otherwise
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+func TestCoreProbes(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(c *Core)
+		wantReady int
+		wantLive  int
+	}{
+		{
+			name:      "not started",
+			setup:     func(c *Core) { c.AddChain(&testChain{symbol: "uatom"}) },
+			wantReady: http.StatusServiceUnavailable,
+			wantLive:  http.StatusOK,
+		},
+		{
+			name: "started",
+			setup: func(c *Core) {
+				c.AddChain(&testChain{symbol: "uatom"})
+				c.started.Store(true)
+			},
+			wantReady: http.StatusOK,
+			wantLive:  http.StatusOK,
+		},
+		{
+			name: "chain without handler",
+			setup: func(c *Core) {
+				c.Registry = append(c.Registry, &testChain{symbol: "uatom"})
+				c.started.Store(true)
+			},
+			wantReady: http.StatusServiceUnavailable,
+			wantLive:  http.StatusOK,
+		},
+		{
+			name: "chain restarting",
+			setup: func(c *Core) {
+				c.AddChain(&testChain{symbol: "uatom"})
+				c.started.Store(true)
+				c.restarting.Add(1)
+			},
+			wantReady: http.StatusServiceUnavailable,
+			wantLive:  http.StatusOK,
+		},
+		{
+			name: "chain stalled",
+			setup: func(c *Core) {
+				c.AddChain(&testChain{symbol: "uatom"})
+				c.AddChain(&testChain{symbol: "uiris", health: errors.New("no new block for 10m")})
+				c.started.Store(true)
+			},
+			wantReady: http.StatusOK,
+			wantLive:  http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCore(log.NewLog(), nil, WithMetrics(NewMetrics()))
+			tt.setup(c)
+			defer c.route.StopMsgHandler()
+
+			server := httptest.NewServer(c.monitorMux())
+			defer server.Close()
+			for path, want := range map[string]int{"/readyz": tt.wantReady, "/healthz": tt.wantLive} {
+				res, err := server.Client().Get(server.URL + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+				if res.StatusCode != want {
+					t.Errorf("%s status %d, want %d", path, res.StatusCode, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCoreLiveReportsStall(t *testing.T) {
+	c := NewCore(log.NewLog(), nil)
+	c.AddChain(&testChain{symbol: "uatom", health: errors.New("no new block for 10m")})
+	defer c.route.StopMsgHandler()
+
+	if err := c.Live(); !errors.Is(err, ErrStalled) {
+		t.Fatalf("err %v, want %v", err, ErrStalled)
+	}
+}
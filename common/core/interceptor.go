@@ -0,0 +1,83 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+// Interceptor observes the messages passing through the Router. PreSend hooks run in
+// registration order, PostHandle and OnError hooks run in reverse order.
+type Interceptor interface {
+	// PreSend is called before msg is queued, a non-nil error rejects the message
+	PreSend(msg *Message) error
+	// PostHandle is called after the destination handler returned, elapsed is the
+	// time spent in the handler
+	PostHandle(msg *Message, elapsed time.Duration)
+	// OnError is called when msg is rejected, dropped or abandoned, or when a request
+	// fails, elapsed is the time since msg was sent
+	OnError(msg *Message, elapsed time.Duration, err error)
+}
+
+// BaseInterceptor implements Interceptor with no-op hooks, embed it to override only some of them
+type BaseInterceptor struct{}
+
+func (BaseInterceptor) PreSend(*Message) error                 { return nil }
+func (BaseInterceptor) PostHandle(*Message, time.Duration)     {}
+func (BaseInterceptor) OnError(*Message, time.Duration, error) {}
+
+// WithInterceptors appends interceptors to the Router chain
+func WithInterceptors(interceptors ...Interceptor) RouterOption {
+	return func(r *Router) {
+		r.interceptors = append(r.interceptors, interceptors...)
+	}
+}
+
+// interceptorChain runs the hooks of every registered interceptor
+type interceptorChain []Interceptor
+
+func (c interceptorChain) preSend(msg *Message) error {
+	for _, i := range c {
+		if err := i.PreSend(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c interceptorChain) postHandle(msg *Message, elapsed time.Duration) {
+	for i := len(c) - 1; i >= 0; i-- {
+		c[i].PostHandle(msg, elapsed)
+	}
+}
+
+func (c interceptorChain) onError(msg *Message, elapsed time.Duration, err error) {
+	for i := len(c) - 1; i >= 0; i-- {
+		c[i].OnError(msg, elapsed, err)
+	}
+}
+
+// LogInterceptor logs every routed message, ReasonNewEra included
+type LogInterceptor struct {
+	log log.Logger
+}
+
+func NewLogInterceptor(log log.Logger) *LogInterceptor {
+	return &LogInterceptor{log: log}
+}
+
+func (l *LogInterceptor) PreSend(msg *Message) error {
+	l.log.Trace("send message", "source", msg.Source, "dest", msg.Destination, "reason", msg.Reason)
+	return nil
+}
+
+func (l *LogInterceptor) PostHandle(msg *Message, elapsed time.Duration) {
+	l.log.Debug("message handled", "source", msg.Source, "dest", msg.Destination, "reason", msg.Reason, "elapsed", elapsed)
+}
+
+func (l *LogInterceptor) OnError(msg *Message, elapsed time.Duration, err error) {
+	l.log.Warn("message failed", "source", msg.Source, "dest", msg.Destination, "reason", msg.Reason, "elapsed", elapsed, "err", err)
+}
@@ -0,0 +1,302 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/cosmos/cosmos-sdk/codec"
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	"github.com/stafihub/rtoken-relay-core/common/utils"
+)
+
+const (
+	JournalFileName = "message.journal"
+	// records that can not be decoded any more are moved to this file instead of replayed
+	JournalDeadLetterFileName = JournalFileName + ".dead"
+
+	journalOpMsg = "msg"
+	journalOpAck = "ack"
+
+	// rewrite the journal with the pending records only once this many were acknowledged
+	journalCompactThreshold = 1024
+)
+
+type journalRecord struct {
+	Op          string          `json:"op"`
+	Seq         uint64          `json:"seq"`
+	Source      RSymbol         `json:"source,omitempty"`
+	Destination RSymbol         `json:"destination,omitempty"`
+	Reason      Reason          `json:"reason,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	Content     json.RawMessage `json:"content,omitempty"`
+}
+
+// journaledMsg is a message recorded in the journal but not acknowledged yet
+type journaledMsg struct {
+	seq uint64
+	msg *Message
+}
+
+// Journal is a write-ahead log of routed messages. Every message is appended before it is
+// queued for its destination and acknowledged once its handler returned, or once done was
+// called for an AckHandler. Messages left unacknowledged by a crash are replayed on the next
+// start.
+type Journal struct {
+	path    string
+	cdc     codec.JSONCodec
+	log     log.Logger
+	lock    sync.Mutex
+	file    *os.File
+	seq     uint64
+	pending map[uint64]*journalRecord
+	acked   int // acknowledged records in the file since the last rewrite
+}
+
+// OpenJournal opens the journal in dir, using the default blockstore path if dir is empty.
+// cdc decodes the sdk msgs carried by proposals.
+func OpenJournal(dir string, cdc codec.JSONCodec, log log.Logger) (*Journal, error) {
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, utils.PathPostfix)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		path:    filepath.Join(dir, JournalFileName),
+		cdc:     cdc,
+		log:     log,
+		pending: make(map[uint64]*journalRecord),
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	if err := j.rewrite(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// load reads the unacknowledged records left by the last run
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := journalRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// a crash can leave the last line half written
+			j.log.Warn("skip broken journal record", "err", err)
+			continue
+		}
+		if record.Seq > j.seq {
+			j.seq = record.Seq
+		}
+		switch record.Op {
+		case journalOpMsg:
+			j.pending[record.Seq] = &record
+		case journalOpAck:
+			delete(j.pending, record.Seq)
+		}
+	}
+	return scanner.Err()
+}
+
+// rewrite replaces the journal file with the pending records only
+func (j *Journal) rewrite() error {
+	if j.file != nil {
+		if err := j.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, seq := range j.pendingSeqs() {
+		if err := writeRecord(tmp, j.pending[seq]); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	j.acked = 0
+	return nil
+}
+
+func (j *Journal) pendingSeqs() []uint64 {
+	seqs := make([]uint64, 0, len(j.pending))
+	for seq := range j.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(a, b int) bool { return seqs[a] < seqs[b] })
+	return seqs
+}
+
+func writeRecord(f *os.File, record *journalRecord) error {
+	bts, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(bts, '\n'))
+	return err
+}
+
+// Append records msg and returns its sequence, ok is false if the content can not be journaled.
+// The record is synced to disk before Append returns, so every journaled Send costs a disk
+// sync. Acks are not synced, a lost ack only replays a message which was already handled.
+func (j *Journal) Append(msg *Message) (seq uint64, ok bool, err error) {
+	if !IsEncodableContent(msg.Content) {
+		return 0, false, nil
+	}
+	contentType, content, err := EncodeContent(j.cdc, msg.Content)
+	if err != nil {
+		return 0, false, err
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return 0, false, os.ErrClosed
+	}
+
+	j.seq++
+	record := &journalRecord{
+		Op:          journalOpMsg,
+		Seq:         j.seq,
+		Source:      msg.Source,
+		Destination: msg.Destination,
+		Reason:      msg.Reason,
+		ContentType: contentType,
+		Content:     content,
+	}
+	if err := writeRecord(j.file, record); err != nil {
+		return 0, false, err
+	}
+	if err := j.file.Sync(); err != nil {
+		return 0, false, err
+	}
+	j.pending[record.Seq] = record
+	return record.Seq, true, nil
+}
+
+// Ack marks the message with seq as handled
+func (j *Journal) Ack(seq uint64) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	// handlers finishing after Close leave their messages to be replayed
+	if _, exist := j.pending[seq]; !exist || j.file == nil {
+		return nil
+	}
+	return j.ack(seq)
+}
+
+// ack drops seq from the pending records, caller must hold the lock
+func (j *Journal) ack(seq uint64) error {
+	delete(j.pending, seq)
+	j.acked++
+	if j.acked >= journalCompactThreshold {
+		return j.rewrite()
+	}
+	return writeRecord(j.file, &journalRecord{Op: journalOpAck, Seq: seq})
+}
+
+// pendingMsgs decodes the unacknowledged messages ordered by sequence, records which can
+// not be decoded are moved to the dead letter file
+func (j *Journal) pendingMsgs() []journaledMsg {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	msgs := make([]journaledMsg, 0, len(j.pending))
+	for _, seq := range j.pendingSeqs() {
+		record := j.pending[seq]
+		content, err := DecodeContent(j.cdc, record.ContentType, record.Content)
+		if err != nil {
+			j.log.Error("undecodable journal record, move it to the dead letter file", "seq", seq, "reason", record.Reason, "contentType", record.ContentType, "err", err)
+			if err := j.deadLetter(record); err != nil {
+				j.log.Error("move journal record to the dead letter file failed, keep it", "seq", seq, "err", err)
+			}
+			continue
+		}
+		msgs = append(msgs, journaledMsg{
+			seq: seq,
+			msg: &Message{
+				Source:      record.Source,
+				Destination: record.Destination,
+				Reason:      record.Reason,
+				Content:     content,
+			},
+		})
+	}
+	return msgs
+}
+
+// deadLetter appends record to the dead letter file and acknowledges it, caller must hold the lock
+func (j *Journal) deadLetter(record *journalRecord) error {
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(j.path), JournalDeadLetterFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(f, record); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if j.file == nil {
+		delete(j.pending, record.Seq)
+		return nil
+	}
+	return j.ack(record.Seq)
+}
+
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
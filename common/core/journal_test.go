@@ -0,0 +1,305 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cosmos/cosmos-sdk/codec"
+	codectypes "github.com/cosmos/cosmos-sdk/codec/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	banktypes "github.com/cosmos/cosmos-sdk/x/bank/types"
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
+)
+
+func testCodec() codec.JSONCodec {
+	registry := codectypes.NewInterfaceRegistry()
+	banktypes.RegisterInterfaces(registry)
+	return codec.NewProtoCodec(registry)
+}
+
+func TestEncodeContent(t *testing.T) {
+	cdc := testCodec()
+	tests := []struct {
+		name        string
+		content     interface{}
+		contentType string
+	}{
+		{
+			name:        "event",
+			content:     EventTransferReported{Denom: "uatom", ShotId: "shot"},
+			contentType: "EventTransferReported",
+		},
+		{
+			name: "event with ints",
+			content: EventActiveReported{Denom: "uatom", ShotId: "shot", Snapshot: stafiHubXLedgerTypes.BondSnapshot{
+				Denom: "uatom", Era: 2, Chunk: stafiHubXLedgerTypes.LinkChunk{Bond: sdk.NewInt(3), Unbond: sdk.NewInt(0), Active: sdk.NewInt(9)},
+			}},
+			contentType: "EventActiveReported",
+		},
+		{
+			name: "proposal with sdk msgs",
+			content: ProposalInterchainTx{Denom: "uatom", Pool: "pool", Era: 3, Msgs: []sdk.Msg{
+				&banktypes.MsgSend{FromAddress: "a", ToAddress: "b", Amount: sdk.NewCoins(sdk.NewInt64Coin("uatom", 5))},
+			}},
+			contentType: "ProposalInterchainTx",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, data, err := EncodeContent(cdc, tt.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != tt.contentType {
+				t.Fatalf("content type: got %s, want %s", contentType, tt.contentType)
+			}
+			decoded, err := DecodeContent(cdc, contentType, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tt.content) {
+				t.Fatalf("decoded: got %+v, want %+v", decoded, tt.content)
+			}
+		})
+	}
+}
+
+func TestEncodeContentRejectsUnregistered(t *testing.T) {
+	for _, content := range []interface{}{nil, ParamGetPools{}, struct{ Denom string }{}} {
+		if IsEncodableContent(content) {
+			t.Fatalf("%T is encodable", content)
+		}
+		if _, _, err := EncodeContent(nil, content); err == nil {
+			t.Fatalf("encode %T: no error", content)
+		}
+	}
+	if _, err := DecodeContent(nil, "Unknown", []byte("{}")); err == nil {
+		t.Fatal("decode unknown content type: no error")
+	}
+}
+
+func TestJournalReopen(t *testing.T) {
+	msg := func(era uint32) *Message {
+		return &Message{Source: "uatom", Destination: HubRFIS, Reason: ReasonEraPoolUpdatedEvent,
+			Content: EventEraPoolUpdated{Denom: "uatom", CurrentEra: era}}
+	}
+	tests := []struct {
+		name    string
+		appends int
+		acks    []int // indexes of the appended messages to acknowledge
+		pending []uint32
+	}{
+		{name: "empty"},
+		{name: "nothing acked", appends: 3, pending: []uint32{1, 2, 3}},
+		{name: "some acked", appends: 3, acks: []int{0, 2}, pending: []uint32{2}},
+		{name: "all acked", appends: 2, acks: []int{1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			j, err := OpenJournal(dir, nil, log.NewLog())
+			if err != nil {
+				t.Fatal(err)
+			}
+			seqs := make([]uint64, tt.appends)
+			for i := range seqs {
+				seq, ok, err := j.Append(msg(uint32(i + 1)))
+				if err != nil || !ok {
+					t.Fatalf("append: %v %v", ok, err)
+				}
+				seqs[i] = seq
+			}
+			for _, i := range tt.acks {
+				if err := j.Ack(seqs[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := j.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			j, err = OpenJournal(dir, nil, log.NewLog())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer j.Close()
+			eras := make([]uint32, 0)
+			for _, jm := range j.pendingMsgs() {
+				eras = append(eras, jm.msg.Content.(EventEraPoolUpdated).CurrentEra)
+			}
+			if len(eras) != len(tt.pending) || (len(eras) > 0 && !reflect.DeepEqual(eras, tt.pending)) {
+				t.Fatalf("pending: got %v, want %v", eras, tt.pending)
+			}
+			// sequences keep growing after a reopen
+			seq, _, err := j.Append(msg(9))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seq <= uint64(tt.appends) {
+				t.Fatalf("seq %d reused", seq)
+			}
+		})
+	}
+}
+
+func TestJournalCompactsWithPendingRecords(t *testing.T) {
+	dir := t.TempDir()
+	j, err := OpenJournal(dir, nil, log.NewLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	msg := &Message{Source: "uatom", Destination: HubRFIS, Reason: ReasonEraPoolUpdatedEvent, Content: EventEraPoolUpdated{Denom: "uatom"}}
+
+	kept, _, err := j.Append(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < journalCompactThreshold; i++ {
+		seq, _, err := j.Append(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Ack(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bts, err := os.ReadFile(filepath.Join(dir, JournalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := countLines(bts); lines != 1 {
+		t.Fatalf("journal holds %d records after compaction, want 1", lines)
+	}
+	if msgs := j.pendingMsgs(); len(msgs) != 1 || msgs[0].seq != kept {
+		t.Fatalf("pending: %+v", msgs)
+	}
+}
+
+func TestJournalDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	j, err := OpenJournal(dir, nil, log.NewLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, _, err := j.Append(&Message{Source: "uatom", Destination: HubRFIS, Reason: ReasonEraPoolUpdatedEvent, Content: EventEraPoolUpdated{Denom: "uatom"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a record of a content type this build does not know
+	j.lock.Lock()
+	j.seq++
+	bad := &journalRecord{Op: journalOpMsg, Seq: j.seq, Destination: HubRFIS, ContentType: "Removed", Content: []byte("{}")}
+	if err := writeRecord(j.file, bad); err != nil {
+		t.Fatal(err)
+	}
+	j.pending[bad.Seq] = bad
+	j.lock.Unlock()
+
+	if msgs := j.pendingMsgs(); len(msgs) != 1 || msgs[0].seq != good {
+		t.Fatalf("pending: %+v", msgs)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bts, err := os.ReadFile(filepath.Join(dir, JournalDeadLetterFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := countLines(bts); lines != 1 {
+		t.Fatalf("dead letter file holds %d records, want 1", lines)
+	}
+	j, err = OpenJournal(dir, nil, log.NewLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if len(j.pending) != 1 {
+		t.Fatalf("dead letter record still pending after reopen: %d pending", len(j.pending))
+	}
+}
+
+func countLines(bts []byte) int {
+	lines := 0
+	for _, b := range bts {
+		if b == '\n' {
+			lines++
+		}
+	}
+	return lines
+}
+
+func TestRouterJournal(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(release chan struct{}) Handler
+		// whether the handler finished the messages before the router stopped
+		finished bool
+	}{
+		{name: "plain handler returned", handler: func(chan struct{}) Handler { return &recordHandler{} }, finished: true},
+		{name: "plain handler still running", handler: func(release chan struct{}) Handler { return &recordHandler{release: release} }},
+		{name: "ack handler done", handler: func(chan struct{}) Handler { return &doneHandler{} }, finished: true},
+		{name: "ack handler not done", handler: func(chan struct{}) Handler { return &ackHandler{dones: make(chan func(error), 4)} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			j, err := OpenJournal(dir, nil, log.NewLog())
+			if err != nil {
+				t.Fatal(err)
+			}
+			release := make(chan struct{})
+			defer close(release)
+			r := NewRouter(log.NewLog(), WithJournal(j), WithQueueConfig(QueueConfig{Workers: 1}), WithDrainTimeout(50*time.Millisecond))
+			r.Listen(HubRFIS, tt.handler(release))
+			for era := uint32(1); era <= 2; era++ {
+				if err := r.Send(testMsg("uatom", era)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			abandoned := r.StopMsgHandler()
+
+			// the next start replays what was not finished
+			j, err = OpenJournal(dir, nil, log.NewLog())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer j.Close()
+			h := &recordHandler{}
+			next := NewRouter(log.NewLog(), WithJournal(j))
+			next.Listen(HubRFIS, h)
+			replayed := next.replayJournal()
+			next.StopMsgHandler()
+
+			want := 2
+			if tt.finished {
+				want = 0
+			}
+			if len(replayed) != want || h.count() != want {
+				t.Fatalf("replayed %d, handled %d, want %d", len(replayed), h.count(), want)
+			}
+			if !tt.finished && len(abandoned) != want {
+				t.Fatalf("%d messages abandoned, want %d", len(abandoned), want)
+			}
+		})
+	}
+}
+
+// doneHandler calls done as soon as it got a message
+type doneHandler struct {
+	recordHandler
+}
+
+func (h *doneHandler) HandleMessageAck(msg *Message, done func(err error)) {
+	h.HandleMessage(msg)
+	done(nil)
+}
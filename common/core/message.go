@@ -39,6 +39,9 @@ const (
 	ReasonInitPoolEvent          = Reason("InitPoolEvent")
 	ReasonRemovePoolEvent        = Reason("RemovePoolEvent")
 
+	//send by a chain once the work of an era step landed
+	ReasonEraStepDone = Reason("EraStepDone")
+
 	//get reason
 	ReasonGetPools                   = Reason("GetPools")
 	ReasonGetSignatures              = Reason("GetSignatures")
@@ -122,6 +125,14 @@ type EventRemovePool struct {
 	PoolAddress string
 }
 
+// === other chain -> relay, taken by the era progress instead of a handler
+type EraStepDone struct {
+	Denom string
+	Pool  string
+	Era   uint32
+	Step  EraStep
+}
+
 // === other chain -> stafihub msg data used in cosmos
 type ProposalExeLiquidityBond struct {
 	Denom  string
@@ -197,7 +208,9 @@ type ParamSubmitSignature struct {
 	Signature string
 }
 
-// get msg
+// get msg, handlers reply by writing to the channel once. The sdk chains create the channel,
+// send them with Router.Send and wait with a timeout of their own, this stays supported.
+// Router.Request and its typed helpers create the channel and wait with a deadline instead.
 type ParamGetPools struct {
 	Denom string
 	Pools chan []string
@@ -0,0 +1,186 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/cosmos/cosmos-sdk/codec"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// content types are stored with encoded contents, they must stay the same once released
+const (
+	contentTypeProposalExeNativeAndLsmLiquidityBond = "ProposalExeNativeAndLsmLiquidityBond"
+	contentTypeProposalInterchainTx                 = "ProposalInterchainTx"
+)
+
+// encodableContents maps the registered content types to their Go type, get params are not
+// included as their reply channels only make sense inside the running process
+var (
+	encodableContents = map[string]reflect.Type{}
+	contentTypes      = map[reflect.Type]string{}
+)
+
+// registerContent registers the Go type of content under contentType
+func registerContent(contentType string, content interface{}) {
+	t := reflect.TypeOf(content)
+	if _, exist := encodableContents[contentType]; exist {
+		panic(fmt.Sprintf("content type %s registered twice", contentType))
+	}
+	encodableContents[contentType] = t
+	contentTypes[t] = contentType
+}
+
+func init() {
+	registerContent("EventEraPoolUpdated", EventEraPoolUpdated{})
+	registerContent("EventBondReported", EventBondReported{})
+	registerContent("EventActiveReported", EventActiveReported{})
+	registerContent("EventTransferReported", EventTransferReported{})
+	registerContent("EventSignatureEnough", EventSignatureEnough{})
+	registerContent("EventRValidatorUpdated", EventRValidatorUpdated{})
+	registerContent("EventRValidatorAdded", EventRValidatorAdded{})
+	registerContent("EventRParamsChanged", EventRParamsChanged{})
+	registerContent("EventInitPool", EventInitPool{})
+	registerContent("EventRemovePool", EventRemovePool{})
+	registerContent("ProposalExeLiquidityBond", ProposalExeLiquidityBond{})
+	registerContent(contentTypeProposalExeNativeAndLsmLiquidityBond, ProposalExeNativeAndLsmLiquidityBond{})
+	registerContent("ProposalSetChainEra", ProposalSetChainEra{})
+	registerContent("ProposalBondReport", ProposalBondReport{})
+	registerContent("ProposalActiveReport", ProposalActiveReport{})
+	registerContent("ProposalWithdrawReport", ProposalWithdrawReport{})
+	registerContent("ProposalTransferReport", ProposalTransferReport{})
+	registerContent("ProposalRValidatorUpdateReport", ProposalRValidatorUpdateReport{})
+	registerContent(contentTypeProposalInterchainTx, ProposalInterchainTx{})
+	registerContent("ParamSubmitSignature", ParamSubmitSignature{})
+}
+
+// proposalExeNativeAndLsmLiquidityBondJSON shadows Msgs, sdk.Msg needs the interface registry to decode
+type proposalExeNativeAndLsmLiquidityBondJSON struct {
+	ProposalExeNativeAndLsmLiquidityBond
+	Msgs []json.RawMessage
+}
+
+type proposalInterchainTxJSON struct {
+	ProposalInterchainTx
+	Msgs []json.RawMessage
+}
+
+// IsEncodableContent reports whether EncodeContent supports content
+func IsEncodableContent(content interface{}) bool {
+	if content == nil {
+		return false
+	}
+	_, ok := contentTypes[reflect.TypeOf(content)]
+	return ok
+}
+
+// EncodeContent encodes a message content to json, it returns the registered content type
+// which DecodeContent needs. cdc is used for the sdk.Msg lists in proposals.
+func EncodeContent(cdc codec.JSONCodec, content interface{}) (string, json.RawMessage, error) {
+	if !IsEncodableContent(content) {
+		return "", nil, fmt.Errorf("content type %T can not be encoded", content)
+	}
+	contentType := contentTypes[reflect.TypeOf(content)]
+
+	var v interface{}
+	switch c := content.(type) {
+	case ProposalExeNativeAndLsmLiquidityBond:
+		msgs, err := encodeMsgs(cdc, c.Msgs)
+		if err != nil {
+			return "", nil, err
+		}
+		v = proposalExeNativeAndLsmLiquidityBondJSON{ProposalExeNativeAndLsmLiquidityBond: c, Msgs: msgs}
+	case ProposalInterchainTx:
+		msgs, err := encodeMsgs(cdc, c.Msgs)
+		if err != nil {
+			return "", nil, err
+		}
+		v = proposalInterchainTxJSON{ProposalInterchainTx: c, Msgs: msgs}
+	default:
+		v = content
+	}
+
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return "", nil, err
+	}
+	return contentType, bts, nil
+}
+
+// DecodeContent decodes data produced by EncodeContent back to a content value
+func DecodeContent(cdc codec.JSONCodec, contentType string, data json.RawMessage) (interface{}, error) {
+	switch contentType {
+	case contentTypeProposalExeNativeAndLsmLiquidityBond:
+		var v proposalExeNativeAndLsmLiquidityBondJSON
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		msgs, err := decodeMsgs(cdc, v.Msgs)
+		if err != nil {
+			return nil, err
+		}
+		v.ProposalExeNativeAndLsmLiquidityBond.Msgs = msgs
+		return v.ProposalExeNativeAndLsmLiquidityBond, nil
+	case contentTypeProposalInterchainTx:
+		var v proposalInterchainTxJSON
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		msgs, err := decodeMsgs(cdc, v.Msgs)
+		if err != nil {
+			return nil, err
+		}
+		v.ProposalInterchainTx.Msgs = msgs
+		return v.ProposalInterchainTx, nil
+	}
+
+	t, exist := encodableContents[contentType]
+	if !exist {
+		return nil, fmt.Errorf("unknown content type: %s", contentType)
+	}
+	ptr := reflect.New(t)
+	if err := json.Unmarshal(data, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+func encodeMsgs(cdc codec.JSONCodec, msgs []sdk.Msg) ([]json.RawMessage, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	if cdc == nil {
+		return nil, fmt.Errorf("codec is required to encode sdk msgs")
+	}
+	raws := make([]json.RawMessage, len(msgs))
+	for i, msg := range msgs {
+		bts, err := cdc.MarshalInterfaceJSON(msg)
+		if err != nil {
+			return nil, err
+		}
+		raws[i] = bts
+	}
+	return raws, nil
+}
+
+func decodeMsgs(cdc codec.JSONCodec, raws []json.RawMessage) ([]sdk.Msg, error) {
+	if len(raws) == 0 {
+		return nil, nil
+	}
+	if cdc == nil {
+		return nil, fmt.Errorf("codec is required to decode sdk msgs")
+	}
+	msgs := make([]sdk.Msg, len(raws))
+	for i, raw := range raws {
+		var msg sdk.Msg
+		if err := cdc.UnmarshalInterfaceJSON(raw, &msg); err != nil {
+			return nil, err
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const metricsNamespace = "rtoken_relay"
+
+// Metrics collects prometheus metrics of the routed messages, it is registered on the
+// Router as an Interceptor by WithMetrics
+type Metrics struct {
+	BaseInterceptor
+
+	registry *prometheus.Registry
+	sent     *prometheus.CounterVec
+	handled  *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	fatal    prometheus.Counter
+	restarts *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_sent_total",
+			Help:      "Messages accepted by the router.",
+		}, []string{"source", "destination", "reason"}),
+		handled: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "message_handle_seconds",
+			Help:      "Time spent in the destination handler.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"source", "destination", "reason"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "message_errors_total",
+			Help:      "Messages rejected, dropped or abandoned and failed requests, by error kind.",
+		}, []string{"source", "destination", "reason", "kind"}),
+		fatal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "fatal_errors_total",
+			Help:      "Errors received from chains on the system error channel that shut the relay down.",
+		}),
+		restarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "chain_restarts_total",
+			Help:      "Restart attempts of supervised chains.",
+		}, []string{"rsymbol"}),
+	}
+	m.registry.MustRegister(
+		m.sent,
+		m.handled,
+		m.errors,
+		m.fatal,
+		m.restarts,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Registry returns the registry backing the metrics endpoint, chains may add their own collectors
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+func (m *Metrics) PreSend(msg *Message) error {
+	m.sent.WithLabelValues(string(msg.Source), string(msg.Destination), string(msg.Reason)).Inc()
+	return nil
+}
+
+func (m *Metrics) PostHandle(msg *Message, elapsed time.Duration) {
+	m.handled.WithLabelValues(string(msg.Source), string(msg.Destination), string(msg.Reason)).Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) OnError(msg *Message, _ time.Duration, err error) {
+	m.errors.WithLabelValues(string(msg.Source), string(msg.Destination), string(msg.Reason), errorKind(err)).Inc()
+}
+
+// errorKind maps an error to a bounded label value
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrQueueFull):
+		return "queue_full"
+	case errors.Is(err, ErrQueueClosed), errors.Is(err, ErrRouterStopped):
+		return "stopped"
+	case errors.Is(err, ErrNoHandler):
+		return "no_handler"
+	case errors.Is(err, ErrMalformedMessage), errors.Is(err, ErrUnsupportedRequest):
+		return "malformed"
+	case errors.Is(err, ErrRequestTimeout):
+		return "timeout"
+	}
+	var handlerErr *HandlerError
+	if errors.As(err, &handlerErr) {
+		return "handler"
+	}
+	return "other"
+}
+
+// coreCollector reports the router queue depth and the gauges of chains implementing ChainMetrics
+type coreCollector struct {
+	core       *Core
+	queueDepth *prometheus.Desc
+	chainGauge *prometheus.Desc
+}
+
+func newCoreCollector(c *Core) *coreCollector {
+	return &coreCollector{
+		core: c,
+		queueDepth: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "queue_depth"),
+			"Messages waiting in the router queue of a destination.",
+			[]string{"destination"}, nil,
+		),
+		chainGauge: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "chain_gauge"),
+			"Gauges reported by chains, e.g. the latest processed block.",
+			[]string{"chain", "rsymbol", "name"}, nil,
+		),
+	}
+}
+
+func (cc *coreCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.queueDepth
+	ch <- cc.chainGauge
+}
+
+func (cc *coreCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, chain := range cc.core.chains() {
+		symbol := chain.RSymbol()
+		ch <- prometheus.MustNewConstMetric(cc.queueDepth, prometheus.GaugeValue, float64(cc.core.route.QueueLen(symbol)), string(symbol))
+
+		cm, ok := chain.(ChainMetrics)
+		if !ok {
+			continue
+		}
+		for name, value := range cm.Gauges() {
+			ch <- prometheus.MustNewConstMetric(cc.chainGauge, prometheus.GaugeValue, value, chain.Name(), string(symbol), name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stafihub/rtoken-relay-core/common/config"
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+// testChain records the messages routed to its RSymbol, its gauges and health are set by the tests
+type testChain struct {
+	recordHandler
+	symbol   RSymbol
+	gauges   map[string]float64
+	health   error
+	startErr error
+}
+
+func (c *testChain) Initialize(*config.RawChainConfig, log.Logger, chan<- error) error { return nil }
+func (c *testChain) Start() error                                                      { return c.startErr }
+func (c *testChain) SetRouter(r *Router)                                               { r.Listen(c.symbol, c) }
+func (c *testChain) RSymbol() RSymbol                                                  { return c.symbol }
+func (c *testChain) Name() string                                                      { return "test-" + string(c.symbol) }
+func (c *testChain) Stop()                                                             {}
+func (c *testChain) Gauges() map[string]float64                                        { return c.gauges }
+func (c *testChain) Health() error                                                     { return c.health }
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: fmt.Errorf("%w, dest: uatom", ErrQueueFull), want: "queue_full"},
+		{err: ErrQueueClosed, want: "stopped"},
+		{err: fmt.Errorf("%w, drop message", ErrRouterStopped), want: "stopped"},
+		{err: ErrNoHandler, want: "no_handler"},
+		{err: ErrMalformedMessage, want: "malformed"},
+		{err: ErrUnsupportedRequest, want: "malformed"},
+		{err: ErrRequestTimeout, want: "timeout"},
+		{err: &HandlerError{Err: errors.New("tx failed")}, want: "handler"},
+		{err: errors.New("journal full"), want: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want+"/"+tt.err.Error(), func(t *testing.T) {
+			if got := errorKind(tt.err); got != tt.want {
+				t.Fatalf("kind %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	c := NewCore(log.NewLog(), nil, WithMetrics(m))
+	c.AddChain(&testChain{symbol: HubRFIS})
+
+	for era := uint32(1); era <= 2; era++ {
+		if err := c.route.Send(testMsg("uatom", era)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.route.Send(NewMessage(HubRFIS, "uiris", ProposalSetChainEra{Denom: "uiris"})); !errors.Is(err, ErrNoHandler) {
+		t.Fatalf("err %v, want %v", err, ErrNoHandler)
+	}
+	c.route.StopMsgHandler()
+
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{name: "sent", got: testutil.ToFloat64(m.sent.WithLabelValues("uatom", string(HubRFIS), string(ReasonEraPoolUpdatedEvent))), want: 2},
+		{name: "errors", got: testutil.ToFloat64(m.errors.WithLabelValues(string(HubRFIS), "uiris", string(ReasonNewEra), "no_handler")), want: 1},
+		{name: "handled", got: float64(testutil.CollectAndCount(m.handled)), want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Fatalf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	c := NewCore(log.NewLog(), nil, WithMetrics(NewMetrics()))
+	c.AddChain(&testChain{symbol: "uatom", gauges: map[string]float64{"latest_block": 42}})
+	defer c.route.StopMsgHandler()
+
+	server := httptest.NewServer(c.monitorMux())
+	defer server.Close()
+	res, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`rtoken_relay_queue_depth{destination="uatom"} 0`,
+		`rtoken_relay_chain_gauge{chain="test-uatom",name="latest_block",rsymbol="uatom"} 42`,
+		`rtoken_relay_fatal_errors_total 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics miss %s", want)
+		}
+	}
+}
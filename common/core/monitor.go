@@ -0,0 +1,73 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const monitorShutdownTimeout = 5 * time.Second
+
+// WithMetrics records router and chain metrics into m
+func WithMetrics(m *Metrics) CoreOption {
+	return func(c *Core) {
+		c.metrics = m
+	}
+}
+
+// WithMonitorAddr serves the monitor endpoints on addr while Core is running,
+// metrics are collected even if WithMetrics is not given
+func WithMonitorAddr(addr string) CoreOption {
+	return func(c *Core) {
+		c.monitorAddr = addr
+	}
+}
+
+// monitorMux routes the monitor endpoints
+func (c *Core) monitorMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(c.metrics.registry, promhttp.HandlerOpts{}))
+	mux.Handle("/healthz", probeHandler(c.Live))
+	mux.Handle("/readyz", probeHandler(c.Ready))
+	return mux
+}
+
+// startMonitor listens on the monitor address, it is a no-op if no address is configured
+func (c *Core) startMonitor() error {
+	if c.monitorAddr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", c.monitorAddr)
+	if err != nil {
+		return err
+	}
+	c.monitor = &http.Server{
+		Handler:           c.monitorMux(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := c.monitor.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.log.Error("monitor server stopped", "err", err)
+		}
+	}()
+	c.log.Info("monitor server started", "addr", listener.Addr().String())
+	return nil
+}
+
+func (c *Core) stopMonitor() {
+	if c.monitor == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), monitorShutdownTimeout)
+	defer cancel()
+	if err := c.monitor.Shutdown(ctx); err != nil {
+		c.log.Warn("monitor server shutdown", "err", err)
+	}
+}
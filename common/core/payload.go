@@ -0,0 +1,132 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	ErrMalformedMessage   = errors.New("malformed message")
+	ErrUnregisteredReason = errors.New("unregistered reason")
+)
+
+// Payload is a Message content bound to the Reason it is sent with
+type Payload interface {
+	Reason() Reason
+}
+
+var (
+	payloadsLock sync.RWMutex
+	payloads     = map[Reason]reflect.Type{}
+)
+
+func init() {
+	for _, p := range []Payload{
+		ProposalSetChainEra{},
+		ProposalExeLiquidityBond{},
+		ProposalExeNativeAndLsmLiquidityBond{},
+		ProposalBondReport{},
+		ProposalActiveReport{},
+		ProposalTransferReport{},
+		ParamSubmitSignature{},
+		ProposalRValidatorUpdateReport{},
+		ProposalInterchainTx{},
+
+		EventEraPoolUpdated{},
+		EventBondReported{},
+		EventActiveReported{},
+		EventTransferReported{},
+		EventSignatureEnough{},
+		EventRValidatorUpdated{},
+		EventRValidatorAdded{},
+		EventRParamsChanged{},
+		EventInitPool{},
+		EventRemovePool{},
+
+		EraStepDone{},
+
+		ParamGetPools{},
+		ParamGetSignatures{},
+		ParamGetBondRecord{},
+		ParamGetInterchainTxStatus{},
+		ParamGetLatestLsmBondProposalId{},
+	} {
+		RegisterPayload(p)
+	}
+}
+
+// RegisterPayload binds p.Reason() to the type of p, chains defining their own reasons
+// must register them before sending
+func RegisterPayload(p Payload) {
+	payloadsLock.Lock()
+	defer payloadsLock.Unlock()
+	payloads[p.Reason()] = reflect.TypeOf(p)
+}
+
+// PayloadType returns the content type registered for reason
+func PayloadType(reason Reason) (reflect.Type, bool) {
+	payloadsLock.RLock()
+	defer payloadsLock.RUnlock()
+	t, ok := payloads[reason]
+	return t, ok
+}
+
+// NewMessage builds a message whose reason always matches its content
+func NewMessage[P Payload](source, destination RSymbol, content P) *Message {
+	return &Message{
+		Source:      source,
+		Destination: destination,
+		Reason:      content.Reason(),
+		Content:     content,
+	}
+}
+
+// Validate checks that the content of m is the type registered for its reason or a pointer
+// to it. Reasons without a registered payload give ErrUnregisteredReason, the Router lets
+// these messages through with a warning as chains built before RegisterPayload send them.
+func (m *Message) Validate() error {
+	want, ok := PayloadType(m.Reason)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnregisteredReason, m.Reason)
+	}
+	if got := reflect.TypeOf(m.Content); got != want && got != reflect.PtrTo(want) {
+		return fmt.Errorf("%w, reason %s needs content %s, got %v", ErrMalformedMessage, m.Reason, want, got)
+	}
+	return nil
+}
+
+func (ProposalSetChainEra) Reason() Reason      { return ReasonNewEra }
+func (ProposalExeLiquidityBond) Reason() Reason { return ReasonExeLiquidityBond }
+func (ProposalExeNativeAndLsmLiquidityBond) Reason() Reason {
+	return ReasonExeNativeAndLsmLiquidityBond
+}
+func (ProposalBondReport) Reason() Reason             { return ReasonBondReport }
+func (ProposalActiveReport) Reason() Reason           { return ReasonActiveReport }
+func (ProposalTransferReport) Reason() Reason         { return ReasonTransferReport }
+func (ParamSubmitSignature) Reason() Reason           { return ReasonSubmitSignature }
+func (ProposalRValidatorUpdateReport) Reason() Reason { return ReasonRValidatorUpdateReport }
+func (ProposalInterchainTx) Reason() Reason           { return ReasonInterchainTx }
+
+func (EventEraPoolUpdated) Reason() Reason    { return ReasonEraPoolUpdatedEvent }
+func (EventBondReported) Reason() Reason      { return ReasonBondReportedEvent }
+func (EventActiveReported) Reason() Reason    { return ReasonActiveReportedEvent }
+func (EventTransferReported) Reason() Reason  { return ReasonTransferReportedEvent }
+func (EventSignatureEnough) Reason() Reason   { return ReasonSignatureEnoughEvent }
+func (EventRValidatorUpdated) Reason() Reason { return ReasonRValidatorUpdatedEvent }
+func (EventRValidatorAdded) Reason() Reason   { return ReasonRValidatorAddedEvent }
+func (EventRParamsChanged) Reason() Reason    { return ReasonRParamsChangedEvent }
+func (EventInitPool) Reason() Reason          { return ReasonInitPoolEvent }
+func (EventRemovePool) Reason() Reason        { return ReasonRemovePoolEvent }
+
+func (EraStepDone) Reason() Reason { return ReasonEraStepDone }
+
+func (ParamGetPools) Reason() Reason                   { return ReasonGetPools }
+func (ParamGetSignatures) Reason() Reason              { return ReasonGetSignatures }
+func (ParamGetBondRecord) Reason() Reason              { return ReasonGetBondRecord }
+func (ParamGetInterchainTxStatus) Reason() Reason      { return ReasonGetInterchainTxStatus }
+func (ParamGetLatestLsmBondProposalId) Reason() Reason { return ReasonGetLatestLsmBondProposalId }
@@ -0,0 +1,64 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+func TestMessageValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     *Message
+		wantErr error
+	}{
+		{name: "built with NewMessage", msg: NewMessage("ATOM", HubRFIS, ProposalActiveReport{Denom: "uatom"})},
+		{name: "matching content", msg: &Message{Reason: ReasonTransferReportedEvent, Content: EventTransferReported{}}},
+		{name: "pointer content", msg: &Message{Reason: ReasonActiveReport, Content: &ProposalActiveReport{}}},
+		{name: "content of another reason", msg: &Message{Reason: ReasonBondReport, Content: ProposalActiveReport{}}, wantErr: ErrMalformedMessage},
+		{name: "unregistered reason", msg: &Message{Reason: "Unknown", Content: 1}, wantErr: ErrUnregisteredReason},
+		{name: "missing content", msg: &Message{Reason: ReasonNewEra}, wantErr: ErrMalformedMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.msg.Validate(); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRouterAdmit(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     *Message
+		wantErr error
+	}{
+		{name: "registered reason", msg: NewMessage("uatom", HubRFIS, ProposalActiveReport{Denom: "uatom"})},
+		{name: "pointer content", msg: &Message{Source: "uatom", Destination: HubRFIS, Reason: ReasonActiveReport, Content: &ProposalActiveReport{}}},
+		{name: "unregistered reason", msg: &Message{Source: "uatom", Destination: HubRFIS, Reason: "Unknown", Content: 1}},
+		{name: "content of another reason", msg: &Message{Source: "uatom", Destination: HubRFIS, Reason: ReasonBondReport, Content: ProposalActiveReport{}}, wantErr: ErrMalformedMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(log.NewLog())
+			h := &recordHandler{}
+			r.Listen(HubRFIS, h)
+			if err := r.Send(tt.msg); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+			r.StopMsgHandler()
+			want := 1
+			if tt.wantErr != nil {
+				want = 0
+			}
+			if h.count() != want {
+				t.Fatalf("handled %d, want %d", h.count(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
+)
+
+const (
+	DefaultPoolResyncInterval = 10 * time.Minute
+	// resync interval while an ica pool is not active yet, so it is activated soon after stafihub sets its withdrawal address
+	DefaultPendingPoolResyncInterval = time.Minute
+)
+
+// PoolInfo is a pool of a denom as registered on stafihub
+type PoolInfo struct {
+	Denom             string
+	Address           string
+	Ica               bool
+	Threshold         uint32                             // multisig pools only
+	WithdrawalAddress string                             // ica pools only
+	HostChannelId     string                             // ica pools only
+	IcaStatus         stafiHubXLedgerTypes.IcaPoolStatus // ica pools only
+	TargetValidators  []string
+}
+
+// Active reports whether the relay handles the pool: multisig pools always, ica pools once
+// stafihub has set their withdrawal address
+func (p PoolInfo) Active() bool {
+	return !p.Ica || p.IcaStatus >= stafiHubXLedgerTypes.IcaPoolStatusSetWithdrawal
+}
+
+func (p PoolInfo) clone() PoolInfo {
+	p.TargetValidators = append([]string(nil), p.TargetValidators...)
+	return p
+}
+
+// equal compares p and o, the order of the target validators does not matter
+func (p PoolInfo) equal(o PoolInfo) bool {
+	if p.Denom != o.Denom || p.Address != o.Address || p.Ica != o.Ica || p.Threshold != o.Threshold ||
+		p.WithdrawalAddress != o.WithdrawalAddress || p.HostChannelId != o.HostChannelId || p.IcaStatus != o.IcaStatus ||
+		len(p.TargetValidators) != len(o.TargetValidators) {
+		return false
+	}
+	validators := make(map[string]int, len(p.TargetValidators))
+	for _, val := range p.TargetValidators {
+		validators[val]++
+	}
+	for _, val := range o.TargetValidators {
+		if validators[val] == 0 {
+			return false
+		}
+		validators[val]--
+	}
+	return true
+}
+
+// PoolSource queries every pool of a denom, usually from stafihub
+type PoolSource interface {
+	QueryPools(denom string) ([]PoolInfo, error)
+}
+
+// PoolChange is a pool added, updated or removed in the registry, Old is nil for an
+// added pool and New is nil for a removed one
+type PoolChange struct {
+	Denom   string
+	Address string
+	Old     *PoolInfo
+	New     *PoolInfo
+}
+
+func (c PoolChange) kind() string {
+	switch {
+	case c.Old == nil:
+		return "added"
+	case c.New == nil:
+		return "removed"
+	case !c.Old.Active() && c.New.Active():
+		return "activated"
+	case c.Old.Active() && !c.New.Active():
+		return "deactivated"
+	}
+	return "updated"
+}
+
+// PoolSnapshot is an immutable view of the registry, all its pools are from the same version
+type PoolSnapshot struct {
+	version uint64
+	pools   map[string]map[string]PoolInfo // denom => pool address => pool
+}
+
+// Version increases every time the pools of the registry change
+func (s *PoolSnapshot) Version() uint64 {
+	return s.version
+}
+
+// Denoms returns the tracked denoms, sorted
+func (s *PoolSnapshot) Denoms() []string {
+	denoms := make([]string, 0, len(s.pools))
+	for denom := range s.pools {
+		denoms = append(denoms, denom)
+	}
+	sort.Strings(denoms)
+	return denoms
+}
+
+// Pools returns the pools of denom sorted by address, ica pools not active yet included
+func (s *PoolSnapshot) Pools(denom string) []PoolInfo {
+	pools := make([]PoolInfo, 0, len(s.pools[denom]))
+	for _, pool := range s.pools[denom] {
+		pools = append(pools, pool.clone())
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Address < pools[j].Address })
+	return pools
+}
+
+// ActivePools returns the pools of denom the relay handles, sorted by address
+func (s *PoolSnapshot) ActivePools(denom string) []PoolInfo {
+	return filterPools(s.Pools(denom), true)
+}
+
+// PendingPools returns the ica pools of denom waiting for their withdrawal address, sorted by address
+func (s *PoolSnapshot) PendingPools(denom string) []PoolInfo {
+	return filterPools(s.Pools(denom), false)
+}
+
+func filterPools(pools []PoolInfo, active bool) []PoolInfo {
+	filtered := pools[:0]
+	for _, pool := range pools {
+		if pool.Active() == active {
+			filtered = append(filtered, pool)
+		}
+	}
+	return filtered
+}
+
+// pending reports whether an ica pool of any denom is not active yet
+func (s *PoolSnapshot) pending() bool {
+	for _, pools := range s.pools {
+		for _, pool := range pools {
+			if !pool.Active() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *PoolSnapshot) Pool(denom, address string) (PoolInfo, bool) {
+	pool, exist := s.pools[denom][address]
+	return pool.clone(), exist
+}
+
+// PoolRegistry owns the pools of the tracked denoms: their threshold, ica withdrawal address,
+// host channel and target validators. Track populates a denom, the pool events routed to the
+// chains keep it up to date and a periodic resync with the PoolSource repairs what a missed
+// event left stale. Add it to a Core with WithPoolRegistry.
+type PoolRegistry struct {
+	BaseInterceptor
+	source   PoolSource
+	interval time.Duration
+	log      log.Logger
+	lock     sync.Mutex         // serializes updates, readers only load the snapshot
+	symbols  map[string]RSymbol // denom => chain the events of the denom are sent to
+	snapshot atomic.Pointer[PoolSnapshot]
+}
+
+// NewPoolRegistry returns an empty registry resynced every interval, DefaultPoolResyncInterval if zero
+func NewPoolRegistry(source PoolSource, interval time.Duration, logger log.Logger) *PoolRegistry {
+	if interval <= 0 {
+		interval = DefaultPoolResyncInterval
+	}
+	r := &PoolRegistry{
+		source:   source,
+		interval: interval,
+		log:      logger,
+		symbols:  make(map[string]RSymbol),
+	}
+	r.snapshot.Store(&PoolSnapshot{pools: map[string]map[string]PoolInfo{}})
+	return r
+}
+
+// Track queries the pools of denom and keeps them up to date from now on, symbol is the
+// chain receiving the events of denom
+func (r *PoolRegistry) Track(symbol RSymbol, denom string) error {
+	pools, err := r.source.QueryPools(denom)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.symbols[denom] = symbol
+	r.replace(denom, pools)
+	snapshot := r.snapshot.Load()
+	pending := snapshot.PendingPools(denom)
+	r.log.Info("pools tracked", "denom", denom, "symbol", symbol, "active", len(snapshot.ActivePools(denom)), "pending", len(pending))
+	for _, pool := range pending {
+		r.log.Warn("ica pool not active yet, it is activated once stafihub sets its withdrawal address",
+			"denom", denom, "pool", pool.Address, "status", pool.IcaStatus)
+	}
+	return nil
+}
+
+// Resync queries the pools of a tracked denom again and replaces them, it returns the
+// pools which changed since the last update
+func (r *PoolRegistry) Resync(denom string) ([]PoolChange, error) {
+	pools, err := r.source.QueryPools(denom)
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, tracked := r.symbols[denom]; !tracked {
+		return nil, nil
+	}
+	return r.replace(denom, pools), nil
+}
+
+// Snapshot returns the current pools, it never blocks on updates
+func (r *PoolRegistry) Snapshot() *PoolSnapshot {
+	return r.snapshot.Load()
+}
+
+// denoms returns the tracked denoms and the chains receiving their events
+func (r *PoolRegistry) denoms() map[string]RSymbol {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	denoms := make(map[string]RSymbol, len(r.symbols))
+	for denom, symbol := range r.symbols {
+		denoms[denom] = symbol
+	}
+	return denoms
+}
+
+// PreSend applies the pool events of the tracked denoms before they reach the chains
+func (r *PoolRegistry) PreSend(msg *Message) error {
+	var changes []PoolChange
+	switch content := msg.Content.(type) {
+	case EventInitPool:
+		changes = r.update(content.Denom, func(pools map[string]PoolInfo) {
+			pools[content.PoolAddress] = PoolInfo{
+				Denom:             content.Denom,
+				Address:           content.PoolAddress,
+				Ica:               true,
+				IcaStatus:         stafiHubXLedgerTypes.IcaPoolStatusSetWithdrawal,
+				WithdrawalAddress: content.WithdrawalAddress,
+				HostChannelId:     content.HostChannelId,
+				TargetValidators:  append([]string(nil), content.Validators...),
+			}
+		})
+	case EventRemovePool:
+		changes = r.update(content.Denom, func(pools map[string]PoolInfo) {
+			delete(pools, content.PoolAddress)
+		})
+	case EventRValidatorUpdated:
+		changes = r.update(content.Denom, func(pools map[string]PoolInfo) {
+			pool, exist := pools[content.PoolAddress]
+			if !exist {
+				return
+			}
+			for i, val := range pool.TargetValidators {
+				if val == content.OldAddress {
+					pool.TargetValidators[i] = content.NewAddress
+				}
+			}
+			pools[content.PoolAddress] = pool
+		})
+	case EventRValidatorAdded:
+		changes = r.update(content.Denom, func(pools map[string]PoolInfo) {
+			pool, exist := pools[content.PoolAddress]
+			if !exist {
+				return
+			}
+			for _, val := range pool.TargetValidators {
+				if val == content.AddedAddress {
+					return
+				}
+			}
+			pool.TargetValidators = append(pool.TargetValidators, content.AddedAddress)
+			pools[content.PoolAddress] = pool
+		})
+	}
+	for _, change := range changes {
+		r.log.Info("pool "+change.kind(), "denom", change.Denom, "pool", change.Address, "reason", msg.Reason)
+	}
+	return nil
+}
+
+// update applies fn to a copy of the pools of a tracked denom and publishes them if they changed
+func (r *PoolRegistry) update(denom string, fn func(pools map[string]PoolInfo)) []PoolChange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, tracked := r.symbols[denom]; !tracked {
+		return nil
+	}
+	current := r.snapshot.Load().pools[denom]
+	pools := make(map[string]PoolInfo, len(current))
+	for address, pool := range current {
+		pools[address] = pool.clone()
+	}
+	fn(pools)
+	return r.publish(denom, pools)
+}
+
+// replace publishes pools as the pools of denom, the caller holds the lock
+func (r *PoolRegistry) replace(denom string, pools []PoolInfo) []PoolChange {
+	next := make(map[string]PoolInfo, len(pools))
+	for _, pool := range pools {
+		pool = pool.clone()
+		pool.Denom = denom
+		next[pool.Address] = pool
+	}
+	return r.publish(denom, next)
+}
+
+// publish stores a new snapshot with next as the pools of denom if they differ from the
+// current ones, the caller holds the lock
+func (r *PoolRegistry) publish(denom string, next map[string]PoolInfo) []PoolChange {
+	current := r.snapshot.Load()
+	var changes []PoolChange
+	for address, pool := range next {
+		pool := pool
+		if old, exist := current.pools[denom][address]; !exist {
+			changes = append(changes, PoolChange{Denom: denom, Address: address, New: &pool})
+		} else if !old.equal(pool) {
+			changes = append(changes, PoolChange{Denom: denom, Address: address, Old: &old, New: &pool})
+		}
+	}
+	for address, pool := range current.pools[denom] {
+		pool := pool
+		if _, exist := next[address]; !exist {
+			changes = append(changes, PoolChange{Denom: denom, Address: address, Old: &pool})
+		}
+	}
+	if _, tracked := current.pools[denom]; tracked && len(changes) == 0 {
+		return nil
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Address < changes[j].Address })
+
+	pools := make(map[string]map[string]PoolInfo, len(current.pools)+1)
+	for d, p := range current.pools {
+		pools[d] = p
+	}
+	pools[denom] = next
+	r.snapshot.Store(&PoolSnapshot{version: current.version + 1, pools: pools})
+	return changes
+}
+
+// WithPoolRegistry routes the chain messages through registry and resyncs it while the
+// Core runs, pools a resync finds changed are pushed to the chain of their denom
+func WithPoolRegistry(registry *PoolRegistry) CoreOption {
+	return func(c *Core) {
+		c.pools = registry
+		c.routerOpts = append(c.routerOpts, WithInterceptors(registry))
+	}
+}
+
+// startPoolResync resyncs the pool registry every interval, or every DefaultPendingPoolResyncInterval
+// while an ica pool is not active yet, until the returned channel is closed
+func (c *Core) startPoolResync() chan struct{} {
+	quit := make(chan struct{})
+	if c.pools == nil {
+		return quit
+	}
+	go func() {
+		for {
+			interval := c.pools.interval
+			if c.pools.Snapshot().pending() && interval > DefaultPendingPoolResyncInterval {
+				interval = DefaultPendingPoolResyncInterval
+			}
+			timer := time.NewTimer(interval)
+			select {
+			case <-quit:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			for denom, symbol := range c.pools.denoms() {
+				changes, err := c.pools.Resync(denom)
+				if err != nil {
+					c.log.Warn("resync pools failed, keep the current ones", "denom", denom, "err", err)
+					continue
+				}
+				if len(changes) > 0 {
+					c.repairPools(symbol, denom, changes)
+				}
+			}
+		}
+	}()
+	return quit
+}
+
+// repairPools brings the chain of denom up to date with pools changed without an event.
+// Chains implementing ChainPools take the new snapshot, other chains get the events they
+// missed when there are some for the change. Ica pools activated since the last resync are
+// added like pools initialized by an event. Other changes reach the chain when it is built
+// again, e.g. on its next restart.
+func (c *Core) repairPools(symbol RSymbol, denom string, changes []PoolChange) {
+	for _, change := range changes {
+		switch kind := change.kind(); {
+		case kind == "activated":
+			c.log.Info("ica pool activated", "denom", denom, "pool", change.Address, "status", change.New.IcaStatus, "chain", symbol)
+		case change.New != nil && !change.New.Active():
+			c.log.Info("ica pool not active yet", "denom", denom, "pool", change.Address, "status", change.New.IcaStatus)
+		default:
+			c.log.Warn("pool "+kind+" on stafihub without event", "denom", denom, "pool", change.Address, "chain", symbol)
+		}
+	}
+	chain := c.chain(symbol)
+	if chain == nil {
+		return
+	}
+	if updater, ok := chain.(ChainPools); ok {
+		if err := updater.UpdatePools(denom, c.pools.Snapshot()); err != nil {
+			c.log.Error("update pools of chain failed", "chain", symbol, "denom", denom, "err", err)
+		}
+		return
+	}
+
+	for _, change := range changes {
+		var msg *Message
+		wasActive := change.Old != nil && change.Old.Active()
+		switch {
+		case change.New == nil || !change.New.Active():
+			// the chain does not know pools which never were active
+			if !wasActive {
+				continue
+			}
+			msg = NewMessage(HubRFIS, symbol, EventRemovePool{Denom: denom, PoolAddress: change.Address})
+		case !wasActive && change.New.Ica:
+			msg = NewMessage(HubRFIS, symbol, EventInitPool{
+				Denom:             denom,
+				PoolAddress:       change.Address,
+				WithdrawalAddress: change.New.WithdrawalAddress,
+				HostChannelId:     change.New.HostChannelId,
+				Validators:        change.New.TargetValidators,
+			})
+		default:
+			c.log.Warn("pool change has no event the chain can take while running, it applies when the chain restarts", "chain", symbol, "denom", denom, "pool", change.Address)
+			continue
+		}
+		if err := c.route.Send(msg); err != nil {
+			c.log.Error("send missed pool event failed", "chain", symbol, "reason", msg.Reason, "pool", change.Address, "err", err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
+)
+
+// poolSource serves the pools set by the tests
+type poolSource struct {
+	lock  sync.Mutex
+	pools map[string][]PoolInfo
+	err   error
+}
+
+func (s *poolSource) QueryPools(denom string) ([]PoolInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pools[denom], s.err
+}
+
+func (s *poolSource) set(denom string, pools ...PoolInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pools[denom] = pools
+}
+
+// poolsChain is a testChain taking pool snapshots
+type poolsChain struct {
+	testChain
+	updates []*PoolSnapshot
+}
+
+func (c *poolsChain) UpdatePools(denom string, snapshot *PoolSnapshot) error {
+	c.updates = append(c.updates, snapshot)
+	return nil
+}
+
+func multisigPool(address string, validators ...string) PoolInfo {
+	return PoolInfo{Address: address, Threshold: 2, TargetValidators: validators}
+}
+
+func icaPool(address string, status stafiHubXLedgerTypes.IcaPoolStatus) PoolInfo {
+	return PoolInfo{Address: address, Ica: true, IcaStatus: status, WithdrawalAddress: "withdraw-" + address, HostChannelId: "channel-0", TargetValidators: []string{"val1"}}
+}
+
+func TestPoolRegistry(t *testing.T) {
+	source := &poolSource{pools: map[string][]PoolInfo{"uatom": {multisigPool("pool1", "val1")}}}
+	r := NewPoolRegistry(source, 0, log.NewLog())
+	if err := r.Track("uatom", "uatom"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := r.Snapshot()
+	if got, want := snapshot.Pools("uatom"), []PoolInfo{{Denom: "uatom", Address: "pool1", Threshold: 2, TargetValidators: []string{"val1"}}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("pools %+v, want %+v", got, want)
+	}
+
+	tests := []struct {
+		name       string
+		content    Payload
+		wantPool   string
+		wantExists bool
+		wantVals   []string
+	}{
+		{
+			name:       "validator added",
+			content:    EventRValidatorAdded{Denom: "uatom", PoolAddress: "pool1", AddedAddress: "val2"},
+			wantPool:   "pool1",
+			wantExists: true,
+			wantVals:   []string{"val1", "val2"},
+		},
+		{
+			name:       "validator updated",
+			content:    EventRValidatorUpdated{Denom: "uatom", PoolAddress: "pool1", OldAddress: "val1", NewAddress: "val3"},
+			wantPool:   "pool1",
+			wantExists: true,
+			wantVals:   []string{"val3", "val2"},
+		},
+		{
+			name:       "pool initialized",
+			content:    EventInitPool{Denom: "uatom", PoolAddress: "pool2", WithdrawalAddress: "withdraw2", HostChannelId: "channel-1", Validators: []string{"val1"}},
+			wantPool:   "pool2",
+			wantExists: true,
+			wantVals:   []string{"val1"},
+		},
+		{
+			name:     "pool removed",
+			content:  EventRemovePool{Denom: "uatom", PoolAddress: "pool2"},
+			wantPool: "pool2",
+		},
+		{
+			name:       "untracked denom ignored",
+			content:    EventRValidatorAdded{Denom: "uiris", PoolAddress: "pool1", AddedAddress: "val4"},
+			wantPool:   "pool1",
+			wantExists: true,
+			wantVals:   []string{"val3", "val2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := r.Snapshot()
+			if err := r.PreSend(NewMessage(HubRFIS, "uatom", tt.content)); err != nil {
+				t.Fatal(err)
+			}
+			pool, exist := r.Snapshot().Pool("uatom", tt.wantPool)
+			if exist != tt.wantExists || exist && !reflect.DeepEqual(pool.TargetValidators, tt.wantVals) {
+				t.Fatalf("pool %+v exists %v, want validators %v exists %v", pool, exist, tt.wantVals, tt.wantExists)
+			}
+			// snapshots are immutable
+			if before.Version() == r.Snapshot().Version() && !reflect.DeepEqual(before, r.Snapshot()) {
+				t.Fatal("snapshot changed without a new version")
+			}
+		})
+	}
+	if old, _ := snapshot.Pool("uatom", "pool1"); !reflect.DeepEqual(old.TargetValidators, []string{"val1"}) {
+		t.Fatalf("first snapshot changed to %v", old.TargetValidators)
+	}
+
+	// the validator order does not matter, a resync finding the same pools changes nothing
+	version := r.Snapshot().Version()
+	source.set("uatom", multisigPool("pool1", "val2", "val3"))
+	if changes, err := r.Resync("uatom"); err != nil || len(changes) != 0 || r.Snapshot().Version() != version {
+		t.Fatalf("changes %+v, err %v, version %d, want no change", changes, err, r.Snapshot().Version())
+	}
+
+	source.set("uatom", multisigPool("pool3"))
+	changes, err := r.Resync("uatom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, change := range changes {
+		kinds = append(kinds, change.Address+" "+change.kind())
+	}
+	if want := []string{"pool1 removed", "pool3 added"}; !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("changes %v, want %v", kinds, want)
+	}
+
+	source.err = errors.New("stafihub unreachable")
+	if _, err := r.Resync("uatom"); err == nil {
+		t.Fatal("resync succeeded without pools")
+	}
+	source.err = nil
+	if changes, err := r.Resync("uiris"); changes != nil || err != nil {
+		t.Fatalf("changes %v, err %v of an untracked denom", changes, err)
+	}
+}
+
+func TestRepairPools(t *testing.T) {
+	pool1 := multisigPool("pool1", "val1")
+	pool2 := multisigPool("pool2", "val1")
+	tests := []struct {
+		name       string
+		updater    bool
+		next       []PoolInfo
+		wantSent   []interface{}
+		wantUpdate bool
+	}{
+		{
+			name:     "removed pool",
+			next:     []PoolInfo{pool1},
+			wantSent: []interface{}{EventRemovePool{Denom: "uatom", PoolAddress: "pool2"}},
+		},
+		{
+			name: "changed pool without event",
+			next: []PoolInfo{multisigPool("pool1", "val2"), pool2},
+		},
+		{
+			name:       "chain taking the snapshot",
+			updater:    true,
+			next:       []PoolInfo{pool1},
+			wantUpdate: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &poolSource{pools: map[string][]PoolInfo{"uatom": {pool1, pool2}}}
+			registry := NewPoolRegistry(source, 0, log.NewLog())
+			c := NewCore(log.NewLog(), nil, WithPoolRegistry(registry))
+			chain := &poolsChain{testChain: testChain{symbol: "uatom"}}
+			if tt.updater {
+				c.AddChain(chain)
+			} else {
+				c.AddChain(&chain.testChain)
+			}
+			if err := registry.Track("uatom", "uatom"); err != nil {
+				t.Fatal(err)
+			}
+
+			source.set("uatom", tt.next...)
+			changes, err := registry.Resync("uatom")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.repairPools("uatom", "uatom", changes)
+			c.route.StopMsgHandler()
+
+			var sent []interface{}
+			for _, msg := range chain.handled {
+				sent = append(sent, msg.Content)
+			}
+			if !reflect.DeepEqual(sent, tt.wantSent) {
+				t.Fatalf("sent %+v, want %+v", sent, tt.wantSent)
+			}
+			if got := len(chain.updates) == 1 && chain.updates[0] == registry.Snapshot(); got != tt.wantUpdate {
+				t.Fatalf("updates %v, want update %v", chain.updates, tt.wantUpdate)
+			}
+		})
+	}
+}
+
+func TestIcaPools(t *testing.T) {
+	pending := icaPool("pool2", stafiHubXLedgerTypes.IcaPoolStatusCreateTwo)
+	tests := []struct {
+		name     string
+		next     []PoolInfo
+		wantKind string
+		wantSent []interface{}
+	}{
+		{
+			name:     "activated on resync",
+			next:     []PoolInfo{icaPool("pool2", stafiHubXLedgerTypes.IcaPoolStatusSetWithdrawal)},
+			wantKind: "activated",
+			wantSent: []interface{}{EventInitPool{
+				Denom:             "uatom",
+				PoolAddress:       "pool2",
+				WithdrawalAddress: "withdraw-pool2",
+				HostChannelId:     "channel-0",
+				Validators:        []string{"val1"},
+			}},
+		},
+		{
+			name:     "still pending",
+			next:     []PoolInfo{icaPool("pool2", stafiHubXLedgerTypes.IcaPoolStatusCreateOne)},
+			wantKind: "updated",
+		},
+		{
+			name:     "removed before it was active",
+			wantKind: "removed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &poolSource{pools: map[string][]PoolInfo{"uatom": {pending}}}
+			registry := NewPoolRegistry(source, 0, log.NewLog())
+			c := NewCore(log.NewLog(), nil, WithPoolRegistry(registry))
+			chain := &testChain{symbol: "uatom"}
+			c.AddChain(chain)
+			if err := registry.Track("uatom", "uatom"); err != nil {
+				t.Fatal(err)
+			}
+			snapshot := registry.Snapshot()
+			if len(snapshot.ActivePools("uatom")) != 0 || len(snapshot.PendingPools("uatom")) != 1 || !snapshot.pending() {
+				t.Fatalf("active %v, pending %v, want the pending ica pool", snapshot.ActivePools("uatom"), snapshot.PendingPools("uatom"))
+			}
+
+			source.set("uatom", tt.next...)
+			changes, err := registry.Resync("uatom")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != 1 || changes[0].kind() != tt.wantKind {
+				t.Fatalf("changes %+v, want one %s", changes, tt.wantKind)
+			}
+			c.repairPools("uatom", "uatom", changes)
+			c.route.StopMsgHandler()
+
+			var sent []interface{}
+			for _, msg := range chain.handled {
+				sent = append(sent, msg.Content)
+			}
+			if !reflect.DeepEqual(sent, tt.wantSent) {
+				t.Fatalf("sent %+v, want %+v", sent, tt.wantSent)
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+const (
+	DefaultQueueDepth   = 1024
+	DefaultQueueWorkers = 4
+)
+
+// QueuePolicy decides what Router.Send does when the destination queue is full.
+type QueuePolicy string
+
+const (
+	// block the sender until a worker takes a message off the queue
+	QueuePolicyBlock = QueuePolicy("block")
+	// discard the oldest pending message to make room for the new one
+	QueuePolicyDropOldest = QueuePolicy("dropOldest")
+	// reject the new message with ErrQueueFull
+	QueuePolicyError = QueuePolicy("error")
+)
+
+var (
+	ErrQueueFull    = errors.New("message queue is full")
+	ErrQueueClosed  = errors.New("message queue is closed")
+	ErrHandlerPanic = errors.New("message handler panicked")
+)
+
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	switch p := QueuePolicy(s); p {
+	case "":
+		return QueuePolicyBlock, nil
+	case QueuePolicyBlock, QueuePolicyDropOldest, QueuePolicyError:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown queue policy: %s, supported: %s|%s|%s", s, QueuePolicyBlock, QueuePolicyDropOldest, QueuePolicyError)
+	}
+}
+
+// QueueConfig configures the queue the Router keeps in front of every registered Handler.
+type QueueConfig struct {
+	Depth   int // max pending messages per destination
+	Workers int // max concurrent HandleMessage calls per destination
+	Policy  QueuePolicy
+}
+
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		Depth:   DefaultQueueDepth,
+		Workers: DefaultQueueWorkers,
+		Policy:  QueuePolicyBlock,
+	}
+}
+
+// withDefaults fills zero fields with their default values
+func (c QueueConfig) withDefaults() QueueConfig {
+	if c.Depth <= 0 {
+		c.Depth = DefaultQueueDepth
+	}
+	if c.Workers <= 0 {
+		c.Workers = DefaultQueueWorkers
+	}
+	if c.Policy == "" {
+		c.Policy = QueuePolicyBlock
+	}
+	return c
+}
+
+// laneKey groups messages that must be delivered in order
+type laneKey struct {
+	source RSymbol
+	reason Reason
+}
+
+type queuedMsg struct {
+	msg       *Message
+	seq       uint64
+	journalId uint64 // 0 if the message is not journaled
+	sentAt    time.Time
+}
+
+// msgQueue is a bounded queue feeding a Handler from a fixed pool of workers.
+// Messages with the same (source, reason) are handled one at a time in the order
+// they were sent, messages with different keys are handled concurrently.
+type msgQueue struct {
+	symbol       RSymbol
+	handler      Handler
+	cfg          QueueConfig
+	journal      *Journal
+	interceptors interceptorChain
+	log          log.Logger
+
+	lock     sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	lanes    map[laneKey][]queuedMsg
+	ready    []laneKey // keys with pending messages and no message in flight
+	running  map[laneKey]queuedMsg
+	size     int
+	seq      uint64
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func newMsgQueue(symbol RSymbol, handler Handler, cfg QueueConfig, journal *Journal, interceptors interceptorChain, log log.Logger) *msgQueue {
+	q := &msgQueue{
+		symbol:       symbol,
+		handler:      handler,
+		cfg:          cfg.withDefaults(),
+		journal:      journal,
+		interceptors: interceptors,
+		log:          log,
+		lanes:        make(map[laneKey][]queuedMsg),
+		running:      make(map[laneKey]queuedMsg),
+	}
+	q.notEmpty = sync.NewCond(&q.lock)
+	q.notFull = sync.NewCond(&q.lock)
+
+	q.wg.Add(q.cfg.Workers)
+	for i := 0; i < q.cfg.Workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// push appends msg to its lane, applying the full-queue policy when needed.
+// journalId is acknowledged once the handler is done with the message or it is dropped.
+func (q *msgQueue) push(msg *Message, journalId uint64) error {
+	var dropped []queuedMsg
+	defer func() {
+		// report outside the lock, interceptors may send messages
+		for _, m := range dropped {
+			q.interceptors.onError(m.msg, time.Since(m.sentAt), fmt.Errorf("%w, oldest message dropped", ErrQueueFull))
+		}
+	}()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.size >= q.cfg.Depth && !q.closed {
+		switch q.cfg.Policy {
+		case QueuePolicyError:
+			return fmt.Errorf("%w, destination: %s, depth: %d", ErrQueueFull, q.symbol, q.cfg.Depth)
+		case QueuePolicyDropOldest:
+			if m, ok := q.dropOldest(); ok {
+				dropped = append(dropped, m)
+			}
+		default:
+			q.notFull.Wait()
+		}
+	}
+	if q.closed {
+		return fmt.Errorf("%w, destination: %s", ErrQueueClosed, q.symbol)
+	}
+
+	key := laneKey{source: msg.Source, reason: msg.Reason}
+	q.seq++
+	q.lanes[key] = append(q.lanes[key], queuedMsg{msg: msg, seq: q.seq, journalId: journalId, sentAt: time.Now()})
+	q.size++
+	if _, inFlight := q.running[key]; len(q.lanes[key]) == 1 && !inFlight {
+		q.ready = append(q.ready, key)
+		q.notEmpty.Signal()
+	}
+	return nil
+}
+
+// dropOldest removes the earliest sent pending message, caller must hold the lock
+func (q *msgQueue) dropOldest() (queuedMsg, bool) {
+	var oldestKey laneKey
+	var oldest *queuedMsg
+	for key, lane := range q.lanes {
+		if oldest == nil || lane[0].seq < oldest.seq {
+			oldestKey = key
+			oldest = &lane[0]
+		}
+	}
+	if oldest == nil {
+		return queuedMsg{}, false
+	}
+	dropped := *oldest
+	q.log.Warn("message queue full, drop oldest message", "dest", q.symbol, "source", oldest.msg.Source, "reason", oldest.msg.Reason)
+	q.ack(oldest.journalId)
+
+	q.size--
+	if lane := q.lanes[oldestKey]; len(lane) > 1 {
+		q.lanes[oldestKey] = lane[1:]
+		return dropped, true
+	}
+	delete(q.lanes, oldestKey)
+	for i, key := range q.ready {
+		if key == oldestKey {
+			q.ready = append(q.ready[:i], q.ready[i+1:]...)
+			break
+		}
+	}
+	return dropped, true
+}
+
+func (q *msgQueue) worker() {
+	defer q.wg.Done()
+	for {
+		q.lock.Lock()
+		// a closed queue keeps its workers while messages wait for done, their lanes
+		// may still hold messages
+		for len(q.ready) == 0 && !(q.closed && len(q.running) == 0) {
+			q.notEmpty.Wait()
+		}
+		if len(q.ready) == 0 {
+			// closed and nothing left to handle
+			q.lock.Unlock()
+			return
+		}
+		key := q.ready[0]
+		q.ready = q.ready[1:]
+		lane := q.lanes[key]
+		m := lane[0]
+		if len(lane) == 1 {
+			delete(q.lanes, key)
+		} else {
+			q.lanes[key] = lane[1:]
+		}
+		q.size--
+		q.running[key] = m
+		q.notFull.Signal()
+		q.lock.Unlock()
+
+		done := q.finisher(key, m, time.Now())
+		if err := q.handle(m.msg, done); err != nil {
+			// a message whose handler panicked is dropped, it would panic again on replay
+			done(err)
+		}
+	}
+}
+
+// finisher returns the done func of m, only its first call counts. It acknowledges the
+// journal entry, reports the outcome to the interceptors and lets the lane of m move on.
+func (q *msgQueue) finisher(key laneKey, m queuedMsg, start time.Time) func(err error) {
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() {
+			q.ack(m.journalId)
+			if err != nil {
+				q.interceptors.onError(m.msg, time.Since(m.sentAt), err)
+			} else {
+				q.interceptors.postHandle(m.msg, time.Since(start))
+			}
+
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			delete(q.running, key)
+			if len(q.lanes[key]) > 0 {
+				q.ready = append(q.ready, key)
+				q.notEmpty.Signal()
+			} else if q.closed && len(q.running) == 0 {
+				q.notEmpty.Broadcast()
+			}
+		})
+	}
+}
+
+// handle passes msg to the handler, done is called once the handler is finished with it. A
+// panic is recovered and returned as an ErrHandlerPanic so a faulty handler only loses the
+// message instead of the whole relay.
+func (q *msgQueue) handle(msg *Message, done func(err error)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w, dest: %s, reason: %s: %v", ErrHandlerPanic, q.symbol, msg.Reason, r)
+			q.log.Error("message handler panicked", "dest", q.symbol, "source", msg.Source, "reason", msg.Reason, "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	if h, ok := q.handler.(AckHandler); ok {
+		h.HandleMessageAck(msg, done)
+		return nil
+	}
+	q.handler.HandleMessage(msg)
+	done(nil)
+	return nil
+}
+
+func (q *msgQueue) ack(journalId uint64) {
+	if q.journal == nil || journalId == 0 {
+		return
+	}
+	if err := q.journal.Ack(journalId); err != nil {
+		q.log.Error("journal ack failed", "dest", q.symbol, "seq", journalId, "err", err)
+	}
+}
+
+// Len returns the number of pending messages
+func (q *msgQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size
+}
+
+// close stops accepting messages, workers exit once the pending messages are handled
+func (q *msgQueue) close() {
+	q.lock.Lock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	q.lock.Unlock()
+}
+
+// takePending removes the messages not handed to a worker yet, ordered by send sequence
+func (q *msgQueue) takePending() []queuedMsg {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	pending := make([]queuedMsg, 0, q.size)
+	for _, lane := range q.lanes {
+		pending = append(pending, lane...)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].seq < pending[j].seq })
+
+	q.lanes = make(map[laneKey][]queuedMsg)
+	q.ready = nil
+	q.size = 0
+	return pending
+}
+
+// drain closes the queue and waits until every pending message is handled or the deadline
+// passes. It returns the messages still in flight or pending at the deadline, pending
+// messages are discarded so workers exit as soon as their current message is handled.
+// Handled means HandleMessage returned, or done was called for an AckHandler: plain handlers
+// which only hand the message over to their own goroutines return before its work is done,
+// drain does not wait for that work.
+func (q *msgQueue) drain(deadline time.Time) []*Message {
+	q.close()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+	}
+
+	q.lock.Lock()
+	abandoned := make([]queuedMsg, 0, len(q.running)+q.size)
+	for _, m := range q.running {
+		abandoned = append(abandoned, m)
+	}
+	q.lock.Unlock()
+	abandoned = append(abandoned, q.takePending()...)
+
+	msgs := make([]*Message, len(abandoned))
+	for i, m := range abandoned {
+		msgs[i] = m.msg
+		q.interceptors.onError(m.msg, time.Since(m.sentAt), fmt.Errorf("%w, message abandoned", ErrRouterStopped))
+	}
+	return msgs
+}
@@ -0,0 +1,309 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+// recordHandler records the handled messages, blocking on release if it is set
+type recordHandler struct {
+	lock    sync.Mutex
+	handled []*Message
+	release chan struct{}
+	panics  bool
+}
+
+func (h *recordHandler) HandleMessage(msg *Message) {
+	if h.release != nil {
+		<-h.release
+	}
+	if h.panics {
+		panic("handler failed")
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.handled = append(h.handled, msg)
+}
+
+func (h *recordHandler) count() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.handled)
+}
+
+// ackHandler hands out the done funcs of the messages instead of calling them
+type ackHandler struct {
+	recordHandler
+	dones chan func(error)
+}
+
+func (h *ackHandler) HandleMessageAck(msg *Message, done func(err error)) {
+	h.HandleMessage(msg)
+	h.dones <- done
+}
+
+// outcomes counts the messages reported to the interceptors
+type outcomes struct {
+	BaseInterceptor
+	lock   sync.Mutex
+	done   int
+	failed []error
+}
+
+func (o *outcomes) PostHandle(*Message, time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.done++
+}
+
+func (o *outcomes) OnError(_ *Message, _ time.Duration, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.failed = append(o.failed, err)
+}
+
+func testMsg(source RSymbol, era uint32) *Message {
+	return &Message{Source: source, Destination: HubRFIS, Reason: ReasonEraPoolUpdatedEvent, Content: EventEraPoolUpdated{Denom: string(source), CurrentEra: era}}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestParseQueuePolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    QueuePolicy
+		wantErr bool
+	}{
+		{in: "", want: QueuePolicyBlock},
+		{in: "block", want: QueuePolicyBlock},
+		{in: "dropOldest", want: QueuePolicyDropOldest},
+		{in: "error", want: QueuePolicyError},
+		{in: "drop", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseQueuePolicy(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Fatalf("ParseQueuePolicy(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestQueueFullPolicy(t *testing.T) {
+	tests := []struct {
+		policy  QueuePolicy
+		sendErr error
+		dropped int
+	}{
+		{policy: QueuePolicyError, sendErr: ErrQueueFull},
+		{policy: QueuePolicyDropOldest, dropped: 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			h := &recordHandler{release: make(chan struct{})}
+			o := &outcomes{}
+			q := newMsgQueue(HubRFIS, h, QueueConfig{Depth: 2, Workers: 1, Policy: tt.policy}, nil, interceptorChain{o}, log.NewLog())
+
+			// the first message blocks the worker, the next two fill the queue
+			for era := uint32(1); era <= 3; era++ {
+				if err := q.push(testMsg("uatom", era), 0); err != nil {
+					t.Fatal(err)
+				}
+				if era == 1 {
+					waitFor(t, func() bool { return q.Len() == 0 })
+				}
+			}
+			err := q.push(testMsg("uatom", 4), 0)
+			if !errors.Is(err, tt.sendErr) {
+				t.Fatalf("push on full queue: got %v, want %v", err, tt.sendErr)
+			}
+			o.lock.Lock()
+			dropped := len(o.failed)
+			o.lock.Unlock()
+			if dropped != tt.dropped {
+				t.Fatalf("dropped %d, want %d", dropped, tt.dropped)
+			}
+			close(h.release)
+			q.drain(time.Now().Add(time.Second))
+		})
+	}
+}
+
+func TestQueueLaneOrder(t *testing.T) {
+	h := &recordHandler{}
+	q := newMsgQueue(HubRFIS, h, QueueConfig{Depth: 100, Workers: 4}, nil, nil, log.NewLog())
+	for era := uint32(1); era <= 20; era++ {
+		for _, source := range []RSymbol{"uatom", "uiris"} {
+			if err := q.push(testMsg(source, era), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if abandoned := q.drain(time.Now().Add(2 * time.Second)); len(abandoned) != 0 {
+		t.Fatalf("%d messages abandoned", len(abandoned))
+	}
+
+	last := map[RSymbol]uint32{}
+	for _, msg := range h.handled {
+		era := msg.Content.(EventEraPoolUpdated).CurrentEra
+		if era != last[msg.Source]+1 {
+			t.Fatalf("%s: era %d handled after %d", msg.Source, era, last[msg.Source])
+		}
+		last[msg.Source] = era
+	}
+}
+
+func TestQueueRecoversPanic(t *testing.T) {
+	o := &outcomes{}
+	q := newMsgQueue(HubRFIS, &recordHandler{panics: true}, QueueConfig{Workers: 1}, nil, interceptorChain{o}, log.NewLog())
+	for era := uint32(1); era <= 2; era++ {
+		if err := q.push(testMsg("uatom", era), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.drain(time.Now().Add(time.Second))
+	if len(o.failed) != 2 || !errors.Is(o.failed[0], ErrHandlerPanic) {
+		t.Fatalf("errors: %v", o.failed)
+	}
+}
+
+func TestQueueAckHandler(t *testing.T) {
+	j, err := OpenJournal(t.TempDir(), nil, log.NewLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	h := &ackHandler{dones: make(chan func(error), 4)}
+	o := &outcomes{}
+	q := newMsgQueue(HubRFIS, h, QueueConfig{Workers: 2}, j, interceptorChain{o}, log.NewLog())
+
+	for era := uint32(1); era <= 2; era++ {
+		msg := testMsg("uatom", era)
+		seq, _, err := j.Append(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.push(msg, seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := <-h.dones
+	// the second message of the lane waits for done of the first
+	time.Sleep(20 * time.Millisecond)
+	if h.count() != 1 || len(j.pendingMsgs()) != 2 {
+		t.Fatalf("handled %d, pending %d before done", h.count(), len(j.pendingMsgs()))
+	}
+	done(nil)
+	done(errors.New("second call is ignored"))
+	waitFor(t, func() bool { return h.count() == 2 })
+	if pending := j.pendingMsgs(); len(pending) != 1 || pending[0].msg.Content.(EventEraPoolUpdated).CurrentEra != 2 {
+		t.Fatalf("pending after first done: %+v", pending)
+	}
+
+	// drain waits for done of the message in flight
+	drained := make(chan []*Message)
+	go func() {
+		drained <- q.drain(time.Now().Add(2 * time.Second))
+	}()
+	select {
+	case <-drained:
+		t.Fatal("drain returned before done")
+	case <-time.After(20 * time.Millisecond):
+	}
+	(<-h.dones)(errors.New("tx failed"))
+	if abandoned := <-drained; len(abandoned) != 0 {
+		t.Fatalf("%d messages abandoned", len(abandoned))
+	}
+	if len(j.pendingMsgs()) != 0 || o.done != 1 || len(o.failed) != 1 {
+		t.Fatalf("pending %d, done %d, failed %v", len(j.pendingMsgs()), o.done, o.failed)
+	}
+}
+
+func TestQueueDrain(t *testing.T) {
+	tests := []struct {
+		name      string
+		blocked   bool
+		abandoned int
+	}{
+		{name: "handled before the deadline"},
+		{name: "running and pending abandoned at the deadline", blocked: true, abandoned: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &recordHandler{}
+			if tt.blocked {
+				h.release = make(chan struct{})
+				defer close(h.release)
+			}
+			o := &outcomes{}
+			q := newMsgQueue(HubRFIS, h, QueueConfig{Workers: 1}, nil, interceptorChain{o}, log.NewLog())
+			for era := uint32(1); era <= 3; era++ {
+				if err := q.push(testMsg("uatom", era), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			abandoned := q.drain(time.Now().Add(100 * time.Millisecond))
+			if len(abandoned) != tt.abandoned {
+				t.Fatalf("%d messages abandoned, want %d", len(abandoned), tt.abandoned)
+			}
+			o.lock.Lock()
+			failed := len(o.failed)
+			o.lock.Unlock()
+			if failed != tt.abandoned {
+				t.Fatalf("%d abandoned messages reported, want %d", failed, tt.abandoned)
+			}
+			if err := q.push(testMsg("uatom", 4), 0); !errors.Is(err, ErrQueueClosed) {
+				t.Fatalf("push after drain: %v, want %v", err, ErrQueueClosed)
+			}
+		})
+	}
+}
+
+func TestRouterStopMsgHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		blocked   bool
+		abandoned int
+	}{
+		{name: "drained"},
+		{name: "abandoned at the drain timeout", blocked: true, abandoned: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &recordHandler{}
+			if tt.blocked {
+				h.release = make(chan struct{})
+				defer close(h.release)
+			}
+			r := NewRouter(log.NewLog(), WithQueueConfig(QueueConfig{Workers: 1}), WithDrainTimeout(100*time.Millisecond))
+			r.Listen(HubRFIS, h)
+			for era := uint32(1); era <= 2; era++ {
+				if err := r.Send(testMsg("uatom", era)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if abandoned := r.StopMsgHandler(); len(abandoned) != tt.abandoned {
+				t.Fatalf("%d messages abandoned, want %d", len(abandoned), tt.abandoned)
+			}
+			if err := r.Send(testMsg("uatom", 3)); !errors.Is(err, ErrRouterStopped) {
+				t.Fatalf("send after stop: %v, want %v", err, ErrRouterStopped)
+			}
+		})
+	}
+}
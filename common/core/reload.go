@@ -0,0 +1,43 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/stafihub/rtoken-relay-core/common/config"
+)
+
+var (
+	ErrReloadNotSupported = errors.New("chain does not support reload")
+	ErrConfigChanged      = errors.New("chain config changed")
+)
+
+// ReloadChain applies cfg to the running chain registered for symbol. A supervised chain not
+// implementing ChainReloader is restarted by the supervisor, its factory must build it from
+// the new config. Other chains not implementing it get ErrReloadNotSupported, the relay
+// must be restarted to apply cfg.
+func (c *Core) ReloadChain(symbol RSymbol, cfg *config.RawChainConfig) error {
+	chain := c.chain(symbol)
+	if chain == nil {
+		return fmt.Errorf("no chain registered for %s", symbol)
+	}
+	reloader, ok := chain.(ChainReloader)
+	if !ok {
+		if _, supervised := c.supervised[symbol]; !supervised {
+			return fmt.Errorf("%w: %s", ErrReloadNotSupported, chain.Name())
+		}
+		if err := c.requestRestart(symbol, ErrConfigChanged); err != nil {
+			return fmt.Errorf("restart %s failed: %w", chain.Name(), err)
+		}
+		c.log.Info("chain restarting to apply the config", "chain", chain.Name(), "rsymbol", symbol)
+		return nil
+	}
+	if err := reloader.Reload(cfg); err != nil {
+		return fmt.Errorf("reload %s failed: %w", chain.Name(), err)
+	}
+	c.log.Info("chain reloaded", "chain", chain.Name(), "rsymbol", symbol)
+	return nil
+}
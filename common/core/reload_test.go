@@ -0,0 +1,85 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/config"
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+// reloadingChain records the configs it reloads
+type reloadingChain struct {
+	testChain
+	lock     sync.Mutex
+	reloaded []*config.RawChainConfig
+}
+
+func (c *reloadingChain) Reload(cfg *config.RawChainConfig) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reloaded = append(c.reloaded, cfg)
+	return nil
+}
+
+func TestReloadChain(t *testing.T) {
+	cfg := &config.RawChainConfig{Rsymbol: "uatom", EndpointList: []string{"http://a:26657"}}
+	reloading := &reloadingChain{testChain: testChain{symbol: "uatom"}}
+	c := NewCore(log.NewLog(), nil)
+	c.AddChain(reloading)
+	c.AddChain(&testChain{symbol: HubRFIS})
+
+	if err := c.ReloadChain("uatom", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloading.reloaded) != 1 || reloading.reloaded[0] != cfg {
+		t.Fatalf("reloaded %v, want %v", reloading.reloaded, cfg)
+	}
+	if err := c.ReloadChain(HubRFIS, cfg); !errors.Is(err, ErrReloadNotSupported) {
+		t.Fatalf("err %v, want %v", err, ErrReloadNotSupported)
+	}
+	if err := c.ReloadChain("uiris", cfg); err == nil {
+		t.Fatal("reload of an unknown chain succeeded")
+	}
+}
+
+func TestReloadChainRestartsSupervised(t *testing.T) {
+	sysErr := make(chan error)
+	c := NewCore(log.NewLog(), sysErr, WithSupervisorConfig(SupervisorConfig{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Minute,
+		MaxRestarts:    2,
+	}))
+	builds := &chainBuilds{symbol: "uatom", failBuild: map[int]bool{5: true}}
+	if err := c.AddSupervisedChain(builds.newChain); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		c.Start()
+		close(stopped)
+	}()
+	waitFor(t, func() bool { return c.Ready() == nil })
+
+	// more config changes than MaxRestarts, they are no failures
+	cfg := &config.RawChainConfig{Rsymbol: "uatom"}
+	for want := 2; want <= 4; want++ {
+		if err := c.ReloadChain("uatom", cfg); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return builds.count() == want && c.Ready() == nil })
+	}
+	// the backoff started over, failed builds are retried
+	if err := c.ReloadChain("uatom", cfg); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return builds.count() == 6 && c.Ready() == nil })
+
+	sysErr <- errors.New("stop")
+	<-stopped
+}
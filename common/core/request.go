@@ -0,0 +1,211 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
+)
+
+const DefaultRequestTimeout = 10 * time.Second
+
+var (
+	ErrNoHandler          = errors.New("no handler registered")
+	ErrRequestTimeout     = errors.New("request timeout")
+	ErrUnsupportedRequest = errors.New("unsupported request content")
+)
+
+// HandlerError is returned by Router.Request when the destination handler failed to answer
+type HandlerError struct {
+	Destination RSymbol
+	Reason      Reason
+	Err         error
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("handler of %s failed on %s: %s", e.Destination, e.Reason, e.Err)
+}
+
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// RequestHandler answers a request synchronously. Handlers implementing it are called
+// directly by Router.Request, others receive the request through HandleMessage and
+// reply on the channel embedded in the get params.
+type RequestHandler interface {
+	HandleRequest(ctx context.Context, msg *Message) (interface{}, error)
+}
+
+// WithRequestTimeout sets the deadline applied to requests whose context has none
+func WithRequestTimeout(timeout time.Duration) RouterOption {
+	return func(r *Router) {
+		if timeout > 0 {
+			r.requestTimeout = timeout
+		}
+	}
+}
+
+// Request sends msg to its destination and waits for the reply until ctx is done.
+// If ctx has no deadline the router request timeout is applied. Get params sent with Send
+// and a reply channel of the sender keep working, Request does not replace them.
+func (r *Router) Request(ctx context.Context, msg *Message) (interface{}, error) {
+	start := time.Now()
+	value, err := r.request(ctx, msg)
+	if err != nil {
+		r.interceptors.onError(msg, time.Since(start), err)
+	}
+	return value, err
+}
+
+func (r *Router) request(ctx context.Context, msg *Message) (interface{}, error) {
+	if err := r.admit(msg); err != nil {
+		return nil, err
+	}
+
+	r.lock.RLock()
+	q := r.registry[msg.Destination]
+	r.lock.RUnlock()
+	if q == nil {
+		return nil, fmt.Errorf("%w, unknown destination symbol: %s", ErrNoHandler, msg.Destination)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.requestTimeout)
+		defer cancel()
+	}
+
+	if rh, ok := q.handler.(RequestHandler); ok {
+		if err := r.interceptors.preSend(msg); err != nil {
+			return nil, err
+		}
+
+		type result struct {
+			value interface{}
+			err   error
+		}
+		done := make(chan result, 1)
+		handleStart := time.Now()
+		go func() {
+			value, err := rh.HandleRequest(ctx, msg)
+			done <- result{value, err}
+		}()
+
+		select {
+		case res := <-done:
+			if res.err != nil {
+				return nil, &HandlerError{Destination: msg.Destination, Reason: msg.Reason, Err: res.err}
+			}
+			r.interceptors.postHandle(msg, time.Since(handleStart))
+			return res.value, nil
+		case <-ctx.Done():
+			return nil, requestCtxErr(ctx, msg)
+		}
+	}
+
+	req, wait, err := bindReply(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.send(req); err != nil {
+		return nil, err
+	}
+	return wait(ctx)
+}
+
+// bindReply copies msg with a fresh buffered reply channel in its content, a late
+// reply never blocks the handler after the requester gave up
+func bindReply(msg *Message) (*Message, func(context.Context) (interface{}, error), error) {
+	req := *msg
+	switch param := msg.Content.(type) {
+	case ParamGetPools:
+		param.Pools = make(chan []string, 1)
+		req.Content = param
+		return &req, awaitReply(&req, param.Pools), nil
+	case ParamGetSignatures:
+		param.Sigs = make(chan []string, 1)
+		req.Content = param
+		return &req, awaitReply(&req, param.Sigs), nil
+	case ParamGetBondRecord:
+		param.BondRecord = make(chan stafiHubXLedgerTypes.BondRecord, 1)
+		req.Content = param
+		return &req, awaitReply(&req, param.BondRecord), nil
+	case ParamGetInterchainTxStatus:
+		param.Status = make(chan stafiHubXLedgerTypes.InterchainTxStatus, 1)
+		req.Content = param
+		return &req, awaitReply(&req, param.Status), nil
+	case ParamGetLatestLsmBondProposalId:
+		param.PropId = make(chan string, 1)
+		req.Content = param
+		return &req, awaitReply(&req, param.PropId), nil
+	default:
+		return nil, nil, fmt.Errorf("%w, reason: %s, content: %T", ErrUnsupportedRequest, msg.Reason, msg.Content)
+	}
+}
+
+func awaitReply[T any](msg *Message, reply <-chan T) func(context.Context) (interface{}, error) {
+	return func(ctx context.Context) (interface{}, error) {
+		select {
+		case value := <-reply:
+			return value, nil
+		case <-ctx.Done():
+			return nil, requestCtxErr(ctx, msg)
+		}
+	}
+}
+
+// replyAs converts a reply to the type expected by the typed request helpers
+func replyAs[T any](value interface{}, err error) (T, error) {
+	var reply T
+	if err != nil {
+		return reply, err
+	}
+	reply, ok := value.(T)
+	if !ok {
+		return reply, fmt.Errorf("unexpected reply type %T, want %T", value, reply)
+	}
+	return reply, nil
+}
+
+func requestCtxErr(ctx context.Context, msg *Message) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w, dest: %s, reason: %s", ErrRequestTimeout, msg.Destination, msg.Reason)
+	}
+	return fmt.Errorf("request canceled, dest: %s, reason: %s: %w", msg.Destination, msg.Reason, ctx.Err())
+}
+
+// GetPools requests the pools of denom from stafihub
+func (r *Router) GetPools(ctx context.Context, source RSymbol, denom string) ([]string, error) {
+	value, err := r.Request(ctx, NewMessage(source, HubRFIS, ParamGetPools{Denom: denom}))
+	return replyAs[[]string](value, err)
+}
+
+// GetSignatures requests the signatures submitted to stafihub for a proposal
+func (r *Router) GetSignatures(ctx context.Context, source RSymbol, param ParamGetSignatures) ([]string, error) {
+	value, err := r.Request(ctx, NewMessage(source, HubRFIS, param))
+	return replyAs[[]string](value, err)
+}
+
+// GetBondRecord requests the bond record of txHash from stafihub
+func (r *Router) GetBondRecord(ctx context.Context, source RSymbol, denom, txHash string) (stafiHubXLedgerTypes.BondRecord, error) {
+	value, err := r.Request(ctx, NewMessage(source, HubRFIS, ParamGetBondRecord{Denom: denom, TxHash: txHash}))
+	return replyAs[stafiHubXLedgerTypes.BondRecord](value, err)
+}
+
+// GetInterchainTxStatus requests the status of an interchain tx proposal from stafihub
+func (r *Router) GetInterchainTxStatus(ctx context.Context, source RSymbol, propId string) (stafiHubXLedgerTypes.InterchainTxStatus, error) {
+	value, err := r.Request(ctx, NewMessage(source, HubRFIS, ParamGetInterchainTxStatus{PropId: propId}))
+	return replyAs[stafiHubXLedgerTypes.InterchainTxStatus](value, err)
+}
+
+// GetLatestLsmBondProposalId requests the latest lsm bond proposal id from stafihub
+func (r *Router) GetLatestLsmBondProposalId(ctx context.Context, source RSymbol) (string, error) {
+	value, err := r.Request(ctx, NewMessage(source, HubRFIS, ParamGetLatestLsmBondProposalId{}))
+	return replyAs[string](value, err)
+}
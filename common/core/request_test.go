@@ -0,0 +1,206 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
+)
+
+// replyHandler answers get params on their reply channel like the sdk chains, or never
+type replyHandler struct {
+	silent bool
+}
+
+func (h *replyHandler) HandleMessage(msg *Message) {
+	if h.silent {
+		return
+	}
+	switch param := msg.Content.(type) {
+	case ParamGetPools:
+		param.Pools <- []string{"pool-" + param.Denom}
+	case ParamGetSignatures:
+		param.Sigs <- []string{"sig"}
+	case ParamGetBondRecord:
+		param.BondRecord <- stafiHubXLedgerTypes.BondRecord{Txhash: param.TxHash}
+	case ParamGetInterchainTxStatus:
+		param.Status <- stafiHubXLedgerTypes.InterchainTxStatusSuccess
+	case ParamGetLatestLsmBondProposalId:
+		param.PropId <- "prop"
+	}
+}
+
+// syncHandler answers requests directly
+type syncHandler struct {
+	replyHandler
+	value interface{}
+	err   error
+	wait  bool
+}
+
+func (h *syncHandler) HandleRequest(ctx context.Context, _ *Message) (interface{}, error) {
+	if h.wait {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return h.value, h.err
+}
+
+func TestRouterRequest(t *testing.T) {
+	errFailed := errors.New("query failed")
+	tests := []struct {
+		name    string
+		handler Handler
+		msg     *Message
+		want    interface{}
+		wantErr error
+	}{
+		{
+			name:    "reply channel",
+			handler: &replyHandler{},
+			msg:     NewMessage("uatom", HubRFIS, ParamGetPools{Denom: "uatom"}),
+			want:    []string{"pool-uatom"},
+		},
+		{
+			name:    "reply channel of the sender replaced",
+			handler: &replyHandler{},
+			msg:     NewMessage("uatom", HubRFIS, ParamGetLatestLsmBondProposalId{PropId: make(chan string)}),
+			want:    "prop",
+		},
+		{
+			name:    "request handler",
+			handler: &syncHandler{value: "direct"},
+			msg:     NewMessage("uatom", HubRFIS, ParamGetPools{Denom: "uatom"}),
+			want:    "direct",
+		},
+		{
+			name:    "request handler failed",
+			handler: &syncHandler{err: errFailed},
+			msg:     NewMessage("uatom", HubRFIS, ParamGetPools{Denom: "uatom"}),
+			wantErr: errFailed,
+		},
+		{
+			name:    "no reply",
+			handler: &replyHandler{silent: true},
+			msg:     NewMessage("uatom", HubRFIS, ParamGetPools{Denom: "uatom"}),
+			wantErr: ErrRequestTimeout,
+		},
+		{
+			name:    "request handler timeout",
+			handler: &syncHandler{wait: true},
+			msg:     NewMessage("uatom", HubRFIS, ParamGetPools{Denom: "uatom"}),
+			wantErr: ErrRequestTimeout,
+		},
+		{
+			name:    "no handler",
+			msg:     NewMessage("uatom", "uiris", ParamGetPools{Denom: "uatom"}),
+			wantErr: ErrNoHandler,
+		},
+		{
+			name:    "not a get param",
+			handler: &replyHandler{},
+			msg:     NewMessage("uatom", HubRFIS, ProposalSetChainEra{Denom: "uatom"}),
+			wantErr: ErrUnsupportedRequest,
+		},
+		{
+			name:    "malformed",
+			handler: &replyHandler{},
+			msg:     &Message{Source: "uatom", Destination: HubRFIS, Reason: ReasonGetPools, Content: ParamGetBondRecord{}},
+			wantErr: ErrMalformedMessage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(log.NewLog(), WithRequestTimeout(50*time.Millisecond))
+			if tt.handler != nil {
+				r.Listen(HubRFIS, tt.handler)
+			}
+			got, err := r.Request(context.Background(), tt.msg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("reply %v, want %v", got, tt.want)
+			}
+			r.StopMsgHandler()
+		})
+	}
+}
+
+func TestRouterRequestCanceled(t *testing.T) {
+	r := NewRouter(log.NewLog())
+	r.Listen(HubRFIS, &replyHandler{silent: true})
+	defer r.StopMsgHandler()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := r.Request(ctx, NewMessage("uatom", HubRFIS, ParamGetPools{Denom: "uatom"}))
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrRequestTimeout) {
+		t.Fatalf("err %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRouterTypedRequests(t *testing.T) {
+	r := NewRouter(log.NewLog())
+	r.Listen(HubRFIS, &replyHandler{})
+	defer r.StopMsgHandler()
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		request func() (interface{}, error)
+		want    interface{}
+	}{
+		{name: "pools", request: func() (interface{}, error) { return r.GetPools(ctx, "uatom", "uatom") }, want: []string{"pool-uatom"}},
+		{name: "signatures", request: func() (interface{}, error) { return r.GetSignatures(ctx, "uatom", ParamGetSignatures{PropId: "p"}) }, want: []string{"sig"}},
+		{
+			name:    "bond record",
+			request: func() (interface{}, error) { return r.GetBondRecord(ctx, "uatom", "uatom", "0xtx") },
+			want:    stafiHubXLedgerTypes.BondRecord{Txhash: "0xtx"},
+		},
+		{
+			name:    "interchain tx status",
+			request: func() (interface{}, error) { return r.GetInterchainTxStatus(ctx, "uatom", "p") },
+			want:    stafiHubXLedgerTypes.InterchainTxStatusSuccess,
+		},
+		{name: "latest lsm bond proposal", request: func() (interface{}, error) { return r.GetLatestLsmBondProposalId(ctx, "uatom") }, want: "prop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.request()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("reply %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterSendWithReplyChannel(t *testing.T) {
+	r := NewRouter(log.NewLog())
+	r.Listen(HubRFIS, &replyHandler{})
+	defer r.StopMsgHandler()
+
+	// the sdk chains create the reply channel and wait on it themselves
+	pools := make(chan []string, 1)
+	if err := r.Send(NewMessage("uatom", HubRFIS, ParamGetPools{Denom: "uatom", Pools: pools})); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-pools:
+		if !reflect.DeepEqual(got, []string{"pool-uatom"}) {
+			t.Fatalf("reply %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reply")
+	}
+}
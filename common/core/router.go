@@ -4,49 +4,214 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"github.com/stafihub/rtoken-relay-core/common/log"
 	"sync"
+	"time"
 )
 
-// Handler consumes a message and makes the requried on-chain interactions.
+const DefaultDrainTimeout = 30 * time.Second
+
+var ErrRouterStopped = errors.New("router is stopped")
+
+// Handler consumes a message and makes the requried on-chain interactions. The Router
+// considers a message handled once HandleMessage returns, work the handler leaves to its
+// own goroutines is not covered by the drain on shutdown. The sdk chains work that way,
+// handlers implement AckHandler for the drain to wait for their work.
 type Handler interface {
 	HandleMessage(msg *Message)
 }
 
+// AckHandler is a Handler which reports when the work on a message is done, e.g. once the
+// tx it submitted landed on chain. The Router calls HandleMessageAck instead of HandleMessage
+// and considers the message handled once done is called, with the error the work ended with.
+// Its journaled messages are acknowledged when done is called instead of when HandleMessageAck
+// returns. Later messages with the same source and reason wait for done.
+type AckHandler interface {
+	Handler
+	HandleMessageAck(msg *Message, done func(err error))
+}
+
+// RouterOption customizes a Router created by NewRouter
+type RouterOption func(*Router)
+
+// WithQueueConfig sets the queue config used for every registered Handler
+func WithQueueConfig(cfg QueueConfig) RouterOption {
+	return func(r *Router) {
+		r.queueCfg = cfg.withDefaults()
+	}
+}
+
+// WithDrainTimeout sets how long StopMsgHandler waits for queued and in-flight messages
+func WithDrainTimeout(timeout time.Duration) RouterOption {
+	return func(r *Router) {
+		if timeout > 0 {
+			r.drainTimeout = timeout
+		}
+	}
+}
+
+// WithJournal records routed messages in journal so unhandled messages survive a restart
+func WithJournal(journal *Journal) RouterOption {
+	return func(r *Router) {
+		r.journal = journal
+	}
+}
+
 // Router forwards messages from their source to their destination
 type Router struct {
-	registry map[RSymbol]Handler
-	lock     *sync.RWMutex
-	log      log.Logger
-	stop     chan int
+	registry       map[RSymbol]*msgQueue
+	queueCfg       QueueConfig
+	drainTimeout   time.Duration
+	requestTimeout time.Duration
+	journal        *Journal
+	interceptors   interceptorChain
+	eraProgress    *EraProgress
+	lock           *sync.RWMutex
+	log            log.Logger
+	stop           chan int
+	stopOnce       sync.Once
+	unregistered   sync.Map // reasons warned about as unregistered
 }
 
-func NewRouter(log log.Logger) *Router {
-	return &Router{
-		registry: make(map[RSymbol]Handler),
-		lock:     &sync.RWMutex{},
-		log:      log,
-		stop:     make(chan int),
+func NewRouter(log log.Logger, opts ...RouterOption) *Router {
+	r := &Router{
+		registry:       make(map[RSymbol]*msgQueue),
+		queueCfg:       DefaultQueueConfig(),
+		drainTimeout:   DefaultDrainTimeout,
+		requestTimeout: DefaultRequestTimeout,
+		lock:           &sync.RWMutex{},
+		log:            log,
+		stop:           make(chan int),
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
-// Send passes a message to the destination Writer if it exists
+// Send passes a message to the destination queue if it exists, messages whose content
+// does not match their reason are rejected with ErrMalformedMessage, messages with an
+// unregistered reason are passed with a warning. Depending on the
+// queue policy, Send blocks, drops the oldest pending message or returns ErrQueueFull
+// when the destination queue is full.
 func (r *Router) Send(msg *Message) error {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	start := time.Now()
+	err := r.send(msg)
+	if err != nil {
+		r.interceptors.onError(msg, time.Since(start), err)
+	}
+	return err
+}
+
+func (r *Router) send(msg *Message) error {
+	if err := r.admit(msg); err != nil {
+		return err
+	}
+	if done, ok := msg.Content.(EraStepDone); ok {
+		return r.eraStepDone(msg.Source, done)
+	}
+	if r.eraProgress != nil && r.eraProgress.rescanned(msg) {
+		r.log.Debug("era event already resent on start, drop the rescanned one", "source", msg.Source, "dest", msg.Destination, "reason", msg.Reason)
+		return nil
+	}
+
+	r.lock.RLock()
+	q := r.registry[msg.Destination]
+	r.lock.RUnlock()
+
+	if q == nil {
+		return fmt.Errorf("%w, unknown destination symbol: %s", ErrNoHandler, msg.Destination)
+	}
+	if err := r.interceptors.preSend(msg); err != nil {
+		return err
+	}
+
+	var journalId uint64
+	if r.journal != nil {
+		seq, ok, err := r.journal.Append(msg)
+		if err != nil {
+			return fmt.Errorf("journal message failed, dest: %s, reason: %s, err: %s", msg.Destination, msg.Reason, err)
+		}
+		if ok {
+			journalId = seq
+		}
+	}
+
+	err := q.push(msg, journalId)
+	if err != nil && journalId != 0 {
+		// not dispatched, the sender gets the error instead
+		q.ack(journalId)
+	}
+	return err
+}
+
+// EraStepDone tells the relay that the work of step in the era of pool landed on chain, e.g.
+// the bond report of EraStepEraUpdated once stafihub took it. For chains implementing
+// ChainEraSteps the event of the step is sent again to the chain on every start until then.
+// It is the same as sending an EraStepDone message, whose destination is not used.
+func (r *Router) EraStepDone(source RSymbol, denom, pool string, era uint32, step EraStep) error {
+	return r.Send(NewMessage(source, source, EraStepDone{Denom: denom, Pool: pool, Era: era, Step: step}))
+}
+
+// eraStepDone records done with the era progress, it is ignored when the progress is not enabled
+func (r *Router) eraStepDone(source RSymbol, done EraStepDone) error {
+	if r.eraProgress == nil {
+		r.log.Trace("era progress not enabled, ignore era step done", "source", source, "pool", done.Pool, "era", done.Era, "step", done.Step)
+		return nil
+	}
+	return r.eraProgress.stepDone(source, done)
+}
+
+// EraProgress returns the era progress recorded by the relay, nil if it is not enabled. Chains
+// can resume the era of a pool from its record instead of deriving it again.
+func (r *Router) EraProgress() *EraProgress {
+	return r.eraProgress
+}
 
-	if msg.Reason != ReasonNewEra {
-		r.log.Trace("Routing message", "source", msg.Source, "dest", msg.Destination, "Reason", msg.Reason)
+// admit rejects messages sent after StopMsgHandler and messages not matching their reason
+func (r *Router) admit(msg *Message) error {
+	select {
+	case <-r.stop:
+		return fmt.Errorf("%w, drop message, dest: %s, reason: %s", ErrRouterStopped, msg.Destination, msg.Reason)
+	default:
 	}
+	err := msg.Validate()
+	if errors.Is(err, ErrUnregisteredReason) {
+		if _, warned := r.unregistered.LoadOrStore(msg.Reason, struct{}{}); !warned {
+			r.log.Warn("routing messages of a reason without registered payload, register it with core.RegisterPayload",
+				"reason", msg.Reason, "source", msg.Source, "content", fmt.Sprintf("%T", msg.Content))
+		}
+		return nil
+	}
+	return err
+}
 
-	h := r.registry[msg.Destination]
-	if h == nil {
-		return fmt.Errorf("unknown destination symbol: %s", msg.Destination)
+// replayJournal dispatches the messages journaled but not handled before the last shutdown
+// and returns the ones dispatched
+func (r *Router) replayJournal() []*Message {
+	if r.journal == nil {
+		return nil
 	}
+	var replayed []*Message
+	for _, jm := range r.journal.pendingMsgs() {
+		r.lock.RLock()
+		q := r.registry[jm.msg.Destination]
+		r.lock.RUnlock()
+		if q == nil {
+			r.log.Warn("no handler for journaled message, keep it for next start", "seq", jm.seq, "dest", jm.msg.Destination, "reason", jm.msg.Reason)
+			continue
+		}
 
-	go h.HandleMessage(msg)
-	return nil
+		r.log.Info("replay journaled message", "seq", jm.seq, "source", jm.msg.Source, "dest", jm.msg.Destination, "reason", jm.msg.Reason)
+		if err := q.push(jm.msg, jm.seq); err != nil {
+			r.log.Error("replay journaled message failed", "seq", jm.seq, "err", err)
+			continue
+		}
+		replayed = append(replayed, jm.msg)
+	}
+	return replayed
 }
 
 // Listen registers a Writer with a ChainId which Router.Send can then use to propagate messages
@@ -54,9 +219,70 @@ func (r *Router) Listen(symbol RSymbol, w Handler) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 	r.log.Debug("Registering new chain in router", "symbol", symbol)
-	r.registry[symbol] = w
+	q := newMsgQueue(symbol, w, r.queueCfg, r.journal, r.interceptors, r.log)
+	if old, exist := r.registry[symbol]; exist {
+		// a restarted chain takes over the messages its previous handler did not get to
+		old.close()
+		for _, m := range old.takePending() {
+			if err := q.push(m.msg, m.journalId); err != nil {
+				r.log.Warn("move pending message to new handler failed", "dest", symbol, "reason", m.msg.Reason, "err", err)
+			}
+		}
+	}
+	r.registry[symbol] = q
+}
+
+// QueueLen returns the number of messages waiting to be handled by the destination
+func (r *Router) QueueLen(symbol RSymbol) int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if q, exist := r.registry[symbol]; exist {
+		return q.Len()
+	}
+	return 0
 }
 
-func (r *Router) StopMsgHandler() {
-	close(r.stop)
+// HasHandler reports whether a handler listens for messages to symbol
+func (r *Router) HasHandler(symbol RSymbol) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	_, exist := r.registry[symbol]
+	return exist
+}
+
+// StopMsgHandler stops accepting new messages and waits up to the drain timeout for
+// queued and in-flight messages to be handled, i.e. for HandleMessage to return on them or
+// for an AckHandler to call done. It returns the messages that were abandoned.
+func (r *Router) StopMsgHandler() []*Message {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+
+	r.lock.RLock()
+	queues := make([]*msgQueue, 0, len(r.registry))
+	for _, q := range r.registry {
+		queues = append(queues, q)
+	}
+	r.lock.RUnlock()
+
+	deadline := time.Now().Add(r.drainTimeout)
+	results := make(chan []*Message, len(queues))
+	for _, q := range queues {
+		go func(q *msgQueue) {
+			results <- q.drain(deadline)
+		}(q)
+	}
+
+	abandoned := make([]*Message, 0)
+	for range queues {
+		abandoned = append(abandoned, <-results...)
+	}
+
+	// abandoned messages stay unacknowledged and are replayed on the next start
+	if r.journal != nil {
+		if err := r.journal.Close(); err != nil {
+			r.log.Error("close journal failed", "err", err)
+		}
+	}
+	return abandoned
 }
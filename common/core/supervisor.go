@@ -0,0 +1,394 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = 5 * time.Minute
+	DefaultMaxRestarts    = 10
+
+	// errors a chain instance can send without blocking once it is no longer forwarded
+	chainErrBuffer = 8
+)
+
+var (
+	ErrRestartsExhausted = errors.New("chain restarts exhausted")
+	ErrSupervisorStopped = errors.New("supervisor stopped")
+)
+
+// ChainError is sent on sysErr to tell which chain failed and whether restarting it can
+// recover, untyped errors on sysErr shut the relay down
+type ChainError struct {
+	Chain RSymbol
+	Fatal bool
+	Err   error
+}
+
+func NewFatalError(chain RSymbol, err error) *ChainError {
+	return &ChainError{Chain: chain, Fatal: true, Err: err}
+}
+
+func NewRecoverableError(chain RSymbol, err error) *ChainError {
+	return &ChainError{Chain: chain, Err: err}
+}
+
+func (e *ChainError) Error() string {
+	kind := "recoverable"
+	if e.Fatal {
+		kind = "fatal"
+	}
+	return fmt.Sprintf("%s error on chain %s: %s", kind, e.Chain, e.Err)
+}
+
+func (e *ChainError) Unwrap() error {
+	return e.Err
+}
+
+// IsFatal reports whether err must shut the relay down
+func IsFatal(err error) bool {
+	var chainErr *ChainError
+	if errors.As(err, &chainErr) {
+		return chainErr.Fatal
+	}
+	return true
+}
+
+// SupervisorConfig bounds how supervised chains are restarted, zero fields use the defaults
+type SupervisorConfig struct {
+	InitialBackoff time.Duration // wait before the first restart, doubled on every failed attempt
+	MaxBackoff     time.Duration // cap of the wait, a chain running this long is considered recovered
+	MaxRestarts    int           // consecutive restarts before the failure becomes fatal
+}
+
+func DefaultSupervisorConfig() SupervisorConfig {
+	return SupervisorConfig{
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+		MaxRestarts:    DefaultMaxRestarts,
+	}
+}
+
+func (c SupervisorConfig) withDefaults() SupervisorConfig {
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = DefaultInitialBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		c.MaxBackoff = c.InitialBackoff
+	}
+	if c.MaxRestarts <= 0 {
+		c.MaxRestarts = DefaultMaxRestarts
+	}
+	return c
+}
+
+// backoff returns the wait before restart attempt n, counted from 0
+func (c SupervisorConfig) backoff(n int) time.Duration {
+	delay := c.InitialBackoff
+	for i := 0; i < n && delay < c.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.MaxBackoff {
+		delay = c.MaxBackoff
+	}
+	return delay
+}
+
+// WithSupervisorConfig sets how supervised chains are restarted
+func WithSupervisorConfig(cfg SupervisorConfig) CoreOption {
+	return func(c *Core) {
+		c.supervisorCfg = cfg.withDefaults()
+	}
+}
+
+// ChainFactory builds and initializes a new instance of a chain, which must report its errors on sysErr
+type ChainFactory func(sysErr chan<- error) (Chain, error)
+
+type supervisedChain struct {
+	symbol     RSymbol
+	newChain   ChainFactory
+	instance   uint64 // id of the running instance, errors of other instances are ignored
+	release    func() // stops forwarding the errors of the running instance
+	failures   int    // consecutive restarts
+	startedAt  time.Time
+	restarting bool
+	// a config change arrived during a restart, the new instance may be built from the old config
+	reloadPending bool
+}
+
+type chainFailure struct {
+	sc       *supervisedChain
+	instance uint64
+	err      error
+}
+
+// restartRequest asks the supervisor to restart a running chain
+type restartRequest struct {
+	symbol RSymbol
+	reason error
+}
+
+type restartResult struct {
+	sc       *supervisedChain
+	chain    Chain
+	instance uint64
+	release  func()
+	failures int
+	err      error
+}
+
+// AddSupervisedChain builds a chain with newChain and registers it like AddChain. Errors the
+// chain sends are recoverable unless they are a fatal ChainError, the supervisor then stops
+// the chain and replaces it with a new instance from newChain.
+func (c *Core) AddSupervisedChain(newChain ChainFactory) error {
+	sc := &supervisedChain{newChain: newChain}
+	sysErr, instance, release := c.chainSysErr(sc)
+	chain, err := newChain(sysErr)
+	if err != nil {
+		release()
+		return err
+	}
+	sc.symbol = chain.RSymbol()
+	sc.instance = instance
+	sc.release = release
+	c.supervised[sc.symbol] = sc
+	c.AddChain(chain)
+	return nil
+}
+
+// chainSysErr returns the error channel and id of a new instance of a supervised chain, and
+// the release func to call once the instance is stopped. Errors are forwarded to the
+// supervisor until release is called or the core stops. The channel is not closed as the
+// goroutines of a stopped instance may still send on it, it is buffered so they do not block.
+func (c *Core) chainSysErr(sc *supervisedChain) (chan<- error, uint64, func()) {
+	instance := c.instances.Add(1)
+	errs := make(chan error, chainErrBuffer)
+	released := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case err := <-errs:
+				select {
+				case c.failures <- chainFailure{sc: sc, instance: instance, err: err}:
+				case <-released:
+					return
+				case <-c.stop:
+					return
+				}
+			case <-released:
+				return
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return errs, instance, func() {
+		once.Do(func() { close(released) })
+	}
+}
+
+// startChains starts the registered chains in order and returns the ones started
+func (c *Core) startChains() ([]Chain, error) {
+	chains := c.chains()
+	started := make([]Chain, 0, len(chains))
+	for _, chain := range chains {
+		if err := chain.Start(); err != nil {
+			return started, fmt.Errorf("start %s chain failed: %w", chain.Name(), err)
+		}
+		if sc, ok := c.supervised[chain.RSymbol()]; ok {
+			sc.startedAt = time.Now()
+		}
+		started = append(started, chain)
+		c.log.Info(fmt.Sprintf("Started %s chain", chain.Name()))
+	}
+	return started, nil
+}
+
+// supervise blocks until a signal or a fatal error is received, restarting supervised
+// chains which report recoverable errors meanwhile
+func (c *Core) supervise() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	quit := make(chan struct{})
+	results := make(chan restartResult)
+	// shutdown waits until replaced instances are stopped, not for restarts in progress
+	// which may block, e.g. on an unreachable endpoint
+	var stopping sync.WaitGroup
+	defer func() {
+		close(quit)
+		stopping.Wait()
+	}()
+
+	restart := func(sc *supervisedChain, err error) bool {
+		if sc.restarting {
+			if errors.Is(err, ErrConfigChanged) {
+				sc.reloadPending = true
+			}
+			return true
+		}
+		// a restart applying a config change is no failure, it starts over the backoff
+		configChanged := errors.Is(err, ErrConfigChanged)
+		if configChanged || time.Since(sc.startedAt) >= c.supervisorCfg.MaxBackoff {
+			sc.failures = 0
+		}
+		if sc.failures >= c.supervisorCfg.MaxRestarts {
+			c.fatalError(fmt.Errorf("%w, chain: %s, attempts: %d, err: %s", ErrRestartsExhausted, sc.symbol, sc.failures, err))
+			return false
+		}
+		if !configChanged {
+			c.log.Warn("chain failed, restarting", "chain", sc.symbol, "attempt", sc.failures+1, "err", err)
+		}
+		sc.restarting = true
+		c.restarting.Add(1)
+		stopping.Add(1)
+		go func(old Chain, release func(), failures int) {
+			old.Stop()
+			release()
+			stopping.Done()
+			res := c.restartChain(quit, sc, failures)
+			if configChanged && res.err == nil {
+				// only the attempts which failed count
+				res.failures--
+			}
+			select {
+			case results <- res:
+			case <-quit:
+				if res.chain != nil {
+					res.chain.Stop()
+				}
+			}
+		}(c.chain(sc.symbol), sc.release, sc.failures)
+		return true
+	}
+
+	for {
+		select {
+		case err := <-c.sysErr:
+			var chainErr *ChainError
+			if !IsFatal(err) && errors.As(err, &chainErr) {
+				if sc, ok := c.supervised[chainErr.Chain]; ok {
+					if restart(sc, err) {
+						continue
+					}
+					return
+				}
+			}
+			c.fatalError(err)
+			return
+		case f := <-c.failures:
+			if f.instance != f.sc.instance {
+				c.log.Debug("ignore error of replaced chain", "chain", f.sc.symbol, "err", f.err)
+				continue
+			}
+			// untyped errors of a supervised chain are recoverable
+			var chainErr *ChainError
+			if errors.As(f.err, &chainErr) && chainErr.Fatal {
+				c.fatalError(f.err)
+				return
+			}
+			if !restart(f.sc, f.err) {
+				return
+			}
+		case req := <-c.restarts:
+			if sc, ok := c.supervised[req.symbol]; ok {
+				if !restart(sc, req.reason) {
+					return
+				}
+			}
+		case res := <-results:
+			c.restarting.Add(-1)
+			if res.err != nil {
+				// the registered instance is stopped, restarting stays set so shutdown skips it
+				c.fatalError(res.err)
+				return
+			}
+			res.sc.restarting = false
+			res.sc.instance = res.instance
+			res.sc.release = res.release
+			res.sc.failures = res.failures
+			res.sc.startedAt = time.Now()
+			c.replaceChain(res.chain)
+			c.log.Info("chain restarted", "chain", res.sc.symbol, "restarts", res.failures)
+			if res.sc.reloadPending {
+				res.sc.reloadPending = false
+				if !restart(res.sc, ErrConfigChanged) {
+					return
+				}
+			}
+		case sig := <-sigc:
+			c.log.Warn("Interrupt received, shutting down now. signal:", sig.String())
+			return
+		}
+	}
+}
+
+// requestRestart asks the supervisor to restart the supervised chain of symbol, it blocks
+// until the supervisor takes the request
+func (c *Core) requestRestart(symbol RSymbol, reason error) error {
+	select {
+	case c.restarts <- restartRequest{symbol: symbol, reason: reason}:
+		return nil
+	case <-c.stop:
+		return ErrSupervisorStopped
+	}
+}
+
+func (c *Core) fatalError(err error) {
+	if c.metrics != nil {
+		c.metrics.fatal.Inc()
+	}
+	c.log.Error("FATAL ERROR. Shutting down.", "err", err)
+}
+
+// restartChain starts a new instance of sc after the backoff of attempt failures,
+// retrying until it starts, quit is closed or MaxRestarts is reached
+func (c *Core) restartChain(quit <-chan struct{}, sc *supervisedChain, failures int) restartResult {
+	for {
+		delay := c.supervisorCfg.backoff(failures)
+		timer := time.NewTimer(delay)
+		select {
+		case <-quit:
+			timer.Stop()
+			return restartResult{sc: sc, err: ErrSupervisorStopped}
+		case <-timer.C:
+		}
+
+		failures++
+		if c.metrics != nil {
+			c.metrics.restarts.WithLabelValues(string(sc.symbol)).Inc()
+		}
+		sysErr, instance, release := c.chainSysErr(sc)
+		chain, err := sc.newChain(sysErr)
+		if err == nil {
+			chain.SetRouter(c.route)
+			if err = chain.Start(); err != nil {
+				chain.Stop()
+			}
+		}
+		if err == nil {
+			return restartResult{sc: sc, chain: chain, instance: instance, release: release, failures: failures}
+		}
+		release()
+
+		c.log.Warn("restart chain failed", "chain", sc.symbol, "attempt", failures, "err", err)
+		if failures >= c.supervisorCfg.MaxRestarts {
+			return restartResult{sc: sc, err: fmt.Errorf("%w, chain: %s, attempts: %d, err: %s", ErrRestartsExhausted, sc.symbol, failures, err)}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+// chainBuilds builds the instances of a supervised testChain, failing the builds and
+// starts listed by their number counted from 1
+type chainBuilds struct {
+	lock      sync.Mutex
+	symbol    RSymbol
+	failBuild map[int]bool
+	failStart map[int]bool
+	sysErrs   []chan<- error
+}
+
+func (b *chainBuilds) newChain(sysErr chan<- error) (Chain, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.sysErrs = append(b.sysErrs, sysErr)
+	n := len(b.sysErrs)
+	if b.failBuild[n] {
+		return nil, errors.New("endpoint unreachable")
+	}
+	chain := &testChain{symbol: b.symbol}
+	if b.failStart[n] {
+		chain.startErr = errors.New("start failed")
+	}
+	return chain, nil
+}
+
+func (b *chainBuilds) count() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.sysErrs)
+}
+
+// fail sends err on the error channel of the latest instance
+func (b *chainBuilds) fail(err error) {
+	b.lock.Lock()
+	sysErr := b.sysErrs[len(b.sysErrs)-1]
+	b.lock.Unlock()
+	sysErr <- err
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	cfg := SupervisorConfig{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}.withDefaults()
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 0, want: time.Second},
+		{attempt: 1, want: 2 * time.Second},
+		{attempt: 2, want: 4 * time.Second},
+		{attempt: 3, want: 5 * time.Second},
+		{attempt: 30, want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := cfg.backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff of attempt %d is %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+	if cfg.MaxRestarts != DefaultMaxRestarts {
+		t.Errorf("max restarts %d, want default %d", cfg.MaxRestarts, DefaultMaxRestarts)
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	tests := []struct {
+		name       string
+		builds     *chainBuilds
+		fail       error // sent by the first instance
+		wantBuilds int
+		wantFatal  bool
+	}{
+		{
+			name:       "recoverable error restarts the chain",
+			builds:     &chainBuilds{},
+			fail:       NewRecoverableError("uatom", errors.New("rpc gone")),
+			wantBuilds: 2,
+		},
+		{
+			name:       "untyped error of a supervised chain is recoverable",
+			builds:     &chainBuilds{},
+			fail:       errors.New("rpc gone"),
+			wantBuilds: 2,
+		},
+		{
+			name:       "failed builds and starts are retried with backoff",
+			builds:     &chainBuilds{failBuild: map[int]bool{2: true}, failStart: map[int]bool{3: true}},
+			fail:       errors.New("rpc gone"),
+			wantBuilds: 4,
+		},
+		{
+			name:       "fatal error stops the relay",
+			builds:     &chainBuilds{},
+			fail:       NewFatalError("uatom", errors.New("keystore gone")),
+			wantBuilds: 1,
+			wantFatal:  true,
+		},
+		{
+			name:       "restarts exhausted",
+			builds:     &chainBuilds{failBuild: map[int]bool{2: true, 3: true, 4: true}},
+			fail:       errors.New("rpc gone"),
+			wantBuilds: 4,
+			wantFatal:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sysErr := make(chan error)
+			metrics := NewMetrics()
+			c := NewCore(log.NewLog(), sysErr, WithMetrics(metrics), WithSupervisorConfig(SupervisorConfig{
+				InitialBackoff: time.Millisecond,
+				MaxBackoff:     time.Minute,
+				MaxRestarts:    3,
+			}))
+			tt.builds.symbol = "uatom"
+			if err := c.AddSupervisedChain(tt.builds.newChain); err != nil {
+				t.Fatal(err)
+			}
+			stopped := make(chan struct{})
+			go func() {
+				c.Start()
+				close(stopped)
+			}()
+			waitFor(t, func() bool { return c.Ready() == nil })
+
+			tt.builds.fail(tt.fail)
+			if tt.wantFatal {
+				select {
+				case <-stopped:
+				case <-time.After(2 * time.Second):
+					t.Fatal("relay still running")
+				}
+			} else {
+				waitFor(t, func() bool { return tt.builds.count() == tt.wantBuilds && c.Ready() == nil })
+				// an untyped error on the relay error channel is fatal
+				sysErr <- errors.New("stop")
+				<-stopped
+			}
+
+			if got := tt.builds.count(); got != tt.wantBuilds {
+				t.Fatalf("built %d instances, want %d", got, tt.wantBuilds)
+			}
+			wantRestarts := float64(tt.wantBuilds - 1)
+			if got := testutil.ToFloat64(metrics.restarts.WithLabelValues("uatom")); got != wantRestarts {
+				t.Fatalf("%v restarts, want %v", got, wantRestarts)
+			}
+		})
+	}
+}
+
+func TestSupervisorStopped(t *testing.T) {
+	c := NewCore(log.NewLog(), nil)
+	builds := &chainBuilds{symbol: "uatom"}
+	quit := make(chan struct{})
+	close(quit)
+	res := c.restartChain(quit, &supervisedChain{symbol: "uatom", newChain: builds.newChain}, 0)
+	if !errors.Is(res.err, ErrSupervisorStopped) || builds.count() != 0 {
+		t.Fatalf("err %v after %d builds, want %v", res.err, builds.count(), ErrSupervisorStopped)
+	}
+
+	close(c.stop)
+	if err := c.requestRestart("uatom", ErrConfigChanged); !errors.Is(err, ErrSupervisorStopped) {
+		t.Fatalf("err %v, want %v", err, ErrSupervisorStopped)
+	}
+}
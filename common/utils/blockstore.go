@@ -4,16 +4,40 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"math/big"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
 )
 
 const PathPostfix = ".chainbridge/blockstore"
 
+// record keys of the Blockstore
+const (
+	BlockKey     = "block"
+	SignatureKey = "signature"
+)
+
+const (
+	// header line of the blockstore files, followed by the crc32 of the json records
+	blockstoreHeader = "blockstore v2 crc32="
+	// header of the files holding a single value, block or signature, before the records
+	blockstoreV1Header = "blockstore v1 crc32="
+	backupSuffix       = ".bak"
+	tmpSuffix          = ".tmp"
+)
+
+var ErrBlockstoreCorrupted = errors.New("blockstore corrupted")
+
 type Blockstorer interface {
 	StoreBlock(*big.Int) error
 	StoreSignature(string) error
@@ -23,17 +47,28 @@ var _ Blockstorer = &EmptyStore{}
 var _ Blockstorer = &Blockstore{}
 
 // Dummy store for testing only
+//
+// Deprecated: use NewStateBlockstore on a NewMemStore, which keeps what is stored.
 type EmptyStore struct{}
 
 func (s *EmptyStore) StoreBlock(_ *big.Int) error   { return nil }
 func (s *EmptyStore) StoreSignature(_ string) error { return nil }
 
-// Blockstore implements Blockstorer.
+// Blockstore implements Blockstorer. It keeps named records, the block cursor and the last
+// signature among them, in one file per chain/relayer pair.
 type Blockstore struct {
 	path     string // Path excluding filename
 	fullPath string
 	chain    uint8
 	relayer  string
+
+	lock    sync.Mutex
+	records map[string]string // nil until loaded
+}
+
+// blockstoreFile is the content of the blockstore file after its header
+type blockstoreFile struct {
+	Records map[string]string `json:"records"`
 }
 
 func NewBlockstore(path string, chain uint8, relayer string) (*Blockstore, error) {
@@ -56,87 +91,272 @@ func NewBlockstore(path string, chain uint8, relayer string) (*Blockstore, error
 
 // StoreBlock writes the block number to disk.
 func (b *Blockstore) StoreBlock(block *big.Int) error {
-	// Create dir if it does not exist
-	if _, err := os.Stat(b.path); os.IsNotExist(err) {
-		errr := os.MkdirAll(b.path, os.ModePerm)
-		if errr != nil {
-			return errr
-		}
-	}
+	return b.Put(BlockKey, block.String())
+}
+
+// StoreSignature writes the signature to disk.
+func (b *Blockstore) StoreSignature(sig string) error {
+	return b.Put(SignatureKey, sig)
+}
 
-	// Write bytes to file
-	data := []byte(block.String())
-	err := ioutil.WriteFile(b.fullPath, data, 0600)
+// TryLoadLatestSignature will attempt to load the latest signature for the chain/relayer pair, returning "" if not found.
+func (b *Blockstore) TryLoadLatestSignature() (string, error) {
+	sig, _, err := b.Get(SignatureKey)
+	return sig, err
+}
+
+// TryLoadLatestBlock will attempt to load the latest block for the chain/relayer pair, returning 0 if not found.
+// Passing an empty string for path will cause it to use the home directory.
+func (b *Blockstore) TryLoadLatestBlock() (*big.Int, error) {
+	dat, found, err := b.Get(BlockKey)
 	if err != nil {
+		return nil, err
+	}
+	if !found || len(dat) == 0 {
+		return big.NewInt(0), nil
+	}
+
+	block, ok := big.NewInt(0).SetString(dat, 10)
+	if !ok {
+		return nil, fmt.Errorf("blockstore: %s parse to number err", dat)
+	}
+	return block, nil
+}
+
+// Get returns the record of key, found is false if it was never stored
+func (b *Blockstore) Get(key string) (value string, found bool, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := b.loadRecords(); err != nil {
+		return "", false, err
+	}
+	value, found = b.records[key]
+	return value, found, nil
+}
+
+// Put stores value as the record of key, the other records are kept
+func (b *Blockstore) Put(key, value string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := b.loadRecords(); err != nil {
+		return err
+	}
+	records := b.copyRecords()
+	records[key] = value
+	if err := b.store(records); err != nil {
 		return err
 	}
+	b.records = records
 	return nil
 }
 
-// StoreBlock writes the signature  to disk.
-func (b *Blockstore) StoreSignature(sig string) error {
-	// Create dir if it does not exist
-	if _, err := os.Stat(b.path); os.IsNotExist(err) {
-		errr := os.MkdirAll(b.path, os.ModePerm)
-		if errr != nil {
-			return errr
-		}
+// Delete removes the record of key
+func (b *Blockstore) Delete(key string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := b.loadRecords(); err != nil {
+		return err
+	}
+	if _, exist := b.records[key]; !exist {
+		return nil
+	}
+	records := b.copyRecords()
+	delete(records, key)
+	if err := b.store(records); err != nil {
+		return err
 	}
+	b.records = records
+	return nil
+}
+
+func (b *Blockstore) copyRecords() map[string]string {
+	records := make(map[string]string, len(b.records)+1)
+	for k, v := range b.records {
+		records[k] = v
+	}
+	return records
+}
 
-	// Write bytes to file
-	data := []byte(sig)
-	err := ioutil.WriteFile(b.fullPath, data, 0600)
+// loadRecords reads the records on first use. A file of the single value format is
+// migrated: its value becomes the block record if it is a number, the signature record
+// otherwise, and it is rewritten as records right away, the old file kept as the backup.
+// The caller holds the lock.
+func (b *Blockstore) loadRecords() error {
+	if b.records != nil {
+		return nil
+	}
+	records, legacy, err := b.load()
 	if err != nil {
 		return err
 	}
+	if legacy {
+		if err := b.store(records); err != nil {
+			return fmt.Errorf("blockstore: migrate %s: %w", b.fullPath, err)
+		}
+		log.NewLog("module", "blockstore").Info("blockstore migrated to records", "file", b.fullPath, "records", records)
+	}
+	b.records = records
 	return nil
 }
 
-// TryLoadLatestBlock will attempt to load the latest block for the chain/relayer pair, returning 0 if not found.
-// Passing an empty string for path will cause it to use the home directory.
-func (b *Blockstore) TryLoadLatestSignature() (string, error) {
-	// If it exists, load and return
-	exists, err := fileExists(b.fullPath)
+// store replaces the file with records without ever leaving it half written: they are
+// written to a temp file which is synced then renamed over the file, the last valid file is
+// kept as a backup first.
+func (b *Blockstore) store(records map[string]string) error {
+	data, err := encodeBlockstoreFile(records)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if exists {
-		dat, err := ioutil.ReadFile(b.fullPath)
-		if err != nil {
-			return "", err
+	if err := os.MkdirAll(b.path, os.ModePerm); err != nil {
+		return err
+	}
+
+	tmpPath := b.fullPath + tmpSuffix
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// a corrupted file must not replace a good backup
+	if _, _, err := readBlockstoreFile(b.fullPath); err == nil {
+		if err := os.Rename(b.fullPath, b.fullPath+backupSuffix); err != nil {
+			return err
 		}
+	}
+	if err := os.Rename(tmpPath, b.fullPath); err != nil {
+		return err
+	}
+	return syncDir(b.path)
+}
 
-		return string(dat), nil
+// load returns the records of the file, or of its backup if the file is missing or
+// corrupted, empty records if neither exists. legacy tells the records were read from the
+// single value format. A corrupted file without a valid backup is an ErrBlockstoreCorrupted
+// rather than a fresh start, so the relay never silently rescans.
+func (b *Blockstore) load() (records map[string]string, legacy bool, err error) {
+	records, legacy, err = readBlockstoreFile(b.fullPath)
+	if err == nil {
+		return records, legacy, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrBlockstoreCorrupted) {
+		return nil, false, err
+	}
+
+	backupPath := b.fullPath + backupSuffix
+	backup, backupLegacy, backupErr := readBlockstoreFile(backupPath)
+	switch {
+	case backupErr == nil:
+		log.NewLog("module", "blockstore").Warn("blockstore file unusable, use backup", "file", b.fullPath, "err", err)
+		return backup, backupLegacy, nil
+	case errors.Is(err, os.ErrNotExist) && errors.Is(backupErr, os.ErrNotExist):
+		return make(map[string]string), false, nil
+	case errors.Is(err, os.ErrNotExist):
+		return nil, false, fmt.Errorf("%s missing, backup: %w", b.fullPath, backupErr)
+	case errors.Is(backupErr, os.ErrNotExist):
+		return nil, false, fmt.Errorf("%w, remove it to start from the configured block", err)
+	default:
+		return nil, false, fmt.Errorf("%w, backup: %s", err, backupErr)
 	}
-	// Otherwise just return 0
-	return "", nil
 }
 
-// TryLoadLatestBlock will attempt to load the latest block for the chain/relayer pair, returning 0 if not found.
-// Passing an empty string for path will cause it to use the home directory.
-func (b *Blockstore) TryLoadLatestBlock() (*big.Int, error) {
-	// If it exists, load and return
-	exists, err := fileExists(b.fullPath)
+// encodeBlockstoreFile returns records as json after the header holding their checksum
+func encodeBlockstoreFile(records map[string]string) ([]byte, error) {
+	body, err := json.Marshal(blockstoreFile{Records: records})
 	if err != nil {
 		return nil, err
 	}
-	if exists {
-		dat, err := ioutil.ReadFile(b.fullPath)
+	return append([]byte(fmt.Sprintf("%s%08x\n", blockstoreHeader, crc32.ChecksumIEEE(body))), body...), nil
+}
+
+// readBlockstoreFile reads and verifies a blockstore file, legacy is true for the single
+// value format: with the v1 header, or the bare value written before any checksum. Bare
+// values are accepted unless empty, which is what a crash during their write left behind.
+func readBlockstoreFile(path string) (records map[string]string, legacy bool, err error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(dat) == 0 {
+		return nil, false, fmt.Errorf("%w: %s is empty", ErrBlockstoreCorrupted, path)
+	}
+
+	switch {
+	case bytes.HasPrefix(dat, []byte(blockstoreHeader)):
+		body, err := checkedBody(path, dat, blockstoreHeader)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		if len(dat) == 0 {
-			return big.NewInt(0), nil
+		file := blockstoreFile{}
+		if err := json.Unmarshal(body, &file); err != nil {
+			return nil, false, fmt.Errorf("%w: %s: %s", ErrBlockstoreCorrupted, path, err)
 		}
-
-		block, ok := big.NewInt(0).SetString(string(dat), 10)
-		if !ok {
-			return nil, fmt.Errorf("blockstore: %s parse to number err", string(dat))
+		if file.Records == nil {
+			file.Records = make(map[string]string)
 		}
-		return block, nil
+		return file.Records, false, nil
+	case bytes.HasPrefix(dat, []byte(blockstoreV1Header)):
+		value, err := checkedBody(path, dat, blockstoreV1Header)
+		if err != nil {
+			return nil, false, err
+		}
+		return legacyRecords(value), true, nil
+	case bytes.HasPrefix([]byte(blockstoreHeader), dat) || bytes.HasPrefix([]byte(blockstoreV1Header), dat):
+		return nil, false, fmt.Errorf("%w: %s is truncated", ErrBlockstoreCorrupted, path)
+	default:
+		return legacyRecords(dat), true, nil
+	}
+}
+
+// checkedBody returns what follows the header line of dat once verified against its checksum
+func checkedBody(path string, dat []byte, header string) ([]byte, error) {
+	line, body, ok := bytes.Cut(dat, []byte("\n"))
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is truncated", ErrBlockstoreCorrupted, path)
+	}
+	sum, err := strconv.ParseUint(string(line[len(header):]), 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s has a bad header", ErrBlockstoreCorrupted, path)
+	}
+	if crc32.ChecksumIEEE(body) != uint32(sum) {
+		return nil, fmt.Errorf("%w: %s checksum mismatch", ErrBlockstoreCorrupted, path)
+	}
+	return body, nil
+}
+
+// legacyRecords returns the records of a single value file, which held whichever of the
+// block and the signature was stored last
+func legacyRecords(value []byte) map[string]string {
+	records := make(map[string]string)
+	if len(value) == 0 {
+		return records
+	}
+	if _, ok := big.NewInt(0).SetString(string(value), 10); ok {
+		records[BlockKey] = string(value)
+	} else {
+		records[SignatureKey] = string(value)
+	}
+	return records
+}
+
+// syncDir makes the renames in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
-	// Otherwise just return 0
-	return big.NewInt(0), nil
+	defer d.Close()
+	return d.Sync()
 }
 
 func getFileName(chain uint8, relayer string) string {
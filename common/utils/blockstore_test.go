@@ -0,0 +1,206 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/big"
+	"os"
+	"testing"
+)
+
+func v1File(value string) string {
+	return fmt.Sprintf("%s%08x\n%s", blockstoreV1Header, crc32.ChecksumIEEE([]byte(value)), value)
+}
+
+func v2File(t *testing.T, records map[string]string) string {
+	t.Helper()
+	dat, err := encodeBlockstoreFile(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(dat)
+}
+
+// writeFile writes content to path, nil leaves the file missing
+func writeFile(t *testing.T, path string, content *string) {
+	t.Helper()
+	if content == nil {
+		return
+	}
+	if err := os.WriteFile(path, []byte(*content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func str(s string) *string {
+	return &s
+}
+
+func TestBlockstoreLoad(t *testing.T) {
+	good := v2File(t, map[string]string{BlockKey: "100", SignatureKey: "sig"})
+	tests := []struct {
+		name      string
+		file      *string
+		backup    *string
+		block     int64
+		signature string
+		corrupted bool
+	}{
+		{name: "fresh start"},
+		{name: "records", file: &good, block: 100, signature: "sig"},
+		{name: "bare block", file: str("42"), block: 42},
+		{name: "bare signature", file: str("0xabc"), signature: "0xabc"},
+		{name: "v1 block", file: str(v1File("7")), block: 7},
+		{name: "v1 signature", file: str(v1File("sig")), signature: "sig"},
+		{name: "checksum mismatch falls back to backup", file: str(good[:len(good)-2] + "x}"), backup: str(v1File("99")), block: 99},
+		{name: "truncated header falls back to backup", file: str("blockstore v2"), backup: &good, block: 100, signature: "sig"},
+		{name: "missing file uses backup", backup: &good, block: 100, signature: "sig"},
+		{name: "empty file without backup", file: str(""), corrupted: true},
+		{name: "corrupted file and backup", file: str(blockstoreHeader + "00000000\n{}"), backup: str(blockstoreV1Header + "00000000\n1"), corrupted: true},
+		{name: "missing file with corrupted backup", backup: str(""), corrupted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := NewBlockstore(t.TempDir(), 1, "relayer")
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, bs.fullPath, tt.file)
+			writeFile(t, bs.fullPath+backupSuffix, tt.backup)
+
+			block, err := bs.TryLoadLatestBlock()
+			if tt.corrupted {
+				if !errors.Is(err, ErrBlockstoreCorrupted) {
+					t.Fatalf("err %v, want %v", err, ErrBlockstoreCorrupted)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.Int64() != tt.block {
+				t.Errorf("block %s, want %d", block, tt.block)
+			}
+			signature, err := bs.TryLoadLatestSignature()
+			if err != nil || signature != tt.signature {
+				t.Errorf("signature %q, want %q, err %v", signature, tt.signature, err)
+			}
+		})
+	}
+}
+
+func TestBlockstoreMigratesLegacyFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		records map[string]string
+	}{
+		{name: "bare block", content: "42", records: map[string]string{BlockKey: "42"}},
+		{name: "v1 signature", content: v1File("sig"), records: map[string]string{SignatureKey: "sig"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := NewBlockstore(t.TempDir(), 1, "relayer")
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, bs.fullPath, &tt.content)
+			if _, _, err := bs.Get(BlockKey); err != nil {
+				t.Fatal(err)
+			}
+
+			records, legacy, err := readBlockstoreFile(bs.fullPath)
+			if err != nil || legacy {
+				t.Fatalf("migrated file: legacy %v, err %v", legacy, err)
+			}
+			if fmt.Sprint(records) != fmt.Sprint(tt.records) {
+				t.Errorf("records %v, want %v", records, tt.records)
+			}
+			backup, err := os.ReadFile(bs.fullPath + backupSuffix)
+			if err != nil || string(backup) != tt.content {
+				t.Errorf("backup %q, want the legacy file, err %v", backup, err)
+			}
+		})
+	}
+}
+
+func TestBlockstoreRecords(t *testing.T) {
+	dir := t.TempDir()
+	bs, err := NewBlockstore(dir, 1, "relayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{name: "store block", run: func() error { return bs.StoreBlock(big.NewInt(10)) }},
+		{name: "store signature", run: func() error { return bs.StoreSignature("sig") }},
+		{name: "put", run: func() error { return bs.Put("era", "12") }},
+		{name: "put again", run: func() error { return bs.Put("era", "13") }},
+		{name: "put other", run: func() error { return bs.Put("pool", "cosmos1pool") }},
+		{name: "delete", run: func() error { return bs.Delete("pool") }},
+		{name: "delete missing", run: func() error { return bs.Delete("missing") }},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+	}
+
+	// a new instance reads what the first one stored
+	reopened, err := NewBlockstore(dir, 1, "relayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]struct {
+		value string
+		found bool
+	}{
+		BlockKey:     {"10", true},
+		SignatureKey: {"sig", true},
+		"era":        {"13", true},
+		"pool":       {"", false},
+	}
+	for key, w := range want {
+		value, found, err := reopened.Get(key)
+		if err != nil || value != w.value || found != w.found {
+			t.Errorf("%s: %q found %v, want %q found %v, err %v", key, value, found, w.value, w.found, err)
+		}
+	}
+}
+
+func TestBlockstoreKeepsGoodBackup(t *testing.T) {
+	bs, err := NewBlockstore(t.TempDir(), 1, "relayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.StoreBlock(big.NewInt(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.StoreBlock(big.NewInt(2)); err != nil {
+		t.Fatal(err)
+	}
+	good, err := os.ReadFile(bs.fullPath + backupSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a corrupted file is not made the backup by the next store
+	writeFile(t, bs.fullPath, str("blockstore v2 crc"))
+	if err := bs.StoreBlock(big.NewInt(3)); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := os.ReadFile(bs.fullPath + backupSuffix)
+	if err != nil || !bytes.Equal(backup, good) {
+		t.Fatalf("backup %q, want %q, err %v", backup, good, err)
+	}
+	if block, err := bs.TryLoadLatestBlock(); err != nil || block.Int64() != 3 {
+		t.Fatalf("block %v, err %v", block, err)
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+const (
+	DefaultMaxHeightLag     = 10
+	DefaultMaxErrorRate     = 0.5
+	DefaultMaxProbeFailures = 3
+	DefaultProbeInterval    = 30 * time.Second
+
+	// weight of the last call in the latency and error rate averages
+	endpointEwmaWeight = 0.2
+	// latency assumed for endpoints without a successful call yet
+	unknownLatency = time.Second
+)
+
+// HeightFunc returns the latest block height of endpoint, the pool calls it to probe endpoints
+type HeightFunc func(ctx context.Context, endpoint string) (int64, error)
+
+// EndpointPoolConfig tells when an endpoint is ejected, zero fields use the defaults
+type EndpointPoolConfig struct {
+	MaxHeightLag     int64         // blocks behind the highest endpoint
+	MaxErrorRate     float64       // average error rate of the calls, between 0 and 1
+	MaxProbeFailures int           // consecutive failed probes
+	ProbeInterval    time.Duration // how often every endpoint is probed, ejected ones included
+	ProbeTimeout     time.Duration // DefaultRetryCallTimeout if zero
+}
+
+func (c EndpointPoolConfig) withDefaults() EndpointPoolConfig {
+	if c.MaxHeightLag <= 0 {
+		c.MaxHeightLag = DefaultMaxHeightLag
+	}
+	if c.MaxErrorRate <= 0 || c.MaxErrorRate > 1 {
+		c.MaxErrorRate = DefaultMaxErrorRate
+	}
+	if c.MaxProbeFailures <= 0 {
+		c.MaxProbeFailures = DefaultMaxProbeFailures
+	}
+	if c.ProbeInterval <= 0 {
+		c.ProbeInterval = DefaultProbeInterval
+	}
+	if c.ProbeTimeout <= 0 {
+		c.ProbeTimeout = DefaultRetryCallTimeout
+	}
+	return c
+}
+
+// EndpointStats is the health of an endpoint as seen by the pool
+type EndpointStats struct {
+	Endpoint  string
+	Latency   time.Duration // average of the successful calls and probes
+	ErrorRate float64       // average of the calls, 1 if every call failed
+	Height    int64         // latest height seen by a probe
+	Lag       int64         // blocks behind the highest endpoint
+	Failures  int           // consecutive failed probes
+	Ejected   bool
+	LastErr   string
+}
+
+// observeLatency adds the latency of a successful call to the average
+func (s *EndpointStats) observeLatency(latency time.Duration) {
+	if s.Latency == 0 {
+		s.Latency = latency
+	} else {
+		s.Latency = time.Duration(endpointEwmaWeight*float64(latency) + (1-endpointEwmaWeight)*float64(s.Latency))
+	}
+}
+
+// score orders endpoints, lower is healthier
+func (s *EndpointStats) score() float64 {
+	latency := s.Latency
+	if latency == 0 {
+		latency = unknownLatency
+	}
+	return float64(latency) * (1 + 4*s.ErrorRate)
+}
+
+// EndpointPool picks among the endpoints of a chain. It tracks the latency, error rate and
+// height lag of every endpoint, prefers the healthiest, ejects those failing repeatedly or
+// falling behind and readmits them once a probe finds them healthy again. The last endpoint
+// not ejected is never ejected. Calls report their result with Observe, RetryEndpoints does
+// it for them.
+type EndpointPool struct {
+	cfg    EndpointPoolConfig
+	height HeightFunc
+	log    log.Logger
+	lock   sync.RWMutex
+	stats  []*EndpointStats // in configured order
+}
+
+// NewEndpointPool returns a pool of endpoints probed with height, which may be nil to track
+// latency and errors only
+func NewEndpointPool(endpoints []string, height HeightFunc, cfg EndpointPoolConfig, logger log.Logger) (*EndpointPool, error) {
+	p := &EndpointPool{
+		cfg:    cfg.withDefaults(),
+		height: height,
+		log:    logger,
+	}
+	if err := p.SetEndpoints(endpoints); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetEndpoints replaces the endpoints of the pool, the stats of the endpoints kept are kept
+func (p *EndpointPool) SetEndpoints(endpoints []string) error {
+	if len(endpoints) == 0 {
+		return ErrNoEndpoint
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	current := make(map[string]*EndpointStats, len(p.stats))
+	for _, s := range p.stats {
+		current[s.Endpoint] = s
+	}
+	stats := make([]*EndpointStats, 0, len(endpoints))
+	seen := make(map[string]bool, len(endpoints))
+	for _, endpoint := range endpoints {
+		if seen[endpoint] {
+			return fmt.Errorf("duplicate endpoint %s", endpoint)
+		}
+		seen[endpoint] = true
+		if s, exist := current[endpoint]; exist {
+			stats = append(stats, s)
+		} else {
+			stats = append(stats, &EndpointStats{Endpoint: endpoint})
+		}
+	}
+	p.stats = stats
+	return nil
+}
+
+// Endpoints returns the endpoints not ejected, healthiest first. When every endpoint is
+// ejected it returns all of them, so callers always have one to try.
+func (p *EndpointPool) Endpoints() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	candidates := make([]*EndpointStats, 0, len(p.stats))
+	for _, s := range p.stats {
+		if !s.Ejected {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, p.stats...)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score() < candidates[j].score() })
+	endpoints := make([]string, len(candidates))
+	for i, s := range candidates {
+		endpoints[i] = s.Endpoint
+	}
+	return endpoints
+}
+
+// Best returns the healthiest endpoint
+func (p *EndpointPool) Best() string {
+	return p.Endpoints()[0]
+}
+
+// Stats returns the health of every endpoint in configured order
+func (p *EndpointPool) Stats() []EndpointStats {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	stats := make([]EndpointStats, len(p.stats))
+	for i, s := range p.stats {
+		stats[i] = *s
+	}
+	return stats
+}
+
+// Observe records the result of a call to endpoint, an endpoint whose error rate goes over
+// the limit is ejected
+func (p *EndpointPool) Observe(endpoint string, latency time.Duration, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s := p.find(endpoint)
+	if s == nil {
+		return
+	}
+	failed := 0.0
+	if err != nil {
+		failed = 1
+		s.LastErr = err.Error()
+	} else {
+		s.observeLatency(latency)
+	}
+	s.ErrorRate = endpointEwmaWeight*failed + (1-endpointEwmaWeight)*s.ErrorRate
+	if !s.Ejected && s.ErrorRate > p.cfg.MaxErrorRate {
+		p.eject(s, fmt.Sprintf("error rate %.2f over %.2f", s.ErrorRate, p.cfg.MaxErrorRate))
+	}
+}
+
+// ObserveHeight records the latest height of endpoint, e.g. seen by the chain, endpoints
+// lagging behind the highest one are ejected
+func (p *EndpointPool) ObserveHeight(endpoint string, height int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s := p.find(endpoint); s != nil && height > s.Height {
+		s.Height = height
+		p.updateLag()
+	}
+}
+
+// Probe queries the height of every endpoint and records its latency, ejects the ones
+// failing MaxProbeFailures probes in a row or lagging and readmits the ejected ones found
+// healthy
+func (p *EndpointPool) Probe(ctx context.Context) {
+	if p.height == nil {
+		return
+	}
+	stats := p.Stats()
+	type probe struct {
+		height  int64
+		latency time.Duration
+		err     error
+	}
+	probes := make([]probe, len(stats))
+	var wg sync.WaitGroup
+	for i := range stats {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := time.Now()
+			probes[i].height, probes[i].err = callWithTimeout(ctx, p.cfg.ProbeTimeout, stats[i].Endpoint, p.height)
+			probes[i].latency = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, res := range probes {
+		s := p.find(stats[i].Endpoint)
+		if s == nil {
+			continue
+		}
+		if res.err != nil {
+			s.LastErr = res.err.Error()
+			s.Failures++
+			if !s.Ejected && s.Failures >= p.cfg.MaxProbeFailures {
+				p.eject(s, fmt.Sprintf("%d probes failed, last: %s", s.Failures, res.err))
+			}
+			continue
+		}
+		s.Failures = 0
+		s.observeLatency(res.latency)
+		if res.height > s.Height {
+			s.Height = res.height
+		}
+	}
+	p.updateLag()
+	for i, res := range probes {
+		s := p.find(stats[i].Endpoint)
+		if s == nil || res.err != nil || !s.Ejected || s.Lag > p.cfg.MaxHeightLag {
+			continue
+		}
+		s.Ejected = false
+		s.ErrorRate = 0
+		p.log.Info("endpoint readmitted", "endpoint", s.Endpoint, "height", s.Height)
+	}
+}
+
+// Run probes the endpoints every probe interval until stop is closed
+func (p *EndpointPool) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		p.Probe(ctx)
+		cancel()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// find returns the stats of endpoint, the caller holds the lock
+func (p *EndpointPool) find(endpoint string) *EndpointStats {
+	for _, s := range p.stats {
+		if s.Endpoint == endpoint {
+			return s
+		}
+	}
+	return nil
+}
+
+// updateLag computes the lag of every endpoint and ejects the ones too far behind, the
+// caller holds the lock
+func (p *EndpointPool) updateLag() {
+	var highest int64
+	for _, s := range p.stats {
+		if s.Height > highest {
+			highest = s.Height
+		}
+	}
+	for _, s := range p.stats {
+		if s.Height == 0 {
+			continue
+		}
+		s.Lag = highest - s.Height
+		if !s.Ejected && s.Lag > p.cfg.MaxHeightLag {
+			p.eject(s, fmt.Sprintf("%d blocks behind", s.Lag))
+		}
+	}
+}
+
+// eject stops offering s unless it is the last endpoint not ejected, the caller holds the lock
+func (p *EndpointPool) eject(s *EndpointStats, reason string) {
+	for _, other := range p.stats {
+		if other != s && !other.Ejected {
+			s.Ejected = true
+			p.log.Warn("endpoint ejected", "endpoint", s.Endpoint, "reason", reason)
+			return
+		}
+	}
+	p.log.Warn("endpoint unhealthy, kept as the last endpoint not ejected", "endpoint", s.Endpoint, "reason", reason)
+}
+
+// RetryEndpoints is Retry over the endpoints of pool, healthiest first. The result of every
+// call is observed by the pool and the endpoints are ordered again after every round.
+func RetryEndpoints[T any](ctx context.Context, policy RetryPolicy, pool *EndpointPool, logger log.Logger, name string,
+	call func(ctx context.Context, endpoint string) (T, error)) (T, error) {
+	return retry(ctx, policy, pool.Endpoints, pool.Observe, logger, name, call)
+}
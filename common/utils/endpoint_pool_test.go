@@ -0,0 +1,224 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+// fakeHeights answers the probes with the height set for every endpoint, 0 fails the probe
+type fakeHeights struct {
+	lock    sync.Mutex
+	heights map[string]int64
+}
+
+func (f *fakeHeights) set(heights map[string]int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.heights = heights
+}
+
+func (f *fakeHeights) height(_ context.Context, endpoint string) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if h := f.heights[endpoint]; h > 0 {
+		return h, nil
+	}
+	return 0, errors.New("unreachable")
+}
+
+func newTestPool(t *testing.T, endpoints ...string) (*EndpointPool, *fakeHeights) {
+	t.Helper()
+	heights := &fakeHeights{}
+	pool, err := NewEndpointPool(endpoints, heights.height, EndpointPoolConfig{ProbeTimeout: time.Second}, log.NewLog("module", "endpoints"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool, heights
+}
+
+func TestEndpointPoolProbe(t *testing.T) {
+	tests := []struct {
+		name   string
+		probes []map[string]int64
+		want   []string
+	}{
+		{
+			name:   "healthy",
+			probes: []map[string]int64{{"a": 100, "b": 100}},
+			want:   []string{"a", "b"},
+		},
+		{
+			name:   "failures below the limit keep the endpoint",
+			probes: []map[string]int64{{"a": 100, "b": 100}, {"b": 101}, {"b": 102}},
+			want:   []string{"a", "b"},
+		},
+		{
+			name:   "consecutive failures eject",
+			probes: []map[string]int64{{"b": 100}, {"b": 101}, {"b": 102}},
+			want:   []string{"b"},
+		},
+		{
+			name:   "a success resets the failures",
+			probes: []map[string]int64{{"b": 100}, {"b": 101}, {"a": 102, "b": 102}, {"b": 103}, {"b": 104}},
+			want:   []string{"a", "b"},
+		},
+		{
+			name:   "lagging endpoint ejected",
+			probes: []map[string]int64{{"a": 100, "b": 100 + DefaultMaxHeightLag + 1}},
+			want:   []string{"b"},
+		},
+		{
+			name:   "ejected endpoint readmitted once caught up",
+			probes: []map[string]int64{{"a": 100, "b": 200}, {"a": 200, "b": 200}},
+			want:   []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, heights := newTestPool(t, "a", "b")
+			for _, probe := range tt.probes {
+				heights.set(probe)
+				pool.Probe(context.Background())
+			}
+			// probe latencies order the endpoints, only the set matters
+			got := pool.Endpoints()
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("endpoints %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndpointPoolLastEndpointNeverEjected(t *testing.T) {
+	pool, heights := newTestPool(t, "a", "b")
+	heights.set(map[string]int64{})
+	for i := 0; i < 2*DefaultMaxProbeFailures; i++ {
+		pool.Probe(context.Background())
+	}
+	ejected := 0
+	for _, s := range pool.Stats() {
+		if s.Ejected {
+			ejected++
+		}
+	}
+	if ejected != 1 {
+		t.Fatalf("%d endpoints ejected, want 1", ejected)
+	}
+	if got := pool.Endpoints(); len(got) != 1 {
+		t.Fatalf("endpoints %v, want the one not ejected", got)
+	}
+}
+
+func TestEndpointPoolObserve(t *testing.T) {
+	unreachable := errors.New("unreachable")
+	tests := []struct {
+		name     string
+		observe  func(pool *EndpointPool)
+		want     []string
+		ejectedA bool
+	}{
+		{
+			name: "faster first",
+			observe: func(pool *EndpointPool) {
+				pool.Observe("a", 300*time.Millisecond, nil)
+				pool.Observe("b", 100*time.Millisecond, nil)
+			},
+			want: []string{"b", "a"},
+		},
+		{
+			name: "failing after the healthy",
+			observe: func(pool *EndpointPool) {
+				pool.Observe("a", 100*time.Millisecond, nil)
+				pool.Observe("a", 0, unreachable)
+				pool.Observe("b", 150*time.Millisecond, nil)
+			},
+			want: []string{"b", "a"},
+		},
+		{
+			name: "error rate over the limit ejects",
+			observe: func(pool *EndpointPool) {
+				for i := 0; i < 4; i++ {
+					pool.Observe("a", 0, unreachable)
+				}
+			},
+			want:     []string{"b"},
+			ejectedA: true,
+		},
+		{
+			name: "unknown endpoint ignored",
+			observe: func(pool *EndpointPool) {
+				pool.Observe("c", 0, unreachable)
+			},
+			want: []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, _ := newTestPool(t, "a", "b")
+			tt.observe(pool)
+			if got := pool.Endpoints(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("endpoints %v, want %v", got, tt.want)
+			}
+			if ejected := pool.Stats()[0].Ejected; ejected != tt.ejectedA {
+				t.Fatalf("a ejected %v, want %v", ejected, tt.ejectedA)
+			}
+		})
+	}
+}
+
+func TestEndpointPoolSetEndpoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoints []string
+		wantErr   bool
+	}{
+		{name: "kept and added", endpoints: []string{"b", "c"}},
+		{name: "empty", endpoints: nil, wantErr: true},
+		{name: "duplicate", endpoints: []string{"c", "c"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, _ := newTestPool(t, "a", "b")
+			pool.Observe("b", 100*time.Millisecond, nil)
+			err := pool.SetEndpoints(tt.endpoints)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			stats := pool.Stats()
+			if len(stats) != 2 || stats[0].Endpoint != "b" || stats[0].Latency != 100*time.Millisecond || stats[1].Endpoint != "c" {
+				t.Fatalf("stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestRetryEndpoints(t *testing.T) {
+	pool, _ := newTestPool(t, "a", "b")
+	calls := &endpointCalls{errs: map[string]error{"a": errors.New("connection refused"), "b": Permanent(errors.New("pool not found"))}}
+	policy := RetryPolicy{Attempts: 2, InitialBackoff: time.Millisecond}
+	if _, err := RetryEndpoints(context.Background(), policy, pool, log.NewLog(), "query", calls.call); err == nil || err.Error() != "query: pool not found" {
+		t.Fatalf("err %v, want the permanent error of b", err)
+	}
+	// a permanent error is an answer, b is healthier than a now
+	stats := pool.Stats()
+	if stats[0].ErrorRate == 0 || stats[1].ErrorRate != 0 {
+		t.Fatalf("stats %+v, want errors on a only", stats)
+	}
+	if got := pool.Endpoints(); !reflect.DeepEqual(got, []string{"b", "a"}) {
+		t.Fatalf("endpoints %v, want b first", got)
+	}
+}
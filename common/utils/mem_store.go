@@ -0,0 +1,133 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package utils
+
+import (
+	"sort"
+	"sync"
+)
+
+var _ StateStore = &MemStore{}
+
+// MemStore is a StateStore in memory, for tests and dry runs
+type MemStore struct {
+	lock    sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *MemStore) View(fn func(tx StateTx) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return fn(&memTx{store: s})
+}
+
+// Update runs fn on copies of the buckets it writes, swapped in if fn succeeds
+func (s *MemStore) Update(fn func(tx StateTx) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tx := &memTx{store: s, writable: true, dirty: make(map[string]map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for name, bucket := range tx.dirty {
+		if bucket == nil {
+			delete(s.buckets, name)
+		} else {
+			s.buckets[name] = bucket
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
+
+type memTx struct {
+	store    *MemStore
+	writable bool
+	dirty    map[string]map[string][]byte // buckets written by the tx, nil if deleted
+}
+
+// read returns the bucket of name as seen by the tx
+func (t *memTx) read(name string) map[string][]byte {
+	if bucket, exist := t.dirty[name]; exist {
+		return bucket
+	}
+	return t.store.buckets[name]
+}
+
+// write returns the copy of the bucket of name owned by the tx
+func (t *memTx) write(name string) (map[string][]byte, error) {
+	if !t.writable {
+		return nil, ErrReadOnlyTx
+	}
+	if bucket := t.dirty[name]; bucket != nil {
+		return bucket, nil
+	}
+	bucket := make(map[string][]byte)
+	for k, v := range t.read(name) {
+		bucket[k] = v
+	}
+	t.dirty[name] = bucket
+	return bucket, nil
+}
+
+func (t *memTx) Bucket(name string) StateBucket {
+	return &memBucket{tx: t, name: name}
+}
+
+func (t *memTx) DeleteBucket(name string) error {
+	if !t.writable {
+		return ErrReadOnlyTx
+	}
+	t.dirty[name] = nil
+	return nil
+}
+
+type memBucket struct {
+	tx   *memTx
+	name string
+}
+
+func (b *memBucket) Get(key []byte) []byte {
+	return b.tx.read(b.name)[string(key)]
+}
+
+func (b *memBucket) Put(key, value []byte) error {
+	bucket, err := b.tx.write(b.name)
+	if err != nil {
+		return err
+	}
+	bucket[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (b *memBucket) Delete(key []byte) error {
+	bucket, err := b.tx.write(b.name)
+	if err != nil {
+		return err
+	}
+	delete(bucket, string(key))
+	return nil
+}
+
+func (b *memBucket) ForEach(fn func(key, value []byte) error) error {
+	bucket := b.tx.read(b.name)
+	keys := make([]string, 0, len(bucket))
+	for k := range bucket {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn([]byte(k), bucket[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
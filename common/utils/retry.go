@@ -0,0 +1,184 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+const (
+	DefaultRetryAttempts       = 5
+	DefaultRetryInitialBackoff = time.Second
+	DefaultRetryMaxBackoff     = 30 * time.Second
+	DefaultRetryCallTimeout    = 10 * time.Second
+)
+
+var (
+	ErrRetriesExhausted = errors.New("retries exhausted")
+	ErrCallTimeout      = errors.New("call timed out")
+	ErrNoEndpoint       = errors.New("no endpoint")
+)
+
+// RetryPolicy tells how a call is retried over a list of endpoints, zero fields use the defaults
+type RetryPolicy struct {
+	Attempts       int           // calls before giving up, over all endpoints
+	InitialBackoff time.Duration // wait once every endpoint failed, doubled after every round
+	MaxBackoff     time.Duration // cap of the wait
+	CallTimeout    time.Duration // a call running longer fails and the next endpoint is tried
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:       DefaultRetryAttempts,
+		InitialBackoff: DefaultRetryInitialBackoff,
+		MaxBackoff:     DefaultRetryMaxBackoff,
+		CallTimeout:    DefaultRetryCallTimeout,
+	}
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Attempts <= 0 {
+		p.Attempts = DefaultRetryAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultRetryInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultRetryMaxBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.CallTimeout <= 0 {
+		p.CallTimeout = DefaultRetryCallTimeout
+	}
+	return p
+}
+
+// backoff returns the wait after round n of endpoints, counted from 0
+func (p RetryPolicy) backoff(n int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 0; i < n && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// permanentError stops the retries of Retry
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying on any endpoint, e.g. a query for something
+// that does not exist
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// Retry calls call on endpoints in turn until it succeeds, failing over to the next endpoint
+// on every error and waiting the backoff of the policy once all of them failed. A call gets
+// ctx bounded by the call timeout, calls not honoring it are abandoned when it expires. The
+// endpoint which answered is logged with name. It gives up after the attempts of the policy,
+// when ctx is done or on an error wrapped with Permanent.
+func Retry[T any](ctx context.Context, policy RetryPolicy, endpoints []string, logger log.Logger, name string,
+	call func(ctx context.Context, endpoint string) (T, error)) (T, error) {
+	if len(endpoints) == 0 {
+		var zero T
+		return zero, fmt.Errorf("%s: %w", name, ErrNoEndpoint)
+	}
+	return retry(ctx, policy, func() []string { return endpoints }, nil, logger, name, call)
+}
+
+// retry is Retry over the endpoints returned by endpoints, asked again for every round. The
+// result of every call is passed to observe if not nil, errors wrapped with Permanent count
+// as answers.
+func retry[T any](ctx context.Context, policy RetryPolicy, endpoints func() []string, observe func(endpoint string, latency time.Duration, err error),
+	logger log.Logger, name string, call func(ctx context.Context, endpoint string) (T, error)) (T, error) {
+	var zero T
+	policy = policy.withDefaults()
+
+	var err error
+	round, next, rounds := endpoints(), 0, 0
+	for attempt := 0; attempt < policy.Attempts; attempt++ {
+		if next == len(round) {
+			timer := time.NewTimer(policy.backoff(rounds))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return zero, fmt.Errorf("%s: %w, last err: %s", name, ctx.Err(), err)
+			case <-timer.C:
+			}
+			round, next, rounds = endpoints(), 0, rounds+1
+		}
+
+		endpoint := round[next]
+		next++
+		start := time.Now()
+		var result T
+		result, err = callWithTimeout(ctx, policy.CallTimeout, endpoint, call)
+		var permanent *permanentError
+		isPermanent := errors.As(err, &permanent)
+		if observe != nil && ctx.Err() == nil {
+			if isPermanent {
+				observe(endpoint, time.Since(start), nil)
+			} else {
+				observe(endpoint, time.Since(start), err)
+			}
+		}
+		if err == nil {
+			logger.Info(name+" answered", "endpoint", endpoint, "attempt", attempt+1)
+			return result, nil
+		}
+		if isPermanent {
+			return zero, fmt.Errorf("%s: %w", name, permanent.err)
+		}
+		if ctx.Err() != nil {
+			return zero, fmt.Errorf("%s: %w, last err: %s", name, ctx.Err(), err)
+		}
+		logger.Warn(name+" failed", "endpoint", endpoint, "attempt", attempt+1, "err", err)
+	}
+	return zero, fmt.Errorf("%s: %w after %d attempts, last err: %s", name, ErrRetriesExhausted, policy.Attempts, err)
+}
+
+// callWithTimeout runs call in its own goroutine so a call ignoring ctx can not outlive the timeout
+func callWithTimeout[T any](ctx context.Context, timeout time.Duration, endpoint string,
+	call func(ctx context.Context, endpoint string) (T, error)) (T, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := call(ctx, endpoint)
+		done <- result{value: value, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.value, res.err
+	case <-ctx.Done():
+		var zero T
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return zero, fmt.Errorf("%w after %s", ErrCallTimeout, timeout)
+		}
+		return zero, ctx.Err()
+	}
+}
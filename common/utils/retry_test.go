@@ -0,0 +1,143 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+// endpointCalls answers the calls with the errors set per endpoint, recording the calls
+type endpointCalls struct {
+	lock   sync.Mutex
+	errs   map[string]error
+	block  map[string]bool // calls ignoring their ctx
+	called []string
+}
+
+func (c *endpointCalls) call(ctx context.Context, endpoint string) (string, error) {
+	c.lock.Lock()
+	c.called = append(c.called, endpoint)
+	err, block := c.errs[endpoint], c.block[endpoint]
+	c.lock.Unlock()
+	if block {
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "answer of " + endpoint, nil
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}.withDefaults()
+	tests := []struct {
+		round int
+		want  time.Duration
+	}{
+		{round: 0, want: time.Second},
+		{round: 1, want: 2 * time.Second},
+		{round: 2, want: 4 * time.Second},
+		{round: 3, want: 5 * time.Second},
+		{round: 40, want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := p.backoff(tt.round); got != tt.want {
+			t.Errorf("backoff of round %d is %s, want %s", tt.round, got, tt.want)
+		}
+	}
+	if p.Attempts != DefaultRetryAttempts || p.CallTimeout != DefaultRetryCallTimeout {
+		t.Errorf("policy %+v, want the default attempts and call timeout", p)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	gone := errors.New("connection refused")
+	policy := RetryPolicy{Attempts: 4, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, CallTimeout: 50 * time.Millisecond}
+	tests := []struct {
+		name       string
+		endpoints  []string
+		calls      *endpointCalls
+		want       string
+		wantErr    error
+		wantCalled []string
+	}{
+		{
+			name:       "first endpoint answers",
+			endpoints:  []string{"a", "b"},
+			calls:      &endpointCalls{},
+			want:       "answer of a",
+			wantCalled: []string{"a"},
+		},
+		{
+			name:       "fails over to the next endpoint",
+			endpoints:  []string{"a", "b"},
+			calls:      &endpointCalls{errs: map[string]error{"a": gone}},
+			want:       "answer of b",
+			wantCalled: []string{"a", "b"},
+		},
+		{
+			name:       "call ignoring the timeout is abandoned",
+			endpoints:  []string{"a", "b"},
+			calls:      &endpointCalls{errs: map[string]error{"a": gone}, block: map[string]bool{"a": true}},
+			want:       "answer of b",
+			wantCalled: []string{"a", "b"},
+		},
+		{
+			name:       "rounds over the endpoints until the attempts are exhausted",
+			endpoints:  []string{"a", "b"},
+			calls:      &endpointCalls{errs: map[string]error{"a": gone, "b": gone}},
+			wantErr:    ErrRetriesExhausted,
+			wantCalled: []string{"a", "b", "a", "b"},
+		},
+		{
+			name:       "permanent error stops the retries",
+			endpoints:  []string{"a", "b"},
+			calls:      &endpointCalls{errs: map[string]error{"a": Permanent(gone)}},
+			wantErr:    gone,
+			wantCalled: []string{"a"},
+		},
+		{
+			name:    "no endpoint",
+			calls:   &endpointCalls{},
+			wantErr: ErrNoEndpoint,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Retry(context.Background(), policy, tt.endpoints, log.NewLog(), "query", tt.calls.call)
+			if !errors.Is(err, tt.wantErr) || tt.wantErr == nil && err != nil {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			tt.calls.lock.Lock()
+			defer tt.calls.lock.Unlock()
+			if !reflect.DeepEqual(tt.calls.called, tt.wantCalled) {
+				t.Fatalf("called %v, want %v", tt.calls.called, tt.wantCalled)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := &endpointCalls{errs: map[string]error{"a": errors.New("connection refused")}}
+	policy := RetryPolicy{Attempts: 10, InitialBackoff: time.Hour}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err := Retry(ctx, policy, []string{"a"}, log.NewLog(), "query", calls.call)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err %v, want %v", err, context.Canceled)
+	}
+}
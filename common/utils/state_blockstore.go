@@ -0,0 +1,129 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package utils
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+// BlockstoreBucketPrefix namespaces the buckets of the StateBlockstores in a StateStore
+const BlockstoreBucketPrefix = "blockstore/"
+
+var _ Blockstorer = &StateBlockstore{}
+
+// StateBlockstore is a Blockstore kept in a bucket of a StateStore, one per chain/relayer
+// pair. It has the records and load methods of Blockstore so chains can use either.
+type StateBlockstore struct {
+	store  StateStore
+	bucket string
+}
+
+// NewStateBlockstore returns the blockstore of the chain/relayer pair in store
+func NewStateBlockstore(store StateStore, chain uint8, relayer string) *StateBlockstore {
+	return &StateBlockstore{
+		store:  store,
+		bucket: BlockstoreBucketPrefix + fmt.Sprintf("%s-%d", relayer, chain),
+	}
+}
+
+// StoreBlock writes the block number to the store.
+func (b *StateBlockstore) StoreBlock(block *big.Int) error {
+	return b.Put(BlockKey, block.String())
+}
+
+// StoreSignature writes the signature to the store.
+func (b *StateBlockstore) StoreSignature(sig string) error {
+	return b.Put(SignatureKey, sig)
+}
+
+// TryLoadLatestSignature returns the latest signature, "" if not found.
+func (b *StateBlockstore) TryLoadLatestSignature() (string, error) {
+	sig, _, err := b.Get(SignatureKey)
+	return sig, err
+}
+
+// TryLoadLatestBlock returns the latest block, 0 if not found.
+func (b *StateBlockstore) TryLoadLatestBlock() (*big.Int, error) {
+	dat, found, err := b.Get(BlockKey)
+	if err != nil {
+		return nil, err
+	}
+	if !found || len(dat) == 0 {
+		return big.NewInt(0), nil
+	}
+
+	block, ok := big.NewInt(0).SetString(dat, 10)
+	if !ok {
+		return nil, fmt.Errorf("blockstore: %s parse to number err", dat)
+	}
+	return block, nil
+}
+
+// Get returns the record of key, found is false if it was never stored
+func (b *StateBlockstore) Get(key string) (value string, found bool, err error) {
+	err = b.store.View(func(tx StateTx) error {
+		if dat := tx.Bucket(b.bucket).Get([]byte(key)); dat != nil {
+			value, found = string(dat), true
+		}
+		return nil
+	})
+	return value, found, err
+}
+
+// Put stores value as the record of key
+func (b *StateBlockstore) Put(key, value string) error {
+	return b.store.Update(func(tx StateTx) error {
+		return tx.Bucket(b.bucket).Put([]byte(key), []byte(value))
+	})
+}
+
+// Delete removes the record of key
+func (b *StateBlockstore) Delete(key string) error {
+	return b.store.Update(func(tx StateTx) error {
+		return tx.Bucket(b.bucket).Delete([]byte(key))
+	})
+}
+
+// Import copies the records of the file Blockstore bs into b unless b already holds
+// records, so a relay moving to the state store keeps its cursor. It returns the number of
+// records copied.
+func (b *StateBlockstore) Import(bs *Blockstore) (int, error) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	if err := bs.loadRecords(); err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	err := b.store.Update(func(tx StateTx) error {
+		bucket := tx.Bucket(b.bucket)
+		empty := true
+		if err := bucket.ForEach(func(_, _ []byte) error {
+			empty = false
+			return nil
+		}); err != nil {
+			return err
+		}
+		if !empty {
+			return nil
+		}
+		for key, value := range bs.records {
+			if err := bucket.Put([]byte(key), []byte(value)); err != nil {
+				return err
+			}
+			imported++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if imported > 0 {
+		log.NewLog("module", "blockstore").Info("blockstore imported into the state store", "file", bs.fullPath, "bucket", b.bucket, "records", imported)
+	}
+	return imported, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package utils
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestStateBlockstore(t *testing.T) {
+	store := NewMemStore()
+	var bs Blockstorer = NewStateBlockstore(store, 1, "relayer")
+	if err := bs.StoreBlock(big.NewInt(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.StoreSignature("sig"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the chain/relayer pairs have their own buckets
+	other := NewStateBlockstore(store, 2, "relayer")
+	if block, err := other.TryLoadLatestBlock(); err != nil || block.Int64() != 0 {
+		t.Fatalf("block %v of another chain, err %v", block, err)
+	}
+
+	again := NewStateBlockstore(store, 1, "relayer")
+	if block, err := again.TryLoadLatestBlock(); err != nil || block.Int64() != 10 {
+		t.Fatalf("block %v, want 10, err %v", block, err)
+	}
+	if sig, err := again.TryLoadLatestSignature(); err != nil || sig != "sig" {
+		t.Fatalf("signature %q, want sig, err %v", sig, err)
+	}
+	if err := again.Put("era", "12"); err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Delete(SignatureKey); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{BlockKey + "=10", "era=12"}
+	if got := keys(t, store, BlockstoreBucketPrefix+"relayer-1"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records %v, want %v", got, want)
+	}
+
+	if err := again.Put(BlockKey, "ten"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := again.TryLoadLatestBlock(); err == nil {
+		t.Fatal("loaded a block which is no number")
+	}
+}
+
+func TestStateBlockstoreImport(t *testing.T) {
+	file, err := NewBlockstore(t.TempDir(), 1, "relayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.StoreBlock(big.NewInt(42)); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.StoreSignature("sig"); err != nil {
+		t.Fatal(err)
+	}
+
+	bs := NewStateBlockstore(NewMemStore(), 1, "relayer")
+	if n, err := bs.Import(file); err != nil || n != 2 {
+		t.Fatalf("imported %d records, want 2, err %v", n, err)
+	}
+	if block, err := bs.TryLoadLatestBlock(); err != nil || block.Int64() != 42 {
+		t.Fatalf("block %v, want 42, err %v", block, err)
+	}
+
+	// a store already holding records keeps them
+	if err := bs.StoreBlock(big.NewInt(50)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bs.Import(file); err != nil || n != 0 {
+		t.Fatalf("imported %d records, want none, err %v", n, err)
+	}
+	if block, err := bs.TryLoadLatestBlock(); err != nil || block.Int64() != 50 {
+		t.Fatalf("block %v, want 50, err %v", block, err)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	StateStoreFileName = "state.db"
+
+	// wait for the lock of a state store file held by another relay
+	stateStoreOpenTimeout = 5 * time.Second
+)
+
+var ErrReadOnlyTx = errors.New("write in a read-only transaction")
+
+// StateStore is a key-value store of relay state, namespaced in buckets. Reads and writes
+// happen in transactions: an Update is applied entirely or not at all.
+type StateStore interface {
+	// View runs fn in a read-only transaction
+	View(fn func(tx StateTx) error) error
+	// Update runs fn in a read-write transaction, committed if fn returns nil
+	Update(fn func(tx StateTx) error) error
+	Close() error
+}
+
+// StateTx is a transaction of a StateStore, valid until its function returns
+type StateTx interface {
+	// Bucket returns the bucket of name, created on first write. A bucket never written
+	// reads as empty.
+	Bucket(name string) StateBucket
+	// DeleteBucket removes the bucket of name and its keys
+	DeleteBucket(name string) error
+}
+
+// StateBucket is a namespace of keys in a StateTx. Values returned by Get and ForEach are
+// only valid in the transaction, copy them to keep them.
+type StateBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// ForEach calls fn on every key in key order, stopping at its first error
+	ForEach(fn func(key, value []byte) error) error
+}
+
+var _ StateStore = &BoltStore{}
+
+// BoltStore is the StateStore of a relay, kept in a bbolt file under the blockstore path
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+// OpenBoltStore opens the state store in dir, using the default blockstore path if dir is
+// empty. The file is locked until Close, a second relay on the same dir fails to open it.
+func OpenBoltStore(dir string) (*BoltStore, error) {
+	if dir == "" {
+		def, err := getDefaultPath()
+		if err != nil {
+			return nil, err
+		}
+		dir = def
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(filepath.Join(dir, StateStoreFileName), 0600, &bbolt.Options{Timeout: stateStoreOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) View(fn func(tx StateTx) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		return fn(boltTx{tx: tx})
+	})
+}
+
+func (s *BoltStore) Update(fn func(tx StateTx) error) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return fn(boltTx{tx: tx})
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+func (t boltTx) Bucket(name string) StateBucket {
+	return &boltBucket{tx: t.tx, name: []byte(name), bucket: t.tx.Bucket([]byte(name))}
+}
+
+func (t boltTx) DeleteBucket(name string) error {
+	if !t.tx.Writable() {
+		return ErrReadOnlyTx
+	}
+	err := t.tx.DeleteBucket([]byte(name))
+	if errors.Is(err, bbolt.ErrBucketNotFound) {
+		return nil
+	}
+	return err
+}
+
+// boltBucket creates its bbolt bucket on first write
+type boltBucket struct {
+	tx     *bbolt.Tx
+	name   []byte
+	bucket *bbolt.Bucket // nil until created
+}
+
+func (b *boltBucket) Get(key []byte) []byte {
+	if b.bucket == nil {
+		return nil
+	}
+	return b.bucket.Get(key)
+}
+
+func (b *boltBucket) Put(key, value []byte) error {
+	if !b.tx.Writable() {
+		return ErrReadOnlyTx
+	}
+	if b.bucket == nil {
+		bucket, err := b.tx.CreateBucketIfNotExists(b.name)
+		if err != nil {
+			return err
+		}
+		b.bucket = bucket
+	}
+	return b.bucket.Put(key, value)
+}
+
+func (b *boltBucket) Delete(key []byte) error {
+	if !b.tx.Writable() {
+		return ErrReadOnlyTx
+	}
+	if b.bucket == nil {
+		return nil
+	}
+	return b.bucket.Delete(key)
+}
+
+func (b *boltBucket) ForEach(fn func(key, value []byte) error) error {
+	if b.bucket == nil {
+		return nil
+	}
+	return b.bucket.ForEach(fn)
+}
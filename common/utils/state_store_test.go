@@ -0,0 +1,146 @@
+// Copyright 2020 Stafi Protocol
+// SPDX-License-Identifier: LGPL-3.0-only
+
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func put(bucket, key, value string) func(tx StateTx) error {
+	return func(tx StateTx) error {
+		return tx.Bucket(bucket).Put([]byte(key), []byte(value))
+	}
+}
+
+// keys returns the keys and values of bucket in store, in key order
+func keys(t *testing.T, store StateStore, bucket string) []string {
+	t.Helper()
+	var kvs []string
+	err := store.View(func(tx StateTx) error {
+		return tx.Bucket(bucket).ForEach(func(key, value []byte) error {
+			kvs = append(kvs, string(key)+"="+string(value))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kvs
+}
+
+func TestStateStore(t *testing.T) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) StateStore
+	}{
+		{name: "bolt", open: func(t *testing.T) StateStore {
+			store, err := OpenBoltStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		}},
+		{name: "mem", open: func(*testing.T) StateStore { return NewMemStore() }},
+	}
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name    string
+		updates []func(tx StateTx) error
+		wantErr error
+		want    map[string][]string // bucket => key=value
+	}{
+		{
+			name:    "committed in key order",
+			updates: []func(tx StateTx) error{put("a", "k2", "2"), put("a", "k1", "1"), put("b", "k", "b")},
+			want:    map[string][]string{"a": {"k1=1", "k2=2"}, "b": {"k=b"}},
+		},
+		{
+			name: "failed update rolled back",
+			updates: []func(tx StateTx) error{put("a", "k", "v"), func(tx StateTx) error {
+				if err := put("a", "k", "x")(tx); err != nil {
+					return err
+				}
+				if err := put("b", "k", "x")(tx); err != nil {
+					return err
+				}
+				if got := string(tx.Bucket("a").Get([]byte("k"))); got != "x" {
+					t.Errorf("own write reads %q", got)
+				}
+				return errFailed
+			}},
+			wantErr: errFailed,
+			want:    map[string][]string{"a": {"k=v"}, "b": nil},
+		},
+		{
+			name: "delete key",
+			updates: []func(tx StateTx) error{put("a", "k1", "1"), put("a", "k2", "2"), func(tx StateTx) error {
+				return tx.Bucket("a").Delete([]byte("k1"))
+			}},
+			want: map[string][]string{"a": {"k2=2"}},
+		},
+		{
+			name: "delete bucket",
+			updates: []func(tx StateTx) error{put("a", "k", "v"), put("b", "k", "v"), func(tx StateTx) error {
+				return tx.DeleteBucket("a")
+			}, func(tx StateTx) error {
+				return tx.DeleteBucket("never written")
+			}},
+			want: map[string][]string{"a": nil, "b": {"k=v"}},
+		},
+	}
+	for _, s := range stores {
+		for _, tt := range tests {
+			t.Run(s.name+"/"+tt.name, func(t *testing.T) {
+				store := s.open(t)
+				var err error
+				for _, update := range tt.updates {
+					if err = store.Update(update); err != nil {
+						break
+					}
+				}
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err %v, want %v", err, tt.wantErr)
+				}
+				for bucket, want := range tt.want {
+					if got := keys(t, store, bucket); !reflect.DeepEqual(got, want) {
+						t.Errorf("bucket %s: %v, want %v", bucket, got, want)
+					}
+				}
+			})
+		}
+		t.Run(s.name+"/read-only view", func(t *testing.T) {
+			store := s.open(t)
+			err := store.View(put("a", "k", "v"))
+			if !errors.Is(err, ErrReadOnlyTx) {
+				t.Fatalf("err %v, want %v", err, ErrReadOnlyTx)
+			}
+		})
+	}
+}
+
+func TestBoltStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenBoltStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(put("a", "k", "v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenBoltStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got := keys(t, store, "a"); !reflect.DeepEqual(got, []string{"k=v"}) {
+		t.Fatalf("reopened store has %v", got)
+	}
+}
@@ -0,0 +1,11 @@
+package cmd
+
+import (
+	cosmosChain "github.com/stafihub/cosmos-relay-sdk/chain"
+	"github.com/stafihub/rtoken-relay-core/common/config"
+	"github.com/stafihub/rtoken-relay-core/common/core"
+)
+
+func init() {
+	core.RegisterChainType(config.ChainTypeCosmosHub, func() core.Chain { return cosmosChain.NewChain() })
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/stafihub/rtoken-relay-core/common/config"
+	"github.com/stafihub/rtoken-relay-core/common/core"
+)
+
+func configCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Config file tools",
+	}
+	cmd.AddCommand(
+		configInitCmd(),
+		configValidateCmd(),
+		configSchemaCmd(),
+	)
+	return cmd
+}
+
+func configValidateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Check the config file and RELAY_* env overrides without connecting to any chain",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configPath, err := flagOrEnv(cmd, flagConfig, config.EnvConfigPath)
+			if err != nil {
+				return err
+			}
+			cfg, err := config.LoadConfig(configPath)
+			if err != nil {
+				return err
+			}
+			for _, key := range cfg.IgnoredEnv() {
+				fmt.Printf("warning: env %s matches no config field, ignored\n", key)
+			}
+
+			var problems config.ValidationError
+			if err := cfg.Validate(); err != nil {
+				problems = err.(config.ValidationError)
+			}
+			problems = append(problems, validateChainTypes(cfg)...)
+			if len(problems) > 0 {
+				return problems
+			}
+			fmt.Printf("config %s is valid\n", configPath)
+			return nil
+		},
+	}
+
+	cmd.Flags().String(flagConfig, defaultConfigPath, "Config file path (.json|.yaml|.yml|.toml), env "+config.EnvConfigPath)
+	return cmd
+}
+
+const flagChainType = "type"
+
+func configSchemaCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Print the json schema of the config file, or of the opts of one chain type",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			chainType, err := cmd.Flags().GetString(flagChainType)
+			if err != nil {
+				return err
+			}
+			schema := config.Schema()
+			if chainType != "" {
+				if schema, err = config.ChainOptionsSchema(chainType); err != nil {
+					return fmt.Errorf("%s, supported: %s", err, strings.Join(config.ChainOptionsTypes(), "|"))
+				}
+			}
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetEscapeHTML(false)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(schema)
+		},
+	}
+
+	cmd.Flags().String(flagChainType, "", "Chain type whose opts schema is printed, e.g. "+config.ChainTypeCosmosHub)
+	return cmd
+}
+
+// validateChainTypes checks the chain types against the types registered in core
+func validateChainTypes(cfg *config.Config) config.ValidationError {
+	var problems config.ValidationError
+	if cfg.NativeChain.Type != "" && cfg.NativeChain.Type != config.ChainTypeStafiHub {
+		problems = append(problems, config.FieldError{
+			Field: "nativeChain.type",
+			Err:   fmt.Errorf("must be %s, got %s", config.ChainTypeStafiHub, cfg.NativeChain.Type),
+		})
+	}
+
+	field := func(i int) string {
+		if cfg.ExternalChain.Rsymbol == "" {
+			return fmt.Sprintf("externalChains[%d].type", i)
+		}
+		if i == 0 {
+			return "externalChain.type"
+		}
+		return fmt.Sprintf("externalChains[%d].type", i-1)
+	}
+	for i, chainConfig := range cfg.ExternalChainList() {
+		chainType := chainConfig.Type
+		if chainType == "" {
+			chainType = config.DefaultExternalChainType
+		}
+		if _, err := core.NewChainByType(chainType); err != nil {
+			problems = append(problems, config.FieldError{Field: field(i), Err: err})
+		}
+	}
+	return problems
+}
@@ -0,0 +1,352 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stafihub/rtoken-relay-core/common/config"
+	"github.com/stafihub/rtoken-relay-core/common/core"
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	"github.com/stafihub/rtoken-relay-core/common/utils"
+	"golang.org/x/term"
+)
+
+const (
+	flagOutput            = "output"
+	flagForce             = "force"
+	flagNoPrompt          = "no_prompt"
+	flagQueryRsymbols     = "query_rsymbols"
+	flagBlockstore        = "blockstore"
+	flagLogDir            = "log_dir"
+	flagNativeEndpoints   = "native_endpoints"
+	flagNativeKeystore    = "native_keystore"
+	flagNativeAccount     = "native_account"
+	flagNativeGasPrice    = "native_gas_price"
+	flagExternalType      = "external_type"
+	flagRsymbol           = "rsymbol"
+	flagExternalEndpoints = "external_endpoints"
+	flagExternalKeystore  = "external_keystore"
+	flagPools             = "pools"
+)
+
+func configInitCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Generate a config file for stafihub and one external chain",
+		Long: `Generate a config file for stafihub and one external chain.
+
+Values not given by flags are prompted for when stdin is a terminal, else their defaults are used.
+Missing keystore directories are created empty, add the keys with "relay keys add" before starting.
+The generated config is checked like "relay config validate" before it is written.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			noPrompt, err := cmd.Flags().GetBool(flagNoPrompt)
+			if err != nil {
+				return err
+			}
+			in := &initInput{cmd: cmd, prompt: !noPrompt && term.IsTerminal(int(os.Stdin.Fd())), reader: bufio.NewReader(os.Stdin)}
+			cfg, err := in.config()
+			if err != nil {
+				return err
+			}
+
+			output, err := cmd.Flags().GetString(flagOutput)
+			if err != nil {
+				return err
+			}
+			force, err := cmd.Flags().GetBool(flagForce)
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(output); err == nil && !force {
+				return fmt.Errorf("%s already exists, use --%s to overwrite it", output, flagForce)
+			}
+
+			for _, dir := range []string{cfg.NativeChain.KeystorePath, cfg.ExternalChains[0].KeystorePath} {
+				if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+					if err := os.MkdirAll(dir, 0700); err != nil {
+						return err
+					}
+					fmt.Printf("created keystore directory %s\n", dir)
+				}
+			}
+
+			var problems config.ValidationError
+			if err := cfg.Validate(); err != nil {
+				problems = err.(config.ValidationError)
+			}
+			problems = append(problems, validateChainTypes(cfg)...)
+			if len(problems) > 0 {
+				return problems
+			}
+
+			if err := config.SaveConfig(output, cfg); err != nil {
+				return err
+			}
+			fmt.Printf("config written to %s\n", output)
+			return nil
+		},
+	}
+
+	cmd.Flags().String(flagOutput, defaultConfigPath, "Path of the generated config (.json|.yaml|.yml|.toml)")
+	cmd.Flags().Bool(flagForce, false, "Overwrite the output file if it exists")
+	cmd.Flags().Bool(flagNoPrompt, false, "Never prompt, use the defaults of the flags not given")
+	cmd.Flags().Bool(flagQueryRsymbols, false, "Query the stafihub endpoints for the rsymbols they support")
+	cmd.Flags().String(flagBlockstore, "./blockstore", "Blockstore directory")
+	cmd.Flags().String(flagLogDir, "./log_file", "Log directory")
+	cmd.Flags().StringSlice(flagNativeEndpoints, []string{"http://127.0.0.1:26657"}, "Stafihub rpc endpoints, comma separated")
+	cmd.Flags().String(flagNativeKeystore, "./keys/stafihub", "Stafihub keystore directory")
+	cmd.Flags().String(flagNativeAccount, "", "Name of the relay key in the stafihub keystore")
+	cmd.Flags().String(flagNativeGasPrice, "0.00001ufis", "Gas price of the stafihub transactions")
+	cmd.Flags().String(flagExternalType, config.DefaultExternalChainType, "External chain type ("+strings.Join(core.SupportedChainTypes(), "|")+")")
+	cmd.Flags().String(flagRsymbol, "", "Rsymbol of the external chain, e.g. uratom")
+	cmd.Flags().StringSlice(flagExternalEndpoints, nil, "External chain rpc endpoints, comma separated")
+	cmd.Flags().String(flagExternalKeystore, "", "External chain keystore directory (default ./keys/<rsymbol>)")
+	cmd.Flags().StringToString(flagPools, nil, "Multisig pools as poolKeyName=subKeyName, comma separated, empty for ica pools only")
+	return cmd
+}
+
+// initInput reads the values of config init from flags, then prompts, then flag defaults
+type initInput struct {
+	cmd    *cobra.Command
+	prompt bool
+	reader *bufio.Reader
+}
+
+func (in *initInput) config() (*config.Config, error) {
+	blockstorePath, err := in.string(flagBlockstore, "blockstore directory", "")
+	if err != nil {
+		return nil, err
+	}
+	logFilePath, err := in.string(flagLogDir, "log directory", "")
+	if err != nil {
+		return nil, err
+	}
+
+	nativeEndpoints, err := in.list(flagNativeEndpoints, "stafihub rpc endpoints")
+	if err != nil {
+		return nil, err
+	}
+	nativeKeystore, err := in.string(flagNativeKeystore, "stafihub keystore directory", "")
+	if err != nil {
+		return nil, err
+	}
+	nativeAccount, err := in.string(flagNativeAccount, "stafihub relay key name", "")
+	if err != nil {
+		return nil, err
+	}
+	nativeGasPrice, err := in.string(flagNativeGasPrice, "stafihub gas price", "")
+	if err != nil {
+		return nil, err
+	}
+
+	externalType, err := in.string(flagExternalType, "external chain type ("+strings.Join(core.SupportedChainTypes(), "|")+")", "")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := core.NewChainByType(externalType); err != nil {
+		return nil, err
+	}
+
+	var rsymbols []string
+	queryRsymbols, err := in.cmd.Flags().GetBool(flagQueryRsymbols)
+	if err != nil {
+		return nil, err
+	}
+	if queryRsymbols {
+		if rsymbols, err = queryHubRsymbols(nativeEndpoints); err != nil {
+			return nil, fmt.Errorf("query rsymbols from stafihub failed: %s", err)
+		}
+		fmt.Printf("rsymbols on stafihub: %s\n", strings.Join(rsymbols, ", "))
+	}
+	defaultRsymbol := ""
+	if len(rsymbols) > 0 {
+		defaultRsymbol = rsymbols[0]
+	}
+	rsymbol, err := in.string(flagRsymbol, "external chain rsymbol", defaultRsymbol)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsymbols) > 0 && !containsString(rsymbols, rsymbol) {
+		return nil, fmt.Errorf("rsymbol %s is not on stafihub, supported: %s", rsymbol, strings.Join(rsymbols, "|"))
+	}
+
+	externalEndpoints, err := in.list(flagExternalEndpoints, "external chain rpc endpoints")
+	if err != nil {
+		return nil, err
+	}
+	externalKeystore, err := in.string(flagExternalKeystore, "external chain keystore directory", filepath.Join(".", "keys", rsymbol))
+	if err != nil {
+		return nil, err
+	}
+
+	nativeOptions := &config.StafiHubOptions{Account: nativeAccount, GasPrice: nativeGasPrice}
+	externalOptions, err := config.NewChainOptions(externalType)
+	if err != nil && !errors.Is(err, config.ErrNoChainOptions) {
+		return nil, err
+	}
+	if cosmosOptions, ok := externalOptions.(*config.CosmosHubOptions); ok {
+		if cosmosOptions.Pools, err = in.pools(); err != nil {
+			return nil, err
+		}
+	}
+	var externalOpts interface{} = map[string]interface{}{}
+	if externalOptions != nil {
+		externalOpts = externalOptions
+	}
+
+	return &config.Config{
+		BlockstorePath: blockstorePath,
+		LogFilePath:    logFilePath,
+		LogLevel:       "info",
+		MsgQueue: config.MsgQueueConfig{
+			Depth:   core.DefaultQueueDepth,
+			Workers: core.DefaultQueueWorkers,
+			Policy:  string(core.QueuePolicyBlock),
+		},
+		ShutdownTimeout: uint32(core.DefaultDrainTimeout / time.Second),
+		Monitor:         config.MonitorConfig{ListenAddr: "127.0.0.1:9100"},
+		Supervisor: config.SupervisorConfig{
+			InitialBackoff: uint32(core.DefaultInitialBackoff / time.Second),
+			MaxBackoff:     uint32(core.DefaultMaxBackoff / time.Second),
+			MaxRestarts:    core.DefaultMaxRestarts,
+		},
+		PoolResync: uint32(core.DefaultPoolResyncInterval / time.Second),
+		Retry: config.RetryConfig{
+			Attempts:       utils.DefaultRetryAttempts,
+			InitialBackoff: uint32(utils.DefaultRetryInitialBackoff / time.Second),
+			MaxBackoff:     uint32(utils.DefaultRetryMaxBackoff / time.Second),
+			CallTimeout:    uint32(utils.DefaultRetryCallTimeout / time.Second),
+		},
+		NativeChain: config.RawChainConfig{
+			Type:         config.ChainTypeStafiHub,
+			Name:         "stafihub",
+			EndpointList: nativeEndpoints,
+			KeystorePath: nativeKeystore,
+			Opts:         nativeOptions,
+		},
+		ExternalChains: []config.RawChainConfig{{
+			Type:         externalType,
+			Name:         rsymbol,
+			Rsymbol:      rsymbol,
+			EndpointList: externalEndpoints,
+			KeystorePath: externalKeystore,
+			Opts:         externalOpts,
+		}},
+	}, nil
+}
+
+// string returns the flag if it is set, else the answer to a prompt, else the default, which
+// is def if not empty else the flag default
+func (in *initInput) string(flag, label, def string) (string, error) {
+	value, err := in.cmd.Flags().GetString(flag)
+	if err != nil {
+		return "", err
+	}
+	if in.cmd.Flags().Changed(flag) {
+		return value, nil
+	}
+	if def == "" {
+		def = value
+	}
+	if !in.prompt {
+		return def, nil
+	}
+	return in.ask(label, def)
+}
+
+func (in *initInput) list(flag, label string) ([]string, error) {
+	values, err := in.cmd.Flags().GetStringSlice(flag)
+	if err != nil {
+		return nil, err
+	}
+	if in.cmd.Flags().Changed(flag) || !in.prompt {
+		return values, nil
+	}
+	answer, err := in.ask(label+", comma separated", strings.Join(values, ","))
+	if err != nil {
+		return nil, err
+	}
+	return splitList(answer), nil
+}
+
+func (in *initInput) pools() (map[string]string, error) {
+	pools, err := in.cmd.Flags().GetStringToString(flagPools)
+	if err != nil {
+		return nil, err
+	}
+	if pools == nil {
+		pools = map[string]string{}
+	}
+	if in.cmd.Flags().Changed(flagPools) || !in.prompt {
+		return pools, nil
+	}
+	answer, err := in.ask("multisig pools as poolKeyName=subKeyName, comma separated, empty for ica pools only", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range splitList(answer) {
+		pool, subKey, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("pool %q must be poolKeyName=subKeyName", item)
+		}
+		pools[strings.TrimSpace(pool)] = strings.TrimSpace(subKey)
+	}
+	return pools, nil
+}
+
+func (in *initInput) ask(label, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", label, def)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+	answer, err := in.reader.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && answer != "") {
+		return "", err
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// queryHubRsymbols returns the rtoken denoms having an exchange rate on stafihub
+func queryHubRsymbols(endpoints []string) ([]string, error) {
+	hub, err := newHubQuerier(endpoints, config.RetryConfig{}, log.NewLog("module", "config init"))
+	if err != nil {
+		return nil, err
+	}
+	rsymbols, err := hub.GetRsymbols()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rsymbols)
+	return rsymbols, nil
+}
+
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
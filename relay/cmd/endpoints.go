@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	rpcHttp "github.com/cometbft/cometbft/rpc/client/http"
+	"github.com/stafihub/rtoken-relay-core/common/config"
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	"github.com/stafihub/rtoken-relay-core/common/utils"
+)
+
+// chainEndpoints probes the rpc endpoints of the cosmos chains, the chains are built and
+// restarted with their endpoints healthiest first and without the ejected ones. Chains of
+// other types keep their endpoints as configured.
+type chainEndpoints struct {
+	timeout time.Duration
+	pools   map[string]*utils.EndpointPool // by rsymbol
+	lock    sync.Mutex
+	clients map[string]*rpcHttp.HTTP // by endpoint
+}
+
+func newChainEndpoints(chains []config.RawChainConfig, retry config.RetryConfig) (*chainEndpoints, error) {
+	e := &chainEndpoints{
+		timeout: time.Duration(retry.CallTimeout) * time.Second,
+		pools:   make(map[string]*utils.EndpointPool),
+		clients: make(map[string]*rpcHttp.HTTP),
+	}
+	if e.timeout <= 0 {
+		e.timeout = utils.DefaultRetryCallTimeout
+	}
+	for _, chainConfig := range chains {
+		if chainConfig.Type != config.ChainTypeCosmosHub {
+			continue
+		}
+		pool, err := utils.NewEndpointPool(chainConfig.EndpointList, e.height, utils.EndpointPoolConfig{ProbeTimeout: e.timeout},
+			log.NewLog("module", "endpoints", "rsymbol", chainConfig.Rsymbol))
+		if err != nil {
+			return nil, fmt.Errorf("%s endpoints: %w", chainConfig.Rsymbol, err)
+		}
+		e.pools[chainConfig.Rsymbol] = pool
+	}
+	return e, nil
+}
+
+// probe probes the endpoints of every chain once
+func (e *chainEndpoints) probe() {
+	var wg sync.WaitGroup
+	for _, pool := range e.pools {
+		wg.Add(1)
+		go func(pool *utils.EndpointPool) {
+			defer wg.Done()
+			pool.Probe(context.Background())
+		}(pool)
+	}
+	wg.Wait()
+}
+
+// run probes the endpoints of every chain until stop is closed
+func (e *chainEndpoints) run(stop <-chan struct{}) {
+	for _, pool := range e.pools {
+		go pool.Run(stop)
+	}
+}
+
+// ordered returns chainConfig with its endpoints healthiest first
+func (e *chainEndpoints) ordered(chainConfig config.RawChainConfig) config.RawChainConfig {
+	if pool, exist := e.pools[chainConfig.Rsymbol]; exist {
+		chainConfig.EndpointList = pool.Endpoints()
+	}
+	return chainConfig
+}
+
+// setEndpoints replaces the endpoints probed for the chain of rsymbol
+func (e *chainEndpoints) setEndpoints(rsymbol string, endpoints []string) error {
+	if pool, exist := e.pools[rsymbol]; exist {
+		return pool.SetEndpoints(endpoints)
+	}
+	return nil
+}
+
+// height returns the latest block height of endpoint, it probes the endpoints of the pools
+func (e *chainEndpoints) height(ctx context.Context, endpoint string) (int64, error) {
+	rpcClient, err := e.client(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	status, err := rpcClient.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if status.SyncInfo.CatchingUp {
+		return 0, fmt.Errorf("catching up at height %d", status.SyncInfo.LatestBlockHeight)
+	}
+	return status.SyncInfo.LatestBlockHeight, nil
+}
+
+// client returns the rpc client of endpoint, it gives up after the call timeout
+func (e *chainEndpoints) client(endpoint string) (*rpcHttp.HTTP, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if rpcClient, exist := e.clients[endpoint]; exist {
+		return rpcClient, nil
+	}
+	rpcClient, err := rpcHttp.NewWithTimeout(endpoint, "/websocket", uint(e.timeout/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	e.clients[endpoint] = rpcClient
+	return rpcClient, nil
+}
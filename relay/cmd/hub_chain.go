@@ -0,0 +1,523 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cosMath "cosmossdk.io/math"
+	"github.com/cosmos/cosmos-sdk/types"
+	"github.com/stafihub/rtoken-relay-core/common/config"
+	"github.com/stafihub/rtoken-relay-core/common/core"
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	"github.com/stafihub/rtoken-relay-core/common/utils"
+	stafiHubChain "github.com/stafihub/stafi-hub-relay-sdk/chain"
+	hubClient "github.com/stafihub/stafi-hub-relay-sdk/client"
+	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
+	stafiHubXRValidatorTypes "github.com/stafihub/stafihub/x/rvalidator/types"
+)
+
+// errHubEventsStopped interrupts the event being dealt with, its block is dealt with again on the next start
+var errHubEventsStopped = errors.New("stafihub events stopped")
+
+// hubChain is the stafihub chain of the relay, it handles the messages to stafihub and routes
+// the stafihub events of every cared symbol to the chain of that symbol. The sdk listener
+// routes the events of a single denom, the first cared symbol, the events of the others are
+// routed by hubEvents over one query only client: the keystore is opened once.
+type hubChain struct {
+	*stafiHubChain.Chain
+	events   []*hubEvents
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newHubChain initializes the stafihub chain for caredSymbols, the cursors of the symbols after
+// the first one are kept under blockstorePath in a directory per symbol
+func newHubChain(keys *keystores, chainConfig config.RawChainConfig, caredSymbols []string, blockstorePath string, sysErr chan<- error) (*hubChain, error) {
+	sdkChain, err := newStafiHubChain(keys, chainConfig, caredSymbols[0], blockstorePath, sysErr)
+	if err != nil {
+		return nil, err
+	}
+	c := &hubChain{Chain: sdkChain, stop: make(chan struct{})}
+	if len(caredSymbols) == 1 {
+		return c, nil
+	}
+
+	options, err := chainConfig.Options(config.ChainTypeStafiHub)
+	if err != nil {
+		return nil, fmt.Errorf("nativeChain opts: %w", err)
+	}
+	hubOptions := options.(*config.StafiHubOptions)
+	client, err := hubClient.NewClient(nil, "", "", chainConfig.EndpointList, log.NewLog("chain", chainConfig.Name))
+	if err != nil {
+		return nil, fmt.Errorf("stafihub query client: %w", err)
+	}
+	for _, symbol := range caredSymbols[1:] {
+		bs, err := utils.NewBlockstore(filepath.Join(blockstorePath, symbol), 0, hubOptions.Account)
+		if err != nil {
+			return nil, err
+		}
+		startBlock, err := stafiHubChain.StartBlock(bs, uint64(hubOptions.StartBlock))
+		if err != nil {
+			return nil, err
+		}
+		c.events = append(c.events, &hubEvents{
+			caredSymbol: core.RSymbol(symbol),
+			startBlock:  startBlock,
+			blockstore:  bs,
+			client:      client,
+			log:         log.NewLog("chain", chainConfig.Name, "caredSymbol", symbol),
+			stop:        c.stop,
+			sysErr:      sysErr,
+		})
+	}
+	return c, nil
+}
+
+func (c *hubChain) SetRouter(r *core.Router) {
+	c.Chain.SetRouter(r)
+	for _, e := range c.events {
+		e.router = r
+	}
+}
+
+func (c *hubChain) Start() error {
+	if err := c.Chain.Start(); err != nil {
+		return err
+	}
+	for _, e := range c.events {
+		if err := e.start(); err != nil {
+			return fmt.Errorf("stafihub events of %s: %w", e.caredSymbol, err)
+		}
+	}
+	return nil
+}
+
+func (c *hubChain) Stop() {
+	c.Chain.Stop()
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// hubEvents routes the stafihub events of caredSymbol like the sdk listener does for the
+// first cared symbol: it polls the confirmed blocks, sends the events still to deal with to
+// the chain of caredSymbol and waits for stafihub to move past an era event before the next
+// block, so a restart resumes from the event being dealt with.
+type hubEvents struct {
+	caredSymbol core.RSymbol
+	startBlock  uint64
+	blockstore  utils.Blockstorer
+	client      *hubClient.Client
+	router      *core.Router
+	log         log.Logger
+	stop        <-chan struct{}
+	sysErr      chan<- error
+}
+
+func (e *hubEvents) start() error {
+	if e.router == nil {
+		return fmt.Errorf("must set router with SetRouter()")
+	}
+	latestBlk, err := e.client.GetCurrentBlockHeight()
+	if err != nil {
+		return err
+	}
+	if latestBlk < int64(e.startBlock) {
+		return fmt.Errorf("starting block (%d) is greater than latest known block (%d)", e.startBlock, latestBlk)
+	}
+	go func() {
+		if err := e.pollBlocks(); err != nil {
+			e.log.Error("Polling blocks failed", "err", err)
+			e.sysErr <- err
+		}
+	}()
+	return nil
+}
+
+func (e *hubEvents) pollBlocks() error {
+	willDealBlock := e.startBlock
+	if willDealBlock == 0 {
+		willDealBlock = 1
+	}
+	retry := stafiHubChain.BlockRetryLimit
+	for {
+		select {
+		case <-e.stop:
+			e.log.Info("pollBlocks receive stop chan, will stop")
+			return nil
+		default:
+		}
+		if retry <= 0 {
+			return fmt.Errorf("pollBlocks reach retry limit, caredSymbol: %s", e.caredSymbol)
+		}
+
+		latestBlk, err := e.client.GetCurrentBlockHeight()
+		if err != nil {
+			e.log.Error("Failed to fetch latest blockNumber", "err", err)
+			retry--
+			e.sleep()
+			continue
+		}
+		// sleep if the block we want comes after the most recently finalized block
+		if int64(willDealBlock)+stafiHubChain.BlockConfirmNumber > latestBlk {
+			e.sleep()
+			continue
+		}
+		if err := e.processBlockEvents(int64(willDealBlock)); err != nil {
+			if errors.Is(err, errHubEventsStopped) {
+				return nil
+			}
+			e.log.Error("Failed to process events in block", "block", willDealBlock, "err", err)
+			retry--
+			e.sleep()
+			continue
+		}
+		if err := e.blockstore.StoreBlock(new(big.Int).SetUint64(willDealBlock)); err != nil {
+			e.log.Error("Failed to write to blockstore", "err", err)
+		}
+		willDealBlock++
+		retry = stafiHubChain.BlockRetryLimit
+	}
+}
+
+// sleep waits the block retry interval, it returns false early once the chain stops
+func (e *hubEvents) sleep() bool {
+	select {
+	case <-time.After(stafiHubChain.BlockRetryInterval):
+		return true
+	case <-e.stop:
+		return false
+	}
+}
+
+func (e *hubEvents) processBlockEvents(currentBlock int64) error {
+	results, err := e.client.GetBlockResults(currentBlock)
+	if err != nil {
+		return fmt.Errorf("client.GetBlockResults failed: %s", err)
+	}
+	for _, txResult := range results.TxsResults {
+		for _, event := range txResult.Events {
+			stringEvent, err := hubClient.ParseBase64Event(event)
+			if err != nil {
+				return err
+			}
+			if err := e.processStringEvent(stringEvent, currentBlock); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// eventDenom returns the denom of a stafihub event, which is its first attribute
+func eventDenom(event types.StringEvent) string {
+	if len(event.Attributes) == 0 {
+		return ""
+	}
+	return event.Attributes[0].Value
+}
+
+// processStringEvent sends the messages of event if it is an event of caredSymbol still to
+// deal with, then waits until stafihub dealt with it
+func (e *hubEvents) processStringEvent(event types.StringEvent, blockNumber int64) error {
+	if event.Type != stafiHubXLedgerTypes.EventTypeEraPoolUpdated && eventDenom(event) != string(e.caredSymbol) {
+		return nil
+	}
+
+	var (
+		msgs     []*core.Message
+		oldState = make(map[string]stafiHubXLedgerTypes.PoolBondState) // shotId => bondstate
+		shotIds  []string
+	)
+	add := func(content core.Payload) {
+		msgs = append(msgs, &core.Message{
+			Source:      core.HubRFIS,
+			Destination: e.caredSymbol,
+			Reason:      content.Reason(),
+			Content:     content,
+		})
+	}
+
+	switch event.Type {
+	case stafiHubXLedgerTypes.EventTypeEraPoolUpdated:
+		if len(event.Attributes)%4 != 0 {
+			return stafiHubChain.ErrEventAttributeNumberUnMatch
+		}
+		for i := 0; i < len(event.Attributes)/4; i++ {
+			if event.Attributes[4*i].Value != string(e.caredSymbol) {
+				continue
+			}
+			lastEra, err := parseEra(event.Attributes[4*i+1].Value)
+			if err != nil {
+				return fmt.Errorf("last era: %w", err)
+			}
+			currentEra, err := parseEra(event.Attributes[4*i+2].Value)
+			if err != nil {
+				return fmt.Errorf("current era: %w", err)
+			}
+			eraEvent := core.EventEraPoolUpdated{
+				Denom:      event.Attributes[4*i].Value,
+				LastEra:    lastEra,
+				CurrentEra: currentEra,
+				ShotId:     event.Attributes[4*i+3].Value,
+			}
+			chainEra, err := e.client.QueryChainEra(string(e.caredSymbol))
+			if err != nil {
+				return err
+			}
+			// already dealt with
+			if chainEra.GetEra() != eraEvent.CurrentEra {
+				continue
+			}
+			snapshotRes, err := e.client.QuerySnapshot(eraEvent.ShotId)
+			if err != nil {
+				return err
+			}
+			if snapshotRes.Shot.BondState != stafiHubXLedgerTypes.EraUpdated {
+				continue
+			}
+			eraEvent.Snapshot = snapshotRes.Shot
+			add(eraEvent)
+			oldState[eraEvent.ShotId] = stafiHubXLedgerTypes.EraUpdated
+			shotIds = append(shotIds, eraEvent.ShotId)
+		}
+
+	case stafiHubXLedgerTypes.EventTypeBondReported, stafiHubXLedgerTypes.EventTypeActiveReported:
+		if len(event.Attributes) != 2 {
+			return stafiHubChain.ErrEventAttributeNumberUnMatch
+		}
+		denom, shotId := event.Attributes[0].Value, event.Attributes[1].Value
+		state := stafiHubXLedgerTypes.BondReported
+		if event.Type == stafiHubXLedgerTypes.EventTypeActiveReported {
+			state = stafiHubXLedgerTypes.ActiveReported
+		}
+		snapshotRes, err := e.client.QuerySnapshot(shotId)
+		if err != nil {
+			return err
+		}
+		// already dealt with
+		if snapshotRes.Shot.BondState != state {
+			return nil
+		}
+		chainEra, err := e.client.QueryChainEra(denom)
+		if err != nil {
+			return err
+		}
+		if chainEra.GetEra() != snapshotRes.Shot.GetEra() {
+			return nil
+		}
+		if state == stafiHubXLedgerTypes.BondReported {
+			add(core.EventBondReported{Denom: denom, ShotId: shotId, Snapshot: snapshotRes.Shot})
+		} else {
+			unbondRes, err := e.client.QueryPoolUnbond(denom, snapshotRes.Shot.Pool, snapshotRes.Shot.Era)
+			if err != nil {
+				return err
+			}
+			add(core.EventActiveReported{Denom: denom, ShotId: shotId, Snapshot: snapshotRes.Shot, PoolUnbond: unbondRes.Unbondings})
+		}
+		oldState[shotId] = state
+		shotIds = append(shotIds, shotId)
+
+	case stafiHubXLedgerTypes.EventTypeRParamsChanged:
+		if len(event.Attributes) != 6 {
+			return stafiHubChain.ErrEventAttributeNumberUnMatch
+		}
+		denom := event.Attributes[0].Value
+		rparams, err := e.client.QueryRParams(denom)
+		if err != nil {
+			return err
+		}
+		add(core.EventRParamsChanged{
+			Denom:      denom,
+			GasPrice:   rparams.RParams.GasPrice,
+			EraSeconds: rparams.RParams.EraSeconds,
+			LeastBond:  rparams.RParams.LeastBond,
+			Offset:     rparams.RParams.Offset,
+		})
+
+	case stafiHubXRValidatorTypes.EventTypeUpdateRValidator:
+		if len(event.Attributes) != 8 {
+			return stafiHubChain.ErrEventAttributeNumberUnMatch
+		}
+		denom, poolAddress := event.Attributes[0].Value, event.Attributes[1].Value
+		var values [4]cosMath.Uint // era, cycle version, cycle number, cycle seconds
+		for i, index := range []int{2, 5, 6, 7} {
+			value, err := cosMath.ParseUint(event.Attributes[index].Value)
+			if err != nil {
+				return err
+			}
+			values[i] = value
+		}
+		updated := core.EventRValidatorUpdated{
+			Denom:        denom,
+			Era:          uint32(values[0].Uint64()),
+			PoolAddress:  poolAddress,
+			OldAddress:   event.Attributes[3].Value,
+			NewAddress:   event.Attributes[4].Value,
+			CycleVersion: values[1].Uint64(),
+			CycleNumber:  values[2].Uint64(),
+			CycleSeconds: values[3].Uint64(),
+		}
+		dealedCycle, err := e.client.QueryLatestDealedCycle(denom, poolAddress)
+		if err != nil {
+			if !strings.Contains(err.Error(), "NotFound") {
+				e.log.Warn("QueryLatestDealedCycle failed", "err", err)
+				return err
+			}
+		} else if dealedCycle.LatestDealedCycle.Number >= updated.CycleNumber && dealedCycle.LatestDealedCycle.Version >= updated.CycleVersion {
+			// already dealt with
+			return nil
+		}
+		resultBlock, err := e.client.QueryBlock(blockNumber)
+		if err != nil {
+			return err
+		}
+		updated.BlockTimestamp = resultBlock.Block.Time.Unix()
+		add(updated)
+
+	case stafiHubXRValidatorTypes.EventTypeAddRValidator:
+		if len(event.Attributes) != 4 {
+			return stafiHubChain.ErrEventAttributeNumberUnMatch
+		}
+		era, err := cosMath.ParseUint(event.Attributes[2].Value)
+		if err != nil {
+			return err
+		}
+		add(core.EventRValidatorAdded{
+			Denom:        event.Attributes[0].Value,
+			Era:          uint32(era.Uint64()),
+			PoolAddress:  event.Attributes[1].Value,
+			AddedAddress: event.Attributes[3].Value,
+		})
+
+	case stafiHubXLedgerTypes.EventTypeInitPool:
+		if len(event.Attributes) != 2 {
+			return stafiHubChain.ErrEventAttributeNumberUnMatch
+		}
+		initPool, ok, err := e.initPool(event.Attributes[0].Value, event.Attributes[1].Value)
+		if err != nil || !ok {
+			return err
+		}
+		add(initPool)
+
+	case stafiHubXLedgerTypes.EventTypeRemovePool:
+		if len(event.Attributes) != 2 {
+			return stafiHubChain.ErrEventAttributeNumberUnMatch
+		}
+		add(core.EventRemovePool{Denom: event.Attributes[0].Value, PoolAddress: event.Attributes[1].Value})
+
+	default:
+		return nil
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	e.log.Info("find event", "eventType", event.Type, "block number", blockNumber, "msgs", msgs)
+	for i, msg := range msgs {
+		err := e.router.Send(msg)
+		if err != nil {
+			e.log.Error("failed to send message", "err", err, "msg", msg)
+			return err
+		}
+		switch content := msg.Content.(type) {
+		case core.EventRParamsChanged, core.EventRValidatorAdded, core.EventInitPool, core.EventRemovePool:
+			// no need to wait, the chain gets the latest state when it restarts
+			return nil
+		case core.EventRValidatorUpdated:
+			// wait until the update is reported, so a restart deals with the event again until then
+			err = e.waitFor(func() (bool, error) {
+				dealedCycle, err := e.client.QueryLatestDealedCycle(content.Denom, content.PoolAddress)
+				if err != nil {
+					return false, err
+				}
+				return dealedCycle.LatestDealedCycle.Number >= content.CycleNumber && dealedCycle.LatestDealedCycle.Version >= content.CycleVersion, nil
+			})
+		default:
+			// era events: wait until the bond state of the snapshot changes, so a restart deals
+			// with the event again until then
+			shotId := shotIds[i]
+			err = e.waitFor(func() (bool, error) {
+				snapshotRes, err := e.client.QuerySnapshot(shotId)
+				if err != nil {
+					return false, err
+				}
+				return snapshotRes.GetShot().BondState != oldState[shotId], nil
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initPool returns the init pool event of an ica pool, ok is false for other pools
+func (e *hubEvents) initPool(denom, poolAddress string) (event core.EventInitPool, ok bool, err error) {
+	icaPoolList, err := e.client.QueryIcaPoolList(denom)
+	if err != nil {
+		return event, false, err
+	}
+	event = core.EventInitPool{Denom: denom, PoolAddress: poolAddress}
+	for _, icaPool := range icaPoolList.IcaPoolList {
+		if icaPool.DelegationAccount.Address == poolAddress {
+			event.WithdrawalAddress = icaPool.WithdrawalAccount.Address
+			event.HostChannelId = icaPool.DelegationAccount.HostChannelId
+			break
+		}
+	}
+	if len(event.WithdrawalAddress) == 0 || len(event.HostChannelId) == 0 {
+		e.log.Info("init pool but not ica pool", "pool", poolAddress)
+		return event, false, nil
+	}
+
+	// wait until the rvalidators of the pool are set
+	for retry := stafiHubChain.BlockRetryLimit; retry > 0; retry-- {
+		validators, err := e.client.QueryRValidatorList(denom, poolAddress)
+		if err != nil {
+			return event, false, err
+		}
+		if len(validators.RValidatorList) != 0 {
+			event.Validators = validators.RValidatorList
+			return event, true, nil
+		}
+		if !e.sleep() {
+			return event, false, errHubEventsStopped
+		}
+	}
+	return event, false, fmt.Errorf("QueryRValidatorList reach retry limit: denom %s pool %s", denom, poolAddress)
+}
+
+// waitFor polls done until it is true, query errors are retried. It returns
+// errHubEventsStopped if the chain stops first.
+func (e *hubEvents) waitFor(done func() (bool, error)) error {
+	for {
+		ok, err := done()
+		if err != nil {
+			e.log.Warn("query failed will retry", "err", err)
+		}
+		if ok {
+			return nil
+		}
+		if !e.sleep() {
+			return errHubEventsStopped
+		}
+	}
+}
+
+// parseEra parses an era attribute of a stafihub event
+func parseEra(value string) (uint32, error) {
+	era, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if era > math.MaxUint32 {
+		return 0, fmt.Errorf("era overflow %d", era)
+	}
+	return uint32(era), nil
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	rpcHttp "github.com/cometbft/cometbft/rpc/client/http"
+	"github.com/cosmos/cosmos-sdk/client"
+	"github.com/stafihub/rtoken-relay-core/common/config"
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	"github.com/stafihub/rtoken-relay-core/common/utils"
+	hubClient "github.com/stafihub/stafi-hub-relay-sdk/client"
+	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
+	stafiHubXRBankTypes "github.com/stafihub/stafihub/x/rbank/types"
+	stafiHubXRValidatorTypes "github.com/stafihub/stafihub/x/rvalidator/types"
+)
+
+// hubQuerier runs the stafihub queries of the start and of the pool resyncs with the retry
+// policy of the config, over the healthiest endpoints of the native chain
+type hubQuerier struct {
+	pool   *utils.EndpointPool
+	policy utils.RetryPolicy
+	log    log.Logger
+	lock   sync.Mutex
+	ctxs   map[string]client.Context // endpoint => query context
+}
+
+func newHubQuerier(endpoints []string, retry config.RetryConfig, logger log.Logger) (*hubQuerier, error) {
+	q := &hubQuerier{
+		policy: utils.RetryPolicy{
+			Attempts:       retry.Attempts,
+			InitialBackoff: time.Duration(retry.InitialBackoff) * time.Second,
+			MaxBackoff:     time.Duration(retry.MaxBackoff) * time.Second,
+			CallTimeout:    time.Duration(retry.CallTimeout) * time.Second,
+		},
+		log:  logger,
+		ctxs: make(map[string]client.Context),
+	}
+	pool, err := utils.NewEndpointPool(endpoints, q.height, utils.EndpointPoolConfig{ProbeTimeout: q.policy.CallTimeout}, logger)
+	if err != nil {
+		return nil, fmt.Errorf("stafihub endpoints: %w", err)
+	}
+	q.pool = pool
+	return q, nil
+}
+
+// height returns the latest block height of endpoint, it probes the endpoints of the pool
+func (q *hubQuerier) height(ctx context.Context, endpoint string) (int64, error) {
+	clientCtx, err := q.clientCtx(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	status, err := clientCtx.Client.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if status.SyncInfo.CatchingUp {
+		return 0, fmt.Errorf("catching up at height %d", status.SyncInfo.LatestBlockHeight)
+	}
+	return status.SyncInfo.LatestBlockHeight, nil
+}
+
+// clientCtx returns the query context of endpoint, its http client gives up after the call timeout
+func (q *hubQuerier) clientCtx(endpoint string) (client.Context, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if ctx, exist := q.ctxs[endpoint]; exist {
+		return ctx, nil
+	}
+	timeout := uint(q.policy.CallTimeout / time.Second)
+	if timeout == 0 {
+		timeout = uint(utils.DefaultRetryCallTimeout / time.Second)
+	}
+	rpcClient, err := rpcHttp.NewWithTimeout(endpoint, "/websocket", timeout)
+	if err != nil {
+		return client.Context{}, err
+	}
+	encodingConfig := hubClient.MakeEncodingConfig()
+	ctx := client.Context{}.
+		WithCodec(encodingConfig.Marshaler).
+		WithInterfaceRegistry(encodingConfig.InterfaceRegistry).
+		WithTxConfig(encodingConfig.TxConfig).
+		WithLegacyAmino(encodingConfig.Amino).
+		WithClient(rpcClient)
+	q.ctxs[endpoint] = ctx
+	return ctx, nil
+}
+
+// hubQuery runs query with the retry policy of q on its endpoints
+func hubQuery[T any](q *hubQuerier, name string, query func(ctx context.Context, clientCtx client.Context) (T, error)) (T, error) {
+	return utils.RetryEndpoints(context.Background(), q.policy, q.pool, q.log, name, func(ctx context.Context, endpoint string) (T, error) {
+		clientCtx, err := q.clientCtx(endpoint)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		return query(ctx, clientCtx)
+	})
+}
+
+func (q *hubQuerier) GetRParams(denom string) (*stafiHubXLedgerTypes.QueryGetRParamsResponse, error) {
+	return hubQuery(q, "GetRParams "+denom, func(ctx context.Context, clientCtx client.Context) (*stafiHubXLedgerTypes.QueryGetRParamsResponse, error) {
+		return stafiHubXLedgerTypes.NewQueryClient(clientCtx).GetRParams(ctx, &stafiHubXLedgerTypes.QueryGetRParamsRequest{Denom: denom})
+	})
+}
+
+func (q *hubQuerier) GetPools(denom string) (*stafiHubXLedgerTypes.QueryBondedPoolsByDenomResponse, error) {
+	return hubQuery(q, "GetPools "+denom, func(ctx context.Context, clientCtx client.Context) (*stafiHubXLedgerTypes.QueryBondedPoolsByDenomResponse, error) {
+		return stafiHubXLedgerTypes.NewQueryClient(clientCtx).BondedPoolsByDenom(ctx, &stafiHubXLedgerTypes.QueryBondedPoolsByDenomRequest{Denom: denom})
+	})
+}
+
+func (q *hubQuerier) GetIcaPools(denom string) (*stafiHubXLedgerTypes.QueryIcaPoolListResponse, error) {
+	return hubQuery(q, "GetIcaPools "+denom, func(ctx context.Context, clientCtx client.Context) (*stafiHubXLedgerTypes.QueryIcaPoolListResponse, error) {
+		return stafiHubXLedgerTypes.NewQueryClient(clientCtx).IcaPoolList(ctx, &stafiHubXLedgerTypes.QueryIcaPoolListRequest{Denom: denom})
+	})
+}
+
+func (q *hubQuerier) GetPoolDetail(denom, pool string) (*stafiHubXLedgerTypes.QueryGetPoolDetailResponse, error) {
+	return hubQuery(q, "GetPoolDetail "+pool, func(ctx context.Context, clientCtx client.Context) (*stafiHubXLedgerTypes.QueryGetPoolDetailResponse, error) {
+		return stafiHubXLedgerTypes.NewQueryClient(clientCtx).GetPoolDetail(ctx, &stafiHubXLedgerTypes.QueryGetPoolDetailRequest{Denom: denom, Pool: pool})
+	})
+}
+
+func (q *hubQuerier) GetSelectedValidators(denom, pool string) (*stafiHubXRValidatorTypes.QueryRValidatorListResponse, error) {
+	return hubQuery(q, "GetSelectedValidators "+pool, func(ctx context.Context, clientCtx client.Context) (*stafiHubXRValidatorTypes.QueryRValidatorListResponse, error) {
+		return stafiHubXRValidatorTypes.NewQueryClient(clientCtx).RValidatorList(ctx, &stafiHubXRValidatorTypes.QueryRValidatorListRequest{Denom: denom, PoolAddress: pool})
+	})
+}
+
+func (q *hubQuerier) GetAddressPrefix(denom string) (*stafiHubXRBankTypes.QueryAddressPrefixResponse, error) {
+	return hubQuery(q, "GetAddressPrefix "+denom, func(ctx context.Context, clientCtx client.Context) (*stafiHubXRBankTypes.QueryAddressPrefixResponse, error) {
+		return stafiHubXRBankTypes.NewQueryClient(clientCtx).AddressPrefix(ctx, &stafiHubXRBankTypes.QueryAddressPrefixRequest{Denom: denom})
+	})
+}
+
+func (q *hubQuerier) GetRsymbols() ([]string, error) {
+	res, err := hubQuery(q, "ExchangeRateAll", func(ctx context.Context, clientCtx client.Context) (*stafiHubXLedgerTypes.QueryExchangeRateAllResponse, error) {
+		return stafiHubXLedgerTypes.NewQueryClient(clientCtx).ExchangeRateAll(ctx, &stafiHubXLedgerTypes.QueryExchangeRateAllRequest{})
+	})
+	if err != nil {
+		return nil, err
+	}
+	rsymbols := make([]string, 0, len(res.ExchangeRates))
+	for _, rate := range res.ExchangeRates {
+		rsymbols = append(rsymbols, rate.Denom)
+	}
+	return rsymbols, nil
+}
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmos/cosmos-sdk/client/input"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/bcrypt"
+	"golang.org/x/term"
+)
+
+const (
+	maxPassphraseAttempts = 3
+
+	// how long the sdk may take to read the passphrase fed for an open, past it a read
+	// for more lines than fed fails instead of blocking
+	passphraseReadTimeout = time.Minute
+)
+
+// keystores reads the passphrase of every keystore once and feeds it to the chain sdks each
+// time they open the keystore. The sdks have no passphrase hook and read the passphrase from
+// os.Stdin, so newKeystores replaces os.Stdin once, before any chain is built, with a pipe
+// only keystores writes to. The passphrases are prompted for on the terminal it had.
+type keystores struct {
+	lock        sync.Mutex
+	terminal    *os.File          // stdin of the process
+	input       *bufio.Reader     // lines of terminal if it is not a tty
+	feed        *os.File          // write end of the pipe read by the sdks as os.Stdin
+	sdkInput    *os.File          // read end of the pipe
+	passphrases map[string]string // by keystore path
+}
+
+// newKeystores installs the passphrase pipe as os.Stdin, it must be called once before
+// the chains are built and before any other goroutine reads os.Stdin
+func newKeystores() (*keystores, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("create passphrase pipe: %w", err)
+	}
+	k := &keystores{
+		terminal:    os.Stdin,
+		input:       bufio.NewReader(os.Stdin),
+		feed:        w,
+		sdkInput:    r,
+		passphrases: make(map[string]string),
+	}
+	os.Stdin = r
+	return k, nil
+}
+
+// open runs open, which opens the keystore at path, with the passphrase of path fed to the
+// sdk. The passphrase is prompted for on the first open of path.
+func (k *keystores) open(name, path string, open func() error) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	passphrase, exist := k.passphrases[path]
+	if !exist {
+		var err error
+		if passphrase, err = k.prompt(name, path); err != nil {
+			return fmt.Errorf("read passphrase of keystore %s: %w", path, err)
+		}
+		k.passphrases[path] = passphrase
+	}
+
+	// the sdk asks once if the keystore has a keyhash, twice when it creates the keystore
+	lines := passphrase + "\n"
+	keyhash, err := hasKeyhash(path)
+	if err != nil {
+		return err
+	}
+	if !keyhash {
+		lines += passphrase + "\n"
+	}
+	if err := k.sdkInput.SetReadDeadline(time.Now().Add(passphraseReadTimeout)); err != nil {
+		return fmt.Errorf("passphrase pipe: %w", err)
+	}
+	defer k.drain()
+	if _, err := io.WriteString(k.feed, lines); err != nil {
+		return fmt.Errorf("feed passphrase of keystore %s: %w", path, err)
+	}
+	return open()
+}
+
+// drain drops the lines the last open did not read, e.g. when it failed before unlocking
+// the keystore, so they are not taken as the passphrase of the next open
+func (k *keystores) drain() {
+	if err := k.sdkInput.SetReadDeadline(time.Now()); err != nil {
+		return
+	}
+	buf := make([]byte, 512)
+	for {
+		if _, err := k.sdkInput.Read(buf); err != nil {
+			break
+		}
+	}
+	_ = k.sdkInput.SetReadDeadline(time.Time{})
+}
+
+// hasKeyhash reports whether the file keyring at path has its passphrase hash yet
+func hasKeyhash(path string) (bool, error) {
+	_, err := os.Stat(keyhashPath(path))
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, os.ErrNotExist):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// keyhashPath returns where the file keyring opened at path keeps its passphrase hash
+func keyhashPath(path string) string {
+	return filepath.Join(path, "keyring-file", "keyhash")
+}
+
+// prompt reads the passphrase of the keystore at path, checked against its keyhash if it has one
+func (k *keystores) prompt(name, path string) (string, error) {
+	keyhash, err := os.ReadFile(keyhashPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	fmt.Printf("Will open %s wallet from <%s>. \nPlease ", name, path)
+	for attempt := 1; ; attempt++ {
+		passphrase, err := k.readPassphrase(fmt.Sprintf("Enter keyring passphrase (attempt %d/%d):", attempt, maxPassphraseAttempts))
+		if err == nil {
+			if keyhash == nil || bcrypt.CompareHashAndPassword(keyhash, []byte(passphrase)) == nil {
+				return passphrase, nil
+			}
+			err = fmt.Errorf("incorrect passphrase")
+		}
+		if attempt >= maxPassphraseAttempts {
+			return "", err
+		}
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// readPassphrase reads a passphrase from the terminal, it has the length the sdk accepts
+func (k *keystores) readPassphrase(prompt string) (string, error) {
+	var passphrase string
+	if fd := int(k.terminal.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		bts, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		passphrase = string(bts)
+	} else {
+		line, err := k.input.ReadString('\n')
+		if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+			return "", err
+		}
+		passphrase = strings.TrimSpace(line)
+	}
+	if len(passphrase) < input.MinPassLength {
+		return "", fmt.Errorf("password must be at least %d characters", input.MinPassLength)
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/stafihub/rtoken-relay-core/common/core"
+	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
+)
+
+// hubPools queries the pools of the pool registry from stafihub
+type hubPools struct {
+	hub *hubQuerier
+}
+
+func (h hubPools) QueryPools(denom string) ([]core.PoolInfo, error) {
+	poolRes, err := h.hub.GetPools(denom)
+	if err != nil {
+		return nil, err
+	}
+	icaPoolsRes, err := h.hub.GetIcaPools(denom)
+	if err != nil {
+		return nil, err
+	}
+
+	// ica pools of every status, the ones not active yet are tracked until stafihub sets
+	// their withdrawal address
+	icaPools := make(map[string]*stafiHubXLedgerTypes.IcaPoolDetail)
+	for _, value := range icaPoolsRes.IcaPoolList {
+		icaPools[value.DelegationAccount.Address] = value
+	}
+
+	pools := make([]core.PoolInfo, 0, len(poolRes.GetAddrs()))
+	for _, poolAddressStr := range poolRes.GetAddrs() {
+		pool := core.PoolInfo{Denom: denom, Address: poolAddressStr}
+		if icaPool, exist := icaPools[poolAddressStr]; exist {
+			pool.Ica = true
+			pool.IcaStatus = icaPool.Status
+			pool.HostChannelId = icaPool.DelegationAccount.HostChannelId
+			if !pool.Active() {
+				// no withdrawal address and possibly no validators selected yet
+				pools = append(pools, pool)
+				continue
+			}
+			pool.WithdrawalAddress = icaPool.WithdrawalAccount.Address
+		} else {
+			// get pool threshold
+			poolDetail, err := h.hub.GetPoolDetail(denom, poolAddressStr)
+			if err != nil {
+				return nil, err
+			}
+			if poolDetail.Detail.Threshold <= 0 {
+				return nil, fmt.Errorf("pool threshold is zero in stafihub, pool: %s", poolAddressStr)
+			}
+			pool.Threshold = poolDetail.Detail.Threshold
+		}
+
+		// get pool targetValidators from rvalidator
+		selectedValidators, err := h.hub.GetSelectedValidators(denom, poolAddressStr)
+		if err != nil {
+			return nil, err
+		}
+		if len(selectedValidators.RValidatorList) <= 0 {
+			return nil, fmt.Errorf("pool selected validators is empty, pool: %s", poolAddressStr)
+		}
+		pool.TargetValidators = selectedValidators.RValidatorList
+		pools = append(pools, pool)
+	}
+
+	// ica pools still being set up may not be bonded yet
+	bonded := make(map[string]bool)
+	for _, pool := range pools {
+		bonded[pool.Address] = true
+	}
+	for address, icaPool := range icaPools {
+		if icaPool.Status < stafiHubXLedgerTypes.IcaPoolStatusSetWithdrawal && !bonded[address] {
+			pools = append(pools, core.PoolInfo{
+				Denom:         denom,
+				Address:       address,
+				Ica:           true,
+				IcaStatus:     icaPool.Status,
+				HostChannelId: icaPool.DelegationAccount.HostChannelId,
+			})
+		}
+	}
+	return pools, nil
+}
@@ -0,0 +1,320 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cosmos/cosmos-sdk/crypto/keyring"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/multisig"
+	"github.com/cosmos/cosmos-sdk/types"
+	cosmosClient "github.com/stafihub/cosmos-relay-sdk/client"
+	"github.com/stafihub/rtoken-relay-core/common/config"
+	"github.com/stafihub/rtoken-relay-core/common/core"
+	"github.com/stafihub/rtoken-relay-core/common/log"
+	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
+)
+
+// preflightPool is one row of the dry run summary
+type preflightPool struct {
+	rsymbol          string
+	address          string
+	kind             string // multisig or ica
+	status           string
+	threshold        uint32
+	relayKey         string // sub key of the relay in the pool, multisig pools only
+	withdrawalAddr   string
+	hostChannel      string
+	targetValidators []string
+}
+
+// preflightReport collects the results of the dry run, every problem is kept instead of
+// stopping at the first one like the start does
+type preflightReport struct {
+	params   []string
+	pools    []preflightPool
+	problems []string
+	warnings []string // reported without failing the dry run
+}
+
+func (r *preflightReport) problem(rsymbol string, format string, args ...interface{}) {
+	r.problems = append(r.problems, rsymbol+": "+fmt.Sprintf(format, args...))
+}
+
+func (r *preflightReport) warning(rsymbol string, format string, args ...interface{}) {
+	r.warnings = append(r.warnings, rsymbol+": "+fmt.Sprintf(format, args...))
+}
+
+// preflight runs the stafihub queries of the start for every external chain, opens the
+// keystores and checks the relay is a member of every configured multisig pool. It prints
+// a summary and submits nothing.
+func preflight(cfg *config.Config, externalChains []config.RawChainConfig) error {
+	report := &preflightReport{}
+
+	// opening the stafihub chain opens its keystore and checks the relay account
+	sysErr := make(chan error, 1)
+	keys, err := newKeystores()
+	if err != nil {
+		return err
+	}
+	if _, err := newStafiHubChain(keys, cfg.NativeChain, externalChains[0].Rsymbol, cfg.BlockstorePath, sysErr); err != nil {
+		return fmt.Errorf("stafihub: %s", err)
+	}
+	hub, err := newHubQuerier(cfg.NativeChain.EndpointList, cfg.Retry, log.NewLog("module", "stafihub query"))
+	if err != nil {
+		return err
+	}
+
+	for _, chainConfig := range externalChains {
+		if chainConfig.Type != config.ChainTypeCosmosHub {
+			report.warning(chainConfig.Rsymbol, "no preflight checks for chain type %s, skipped", chainConfig.Type)
+			continue
+		}
+		report.cosmosChain(hub, chainConfig)
+	}
+
+	report.print()
+	if len(report.problems) > 0 {
+		return fmt.Errorf("preflight found %d problem(s)", len(report.problems))
+	}
+	fmt.Println("preflight ok, nothing was submitted")
+	return nil
+}
+
+func (r *preflightReport) cosmosChain(hub *hubQuerier, chainConfig config.RawChainConfig) {
+	rsymbol := chainConfig.Rsymbol
+	options, err := chainConfig.Options(config.DefaultExternalChainType)
+	if err != nil {
+		r.problem(rsymbol, "opts: %s", err)
+		return
+	}
+	cosmosOptions := options.(*config.CosmosHubOptions)
+
+	rParams, err := hub.GetRParams(rsymbol)
+	if err != nil {
+		r.problem(rsymbol, "GetRParams: %s", err)
+		return
+	}
+	denom := rParams.RParams.Denom
+	prefix := ""
+	if prefixRes, err := hub.GetAddressPrefix(rsymbol); err != nil {
+		r.problem(rsymbol, "GetAddressPrefix: %s", err)
+	} else {
+		prefix = prefixRes.GetAccAddressPrefix()
+	}
+	gasPrice := rParams.RParams.GasPrice
+	if cosmosOptions.GasPrice != "" {
+		gasPrice = cosmosOptions.GasPrice + " (opts)"
+	}
+	r.params = append(r.params, fmt.Sprintf("%s: eraSeconds=%d offset=%d leastBond=%s gasPrice=%s accountPrefix=%s",
+		rsymbol, rParams.RParams.EraSeconds, rParams.RParams.Offset, rParams.RParams.LeastBond, gasPrice, prefix))
+
+	poolRes, err := hub.GetPools(denom)
+	if err != nil {
+		r.problem(rsymbol, "GetPools: %s", err)
+		return
+	}
+	icaPoolsRes, err := hub.GetIcaPools(denom)
+	if err != nil {
+		r.problem(rsymbol, "GetIcaPools: %s", err)
+		return
+	}
+	if len(cosmosOptions.Pools) == 0 && len(icaPoolsRes.IcaPoolList) == 0 {
+		r.problem(rsymbol, "no pool")
+	}
+
+	icaPools := make(map[string]*stafiHubXLedgerTypes.IcaPoolDetail)
+	for _, icaPool := range icaPoolsRes.IcaPoolList {
+		icaPools[icaPool.DelegationAccount.Address] = icaPool
+	}
+
+	subAccounts := make(map[string][]string)
+	for _, poolAddress := range poolRes.GetAddrs() {
+		pool := preflightPool{rsymbol: rsymbol, address: poolAddress, kind: "multisig"}
+		if icaPool, exist := icaPools[poolAddress]; exist {
+			pool.kind = "ica"
+			pool.status = icaPool.Status.String()
+			pool.withdrawalAddr = icaPool.WithdrawalAccount.Address
+			pool.hostChannel = icaPool.DelegationAccount.HostChannelId
+			if icaPool.Status < stafiHubXLedgerTypes.IcaPoolStatusSetWithdrawal {
+				r.pendingPool(rsymbol, poolAddress, icaPool.Status)
+				// no validators selected yet
+				r.pools = append(r.pools, pool)
+				continue
+			}
+		} else {
+			poolDetail, err := hub.GetPoolDetail(denom, poolAddress)
+			if err != nil {
+				r.problem(rsymbol, "GetPoolDetail %s: %s", poolAddress, err)
+			} else {
+				pool.status = poolDetail.Detail.Status.String()
+				pool.threshold = poolDetail.Detail.Threshold
+				subAccounts[poolAddress] = poolDetail.Detail.SubAccounts
+				if poolDetail.Detail.Threshold <= 0 {
+					r.problem(rsymbol, "pool threshold is zero in stafihub, pool: %s", poolAddress)
+				}
+			}
+		}
+
+		selectedValidators, err := hub.GetSelectedValidators(denom, poolAddress)
+		if err != nil {
+			r.problem(rsymbol, "GetSelectedValidators %s: %s", poolAddress, err)
+		} else {
+			pool.targetValidators = selectedValidators.RValidatorList
+			if len(selectedValidators.RValidatorList) == 0 {
+				r.problem(rsymbol, "pool selected validators is empty, pool: %s", poolAddress)
+			}
+		}
+		r.pools = append(r.pools, pool)
+	}
+	bonded := make(map[string]bool)
+	for _, poolAddress := range poolRes.GetAddrs() {
+		bonded[poolAddress] = true
+	}
+	for _, icaPool := range icaPoolsRes.IcaPoolList {
+		address := icaPool.DelegationAccount.Address
+		if icaPool.Status < stafiHubXLedgerTypes.IcaPoolStatusSetWithdrawal && !bonded[address] {
+			r.pendingPool(rsymbol, address, icaPool.Status)
+			r.pools = append(r.pools, preflightPool{rsymbol: rsymbol, address: address, kind: "ica", status: icaPool.Status.String(), hostChannel: icaPool.DelegationAccount.HostChannelId})
+		}
+	}
+
+	if len(cosmosOptions.Pools) > 0 && prefix != "" {
+		r.checkPoolMembers(chainConfig, cosmosOptions.Pools, prefix, subAccounts)
+	}
+	for _, pool := range r.pools {
+		if pool.rsymbol == rsymbol && pool.kind == "multisig" && pool.relayKey == "" {
+			r.warning(rsymbol, "no key of the relay for multisig pool %s", pool.address)
+		}
+	}
+}
+
+func (r *preflightReport) pendingPool(rsymbol, address string, status stafiHubXLedgerTypes.IcaPoolStatus) {
+	r.warning(rsymbol, "ica pool %s is %s, the relay tracks it and activates it once stafihub moves it to %s",
+		address, status, stafiHubXLedgerTypes.IcaPoolStatusSetWithdrawal)
+}
+
+// checkPoolMembers opens the keystore of the external chain and checks that every
+// configured pool is bonded on stafihub with the sub key of the relay among its members
+func (r *preflightReport) checkPoolMembers(chainConfig config.RawChainConfig, pools map[string]string, prefix string, subAccounts map[string][]string) {
+	rsymbol := chainConfig.Rsymbol
+	fmt.Printf("Will open %s wallet from <%s>. \nPlease ", chainConfig.Name, chainConfig.KeystorePath)
+	key, err := keyring.New(types.KeyringServiceName(), keyring.BackendFile, chainConfig.KeystorePath, os.Stdin, cosmosClient.MakeEncodingConfig().Marshaler)
+	if err != nil {
+		r.problem(rsymbol, "open keystore %s: %s", chainConfig.KeystorePath, err)
+		return
+	}
+
+	done := core.UseSdkConfigContext(prefix)
+	defer done()
+	for poolName, subKeyName := range pools {
+		poolInfo, err := key.Key(poolName)
+		if err != nil {
+			r.problem(rsymbol, "pool key %s: %s", poolName, err)
+			continue
+		}
+		poolAddress, err := poolInfo.GetAddress()
+		if err != nil {
+			r.problem(rsymbol, "pool key %s: %s", poolName, err)
+			continue
+		}
+		members, bonded := subAccounts[poolAddress.String()]
+		if !bonded {
+			r.problem(rsymbol, "pool key %s address %s is not a bonded multisig pool on stafihub", poolName, poolAddress)
+			continue
+		}
+
+		subInfo, err := key.Key(subKeyName)
+		if err != nil {
+			r.problem(rsymbol, "sub key %s of pool %s: %s", subKeyName, poolName, err)
+			continue
+		}
+		subAddress, err := subInfo.GetAddress()
+		if err != nil {
+			r.problem(rsymbol, "sub key %s of pool %s: %s", subKeyName, poolName, err)
+			continue
+		}
+		if !containsString(members, subAddress.String()) {
+			r.problem(rsymbol, "sub key %s address %s is not a sub account of pool %s on stafihub", subKeyName, subAddress, poolAddress)
+			continue
+		}
+		if !isMultisigMember(poolInfo, subInfo) {
+			r.problem(rsymbol, "sub key %s is not a member of the multisig key %s", subKeyName, poolName)
+			continue
+		}
+		for i := range r.pools {
+			if r.pools[i].address == poolAddress.String() {
+				r.pools[i].relayKey = subKeyName
+			}
+		}
+	}
+}
+
+// isMultisigMember checks that the public key of sub is part of the multisig public key of pool
+func isMultisigMember(pool, sub *keyring.Record) bool {
+	poolPubKey, err := pool.GetPubKey()
+	if err != nil {
+		return false
+	}
+	subPubKey, err := sub.GetPubKey()
+	if err != nil {
+		return false
+	}
+	multisigPubKey, ok := poolPubKey.(*multisig.LegacyAminoPubKey)
+	if !ok {
+		return false
+	}
+	for _, pubKey := range multisigPubKey.GetPubKeys() {
+		if pubKey.Equals(subPubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *preflightReport) print() {
+	fmt.Println()
+	fmt.Println("rparams:")
+	for _, params := range r.params {
+		fmt.Println("  " + params)
+	}
+
+	fmt.Println()
+	sort.SliceStable(r.pools, func(i, j int) bool { return r.pools[i].rsymbol < r.pools[j].rsymbol })
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RSYMBOL\tPOOL\tTYPE\tSTATUS\tTHRESHOLD\tRELAY KEY\tWITHDRAWAL ADDRESS\tHOST CHANNEL\tTARGET VALIDATORS")
+	for _, p := range r.pools {
+		threshold := "-"
+		if p.kind == "multisig" {
+			threshold = fmt.Sprint(p.threshold)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.rsymbol, p.address, p.kind, orDash(p.status), threshold,
+			orDash(p.relayKey), orDash(p.withdrawalAddr), orDash(p.hostChannel), orDash(strings.Join(p.targetValidators, ",")))
+	}
+	w.Flush()
+
+	if len(r.warnings) > 0 {
+		fmt.Println()
+		fmt.Printf("%d warning(s):\n", len(r.warnings))
+		for _, warning := range r.warnings {
+			fmt.Println("  " + warning)
+		}
+	}
+	if len(r.problems) > 0 {
+		fmt.Println()
+		fmt.Printf("%d problem(s):\n", len(r.problems))
+		for _, problem := range r.problems {
+			fmt.Println("  " + problem)
+		}
+	}
+	fmt.Println()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/stafihub/rtoken-relay-core/common/config"
+	"github.com/stafihub/rtoken-relay-core/common/core"
+	"github.com/stafihub/rtoken-relay-core/common/log"
+)
+
+// editors often save a file in several writes, they are applied as one reload
+const reloadDebounce = 500 * time.Millisecond
+
+// reloader applies the live fields of the config file to the running relay, see config.Config.Reload
+type reloader struct {
+	path string
+	// set when --log_level is given, it wins over the logLevel of the file
+	logLevelFlag string
+	core         *core.Core
+	hub          *hubQuerier     // queries stafihub over the native chain endpoints
+	endpoints    *chainEndpoints // probes the endpoints of the external chains
+	log          log.Logger
+
+	lock sync.Mutex
+	cfg  *config.Config
+}
+
+func newReloader(path string, cfg *config.Config, logLevelFlag string, c *core.Core, hub *hubQuerier, endpoints *chainEndpoints) *reloader {
+	return &reloader{
+		path:         path,
+		logLevelFlag: logLevelFlag,
+		core:         c,
+		hub:          hub,
+		endpoints:    endpoints,
+		log:          log.NewLog("module", "reload"),
+		cfg:          cfg,
+	}
+}
+
+// logLevel returns the level to use, --log_level first, then logLevel of the config or RELAY_LOG_LEVEL
+func logLevel(logLevelFlag string, cfg *config.Config) (logrus.Level, error) {
+	level := logLevelFlag
+	if level == "" {
+		level = cfg.LogLevel
+	}
+	if level == "" {
+		level = logrus.InfoLevel.String()
+	}
+	return logrus.ParseLevel(level)
+}
+
+// externalChain returns the current config of the external chain of rsymbol, chains
+// restarted by the supervisor are built from it so they pick up reloaded fields
+func (r *reloader) externalChain(rsymbol string) config.RawChainConfig {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, chainConfig := range r.cfg.ExternalChainList() {
+		if chainConfig.Rsymbol == rsymbol {
+			if chainConfig.Type == "" {
+				chainConfig.Type = config.DefaultExternalChainType
+			}
+			return chainConfig
+		}
+	}
+	return config.RawChainConfig{}
+}
+
+// reload loads the config file again and applies the fields which can change while running,
+// the other changes are logged and wait for a restart
+func (r *reloader) reload(trigger string) {
+	// chains are reloaded after the lock is released, a supervised chain restarting
+	// for the change reads its config through externalChain
+	for _, change := range r.merge(trigger) {
+		err := r.core.ReloadChain(change.symbol, &change.cfg)
+		switch {
+		case errors.Is(err, core.ErrReloadNotSupported):
+			r.log.Warn("chain can not reload while running, restart the relay to apply the change", "rsymbol", change.symbol, "err", err)
+		case err != nil:
+			r.log.Error("chain reload failed", "rsymbol", change.symbol, "err", err)
+		}
+	}
+}
+
+// chainChange is the new config of a chain to reload
+type chainChange struct {
+	symbol core.RSymbol
+	cfg    config.RawChainConfig
+}
+
+// merge takes the live fields of the config file into the running config and returns the chains to reload
+func (r *reloader) merge(trigger string) []chainChange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.log.Info("reloading config", "path", r.path, "trigger", trigger)
+
+	next, err := config.LoadConfig(r.path)
+	if err != nil {
+		r.log.Error("reload failed, keeping the running config", "err", err)
+		return nil
+	}
+	for _, key := range next.IgnoredEnv() {
+		r.log.Warn("env matches no config field, ignored", "env", key)
+	}
+	var problems config.ValidationError
+	if err := next.Validate(); err != nil {
+		problems = err.(config.ValidationError)
+	}
+	problems = append(problems, validateChainTypes(next)...)
+	if len(problems) > 0 {
+		r.log.Error("reload failed, keeping the running config", "err", problems)
+		return nil
+	}
+
+	merged, err := r.cfg.Reload(next)
+	var restart config.ValidationError
+	errors.As(err, &restart)
+	// the stafihub chain can not reload, only the queries of the relay take its new endpoints
+	if old, new := r.cfg.NativeChain.GasPrice(), merged.NativeChain.GasPrice(); old != new {
+		restart = append(restart, config.FieldError{
+			Field: "nativeChain.opts.gasPrice",
+			Err:   fmt.Errorf("changed from %q to %q, the stafihub chain requires a restart", old, new),
+		})
+		merged.NativeChain.Opts = r.cfg.NativeChain.Opts
+	}
+	if !reflect.DeepEqual(r.cfg.NativeChain.EndpointList, merged.NativeChain.EndpointList) {
+		restart = append(restart, config.FieldError{
+			Field: "nativeChain.endpointList",
+			Err:   errors.New("applied to the stafihub queries, the stafihub chain requires a restart"),
+		})
+	}
+	for _, fe := range restart {
+		r.log.Warn("config change not applied, restart the relay to apply it", "field", fe.Field, "reason", fe.Err)
+	}
+
+	if merged.LogLevel != r.cfg.LogLevel {
+		if r.logLevelFlag != "" {
+			r.log.Warn("logLevel change ignored, the level is set by --"+flagLogLevel, "level", r.logLevelFlag)
+		} else if level, err := logLevel(r.logLevelFlag, merged); err == nil {
+			logrus.SetLevel(level)
+			r.log.Info("log level changed", "level", level.String())
+		}
+	}
+
+	if !reflect.DeepEqual(r.cfg.NativeChain.EndpointList, merged.NativeChain.EndpointList) {
+		if err := r.hub.pool.SetEndpoints(merged.NativeChain.EndpointList); err != nil {
+			r.log.Error("stafihub query endpoints not changed", "err", err)
+		} else {
+			r.log.Info("stafihub query endpoints changed", "endpoints", merged.NativeChain.EndpointList)
+		}
+	}
+	old := make(map[string]config.RawChainConfig)
+	for _, chainConfig := range r.cfg.ExternalChainList() {
+		old[chainConfig.Rsymbol] = chainConfig
+	}
+	var changes []chainChange
+	for _, chainConfig := range merged.ExternalChainList() {
+		oldConfig := old[chainConfig.Rsymbol]
+		if !reflect.DeepEqual(oldConfig.EndpointList, chainConfig.EndpointList) {
+			if err := r.endpoints.setEndpoints(chainConfig.Rsymbol, chainConfig.EndpointList); err != nil {
+				r.log.Error("probed endpoints not changed", "rsymbol", chainConfig.Rsymbol, "err", err)
+			}
+		}
+		if chainChanged(&oldConfig, &chainConfig) {
+			changes = append(changes, chainChange{symbol: core.RSymbol(chainConfig.Rsymbol), cfg: chainConfig})
+		}
+	}
+
+	r.cfg = merged
+	return changes
+}
+
+// chainChanged reports whether a field a chain can reload differs
+func chainChanged(old, new *config.RawChainConfig) bool {
+	return !reflect.DeepEqual(old.EndpointList, new.EndpointList) || old.GasPrice() != new.GasPrice()
+}
+
+// watch calls reload when the config file is written or replaced and on SIGHUP, until stop is closed
+func (r *reloader) watch(stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// watch the directory, editors and config management replace the file instead of writing it
+	path, err := filepath.Abs(r.path)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(sighup)
+
+		debounce := time.NewTimer(reloadDebounce)
+		debounce.Stop()
+		for {
+			select {
+			case <-stop:
+				debounce.Stop()
+				return
+			case <-sighup:
+				r.reload("SIGHUP")
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					debounce.Reset(reloadDebounce)
+				}
+			case <-debounce.C:
+				r.reload("file changed")
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				r.log.Warn("config file watcher error", "err", err)
+			}
+		}
+	}()
+	return nil
+}
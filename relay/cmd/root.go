@@ -30,6 +30,7 @@ func NewRootCmd() *cobra.Command {
 		versionCmd(),
 		keyCmd(),
 		multisigTransferCmd(),
+		configCmd(),
 	)
 	return rootCmd
 }
@@ -1,9 +1,11 @@
 package cmd
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -11,37 +13,45 @@ import (
 	"github.com/stafihub/rtoken-relay-core/common/config"
 	"github.com/stafihub/rtoken-relay-core/common/core"
 	"github.com/stafihub/rtoken-relay-core/common/log"
+	"github.com/stafihub/rtoken-relay-core/common/utils"
 	stafiHubChain "github.com/stafihub/stafi-hub-relay-sdk/chain"
-	stafiHubXLedgerTypes "github.com/stafihub/stafihub/x/ledger/types"
 )
 
 const (
 	flagConfig   = "config"
 	flagLogLevel = "log_level"
+	flagDryRun   = "dry-run"
 )
 
 var defaultConfigPath = os.ExpandEnv("./config.json")
 
+// flagOrEnv returns the flag value if it is set, then the env value if it is set, then the flag default
+func flagOrEnv(cmd *cobra.Command, flag, env string) (string, error) {
+	if !cmd.Flags().Changed(flag) {
+		if value, ok := os.LookupEnv(env); ok {
+			return value, nil
+		}
+	}
+	return cmd.Flags().GetString(flag)
+}
+
 func startCmd() *cobra.Command {
 
 	cmd := &cobra.Command{
 		Use:   "start",
 		Short: "Start relay procedure",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			configPath, err := cmd.Flags().GetString(flagConfig)
+			configPath, err := flagOrEnv(cmd, flagConfig, config.EnvConfigPath)
 			if err != nil {
 				return err
 			}
 			fmt.Printf("config path: %s\n", configPath)
-			logLevelStr, err := cmd.Flags().GetString(flagLogLevel)
-			if err != nil {
-				return err
-			}
-			logLevel, err := logrus.ParseLevel(logLevelStr)
-			if err != nil {
-				return err
+			var logLevelFlag string
+			if cmd.Flags().Changed(flagLogLevel) {
+				if logLevelFlag, err = cmd.Flags().GetString(flagLogLevel); err != nil {
+					return err
+				}
 			}
-			logrus.SetLevel(logLevel)
 
 			cfg, err := config.GetConfig(configPath)
 			if err != nil {
@@ -52,142 +62,299 @@ func startCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-
-			// Used to signal core shutdown due to fatal error
-			sysErr := make(chan error)
-			c := core.NewCore(log.NewLog(), sysErr)
-
-			// ======================== init stafiHub
-			stafiHubChainConfig := cfg.NativeChain
-			stafiHubChainConfig.Rsymbol = string(core.HubRFIS)
-			bts, err := json.Marshal(stafiHubChainConfig.Opts)
+			level, err := logLevel(logLevelFlag, cfg)
 			if err != nil {
 				return err
 			}
-			option := stafiHubChain.ConfigOption{}
-			err = json.Unmarshal(bts, &option)
-			if err != nil {
-				return err
+			logrus.SetLevel(level)
+			for _, key := range cfg.IgnoredEnv() {
+				logrus.Warnf("env %s matches no config field, ignored", key)
+			}
+
+			externalChains := cfg.ExternalChainList()
+			if len(externalChains) == 0 {
+				return fmt.Errorf("no external chain configured")
+			}
+			if problems := validateChainTypes(cfg); len(problems) > 0 {
+				return problems
+			}
+			for i := range externalChains {
+				if externalChains[i].Type == "" {
+					externalChains[i].Type = config.DefaultExternalChainType
+				}
 			}
-			option.CaredSymbol = cfg.ExternalChain.Rsymbol
-			option.BlockstorePath = cfg.BlockstorePath
 
-			stafiHubChainConfig.Opts = option
-			stafiHubChain := stafiHubChain.NewChain()
-			err = stafiHubChain.Initialize(&stafiHubChainConfig, log.NewLog("chain", stafiHubChainConfig.Name), sysErr)
+			dryRun, err := cmd.Flags().GetBool(flagDryRun)
 			if err != nil {
 				return err
 			}
-			c.AddChain(stafiHubChain)
-
-			//========================== init external chain
-			chainConfig := cfg.ExternalChain
-			var newChain core.Chain
+			if dryRun {
+				return preflight(cfg, externalChains)
+			}
 
-			// load option config from file
-			bts, err = json.Marshal(chainConfig.Opts)
+			queuePolicy, err := core.ParseQueuePolicy(cfg.MsgQueue.Policy)
 			if err != nil {
 				return err
 			}
-			cosmosOption := cosmosChain.ConfigOption{}
-			err = json.Unmarshal(bts, &cosmosOption)
+			queueCfg := core.QueueConfig{
+				Depth:   cfg.MsgQueue.Depth,
+				Workers: cfg.MsgQueue.Workers,
+				Policy:  queuePolicy,
+			}
+
+			routerOpts := []core.RouterOption{
+				core.WithQueueConfig(queueCfg),
+				core.WithDrainTimeout(time.Duration(cfg.ShutdownTimeout) * time.Second),
+				core.WithInterceptors(core.NewLogInterceptor(log.NewLog("module", "router"))),
+			}
+			if cfg.EnableJournal {
+				journal, err := core.OpenJournal(cfg.BlockstorePath, MakeEncodingConfig().Marshaler, log.NewLog("module", "journal"))
+				if err != nil {
+					return fmt.Errorf("open message journal failed: %s", err)
+				}
+				routerOpts = append(routerOpts, core.WithJournal(journal))
+			}
+			var eraProgress *core.EraProgress
+			if cfg.EnableEraProgress {
+				store, err := utils.OpenBoltStore(cfg.BlockstorePath)
+				if err != nil {
+					return fmt.Errorf("open state store failed: %s", err)
+				}
+				defer store.Close()
+				eraProgress = core.NewEraProgress(store, log.NewLog("module", "era progress"))
+			}
+
+			// Used to signal core shutdown due to fatal error
+			sysErr := make(chan error)
+			// passphrases read once, supervised restarts reopen the keystores with them
+			keys, err := newKeystores()
 			if err != nil {
 				return err
 			}
 
-			cosmosOption.BlockstorePath = cfg.BlockstorePath
-
-			// prepare r params from stafihub
-			rParams, err := stafiHubChain.GetRParams(chainConfig.Rsymbol)
+			// queries of the start and of the pool resyncs, failing over across the stafihub endpoints
+			hub, err := newHubQuerier(cfg.NativeChain.EndpointList, cfg.Retry, log.NewLog("module", "stafihub query"))
 			if err != nil {
 				return err
 			}
-			poolRes, err := stafiHubChain.GetPools(rParams.RParams.Denom)
+			// rpc endpoints of the cosmos chains, probed so chains start on the healthiest ones
+			endpoints, err := newChainEndpoints(externalChains, cfg.Retry)
 			if err != nil {
 				return err
 			}
+			hub.pool.Probe(context.Background())
+			endpoints.probe()
 
-			icaPoolsRes, err := stafiHubChain.GetIcaPools(rParams.RParams.Denom)
+			// ======================== init stafiHub
+			// the stafihub chain handles the messages to stafihub and routes the events of every
+			// external chain
+			nativeChain := cfg.NativeChain
+			nativeChain.EndpointList = hub.pool.Endpoints()
+			caredSymbols := make([]string, 0, len(externalChains))
+			for _, chainConfig := range externalChains {
+				caredSymbols = append(caredSymbols, chainConfig.Rsymbol)
+			}
+			hubChain, err := newHubChain(keys, nativeChain, caredSymbols, cfg.BlockstorePath, sysErr)
 			if err != nil {
 				return err
 			}
-			if len(cosmosOption.PoolNameSubKey) == 0 && len(icaPoolsRes.IcaPoolList) == 0 {
-				return fmt.Errorf("no pool")
-			}
 
-			icaPoolsMap := make(map[string]string)
-			icaPoolHostChannel := make(map[string]string)
+			// pools of the cosmos chains, kept up to date with stafihub while running
+			pools := core.NewPoolRegistry(hubPools{hub: hub}, time.Duration(cfg.PoolResync)*time.Second, log.NewLog("module", "pools"))
 
-			for _, value := range icaPoolsRes.IcaPoolList {
-				if value.Status >= stafiHubXLedgerTypes.IcaPoolStatusSetWithdrawal {
-					icaPoolsMap[value.DelegationAccount.Address] = value.WithdrawalAccount.Address
-					icaPoolHostChannel[value.DelegationAccount.Address] = value.DelegationAccount.HostChannelId
-				}
+			coreOpts := []core.CoreOption{
+				core.WithRouterOptions(routerOpts...),
+				core.WithMonitorAddr(cfg.Monitor.ListenAddr),
+				core.WithSupervisorConfig(core.SupervisorConfig{
+					InitialBackoff: time.Duration(cfg.Supervisor.InitialBackoff) * time.Second,
+					MaxBackoff:     time.Duration(cfg.Supervisor.MaxBackoff) * time.Second,
+					MaxRestarts:    cfg.Supervisor.MaxRestarts,
+				}),
+				core.WithPoolRegistry(pools),
+			}
+			if eraProgress != nil {
+				coreOpts = append(coreOpts, core.WithEraProgress(eraProgress))
 			}
+			c := core.NewCore(log.NewLog(), sysErr, coreOpts...)
+			c.AddChain(hubChain)
 
-			cosmosOption.PoolAddressThreshold = make(map[string]uint32)
-			cosmosOption.PoolTargetValidators = make(map[string][]string)
-			bondedIcaPoolWithdrawalAddr := make(map[string]string)
+			// applies the live fields of the config file on change or SIGHUP
+			reload := newReloader(configPath, cfg, logLevelFlag, c, hub, endpoints)
 
-			for _, poolAddressStr := range poolRes.GetAddrs() {
-				// filter icapool
-				if withdrawalAddr, exist := icaPoolsMap[poolAddressStr]; exist {
-					bondedIcaPoolWithdrawalAddr[poolAddressStr] = withdrawalAddr
-				} else {
-					// get pool threshold
-					poolDetail, err := stafiHubChain.GetPoolDetail(rParams.RParams.Denom, poolAddressStr)
+			//========================== init external chains
+			// restarted with backoff on errors, e.g. while their rpc endpoints are unreachable
+			for _, chainConfig := range externalChains {
+				rsymbol := chainConfig.Rsymbol
+				if chainConfig.Type == config.ChainTypeCosmosHub {
+					rParams, err := hub.GetRParams(rsymbol)
 					if err != nil {
 						return err
 					}
-					if poolDetail.Detail.Threshold <= 0 {
-						return fmt.Errorf("pool threshold is zero in stafihub, pool: %s", poolAddressStr)
+					if err := pools.Track(core.RSymbol(rsymbol), rParams.RParams.Denom); err != nil {
+						return fmt.Errorf("%s pools: %s", rsymbol, err)
 					}
-					cosmosOption.PoolAddressThreshold[poolAddressStr] = poolDetail.Detail.Threshold
 				}
-
-				// get pool targetValidators from rvalidator
-				selectedValidators, err := stafiHubChain.GetSelectedValidators(rParams.RParams.Denom, poolAddressStr)
+				err = c.AddSupervisedChain(func(sysErr chan<- error) (core.Chain, error) {
+					return newExternalChain(keys, hub, pools, endpoints.ordered(reload.externalChain(rsymbol)), cfg.BlockstorePath, sysErr)
+				})
 				if err != nil {
 					return err
 				}
-				if len(selectedValidators.RValidatorList) <= 0 {
-					return fmt.Errorf("pool selected validators is empty, pool: %s", poolAddressStr)
-				}
-				cosmosOption.PoolTargetValidators[poolAddressStr] = selectedValidators.RValidatorList
-			}
-
-			cosmosOption.EraSeconds = rParams.RParams.EraSeconds
-			cosmosOption.GasPrice = rParams.RParams.GasPrice
-			cosmosOption.LeastBond = rParams.RParams.LeastBond
-			cosmosOption.Offset = rParams.RParams.Offset
-
-			cosmosOption.IcaPoolWithdrawalAddr = bondedIcaPoolWithdrawalAddr
-			cosmosOption.IcaPoolHostChannel = icaPoolHostChannel
-
-			// prepare account prefix from stafihub
-			prefixRes, err := stafiHubChain.GetAddressPrefix(chainConfig.Rsymbol)
-			if err != nil {
-				return err
-			}
-			cosmosOption.AccountPrefix = prefixRes.GetAccAddressPrefix()
-
-			chainConfig.Opts = cosmosOption
-			newChain = cosmosChain.NewChain()
-			err = newChain.Initialize(&chainConfig, log.NewLog("chain", chainConfig.Name), sysErr)
-			if err != nil {
-				return fmt.Errorf("newChain.Initialize failed: %s", err)
 			}
-			c.AddChain(newChain)
 
 			// =============== start
+			stopWatch := make(chan struct{})
+			if err := reload.watch(stopWatch); err != nil {
+				return fmt.Errorf("watch config file failed: %s", err)
+			}
+			go hub.pool.Run(stopWatch)
+			endpoints.run(stopWatch)
 			c.Start()
+			close(stopWatch)
 
 			return nil
 		},
 	}
 
-	cmd.Flags().String(flagConfig, defaultConfigPath, "Config file path")
-	cmd.Flags().String(flagLogLevel, logrus.InfoLevel.String(), "The logging level (trace|debug|info|warn|error|fatal|panic)")
+	cmd.Flags().String(flagConfig, defaultConfigPath, "Config file path (.json|.yaml|.yml|.toml), env "+config.EnvConfigPath)
+	cmd.Flags().Bool(flagDryRun, false, "Run the stafihub queries and keystore checks of the start, print a summary and exit without submitting anything")
+	cmd.Flags().String(flagLogLevel, logrus.InfoLevel.String(), "The logging level (trace|debug|info|warn|error|fatal|panic), overrides logLevel of the config and env "+config.EnvLogLevel)
 
 	return cmd
 }
+
+// newStafiHubChain initializes a stafihub chain routing the events of caredSymbol
+func newStafiHubChain(keys *keystores, chainConfig config.RawChainConfig, caredSymbol, blockstorePath string, sysErr chan<- error) (*stafiHubChain.Chain, error) {
+	chainConfig.Rsymbol = string(core.HubRFIS)
+	options, err := chainConfig.Options(config.ChainTypeStafiHub)
+	if err != nil {
+		return nil, fmt.Errorf("nativeChain opts: %w", err)
+	}
+	hubOptions := options.(*config.StafiHubOptions)
+	option := stafiHubChain.ConfigOption{
+		BlockstorePath: blockstorePath,
+		StartBlock:     hubOptions.StartBlock,
+		Account:        hubOptions.Account,
+		GasPrice:       hubOptions.GasPrice,
+		CaredSymbol:    caredSymbol,
+	}
+
+	chainConfig.Opts = option
+	hubChain := stafiHubChain.NewChain()
+	err = keys.open(chainConfig.Name, chainConfig.KeystorePath, func() error {
+		return hubChain.Initialize(&chainConfig, log.NewLog("chain", chainConfig.Name, "caredSymbol", caredSymbol), sysErr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hubChain, nil
+}
+
+// newExternalChain builds and initializes an external chain of the configured type, it runs
+// again whenever the supervisor restarts the chain. The pool keystore is reopened with the
+// passphrase read on the first start.
+func newExternalChain(keys *keystores, hub *hubQuerier, pools *core.PoolRegistry, chainConfig config.RawChainConfig, blockstorePath string, sysErr chan<- error) (core.Chain, error) {
+	newChain, err := core.NewChainByType(chainConfig.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	// cosmos chains take their pools and params from stafihub, other types get their typed
+	// options if they registered some, else opts as configured
+	opensKeystore := chainConfig.KeystorePath != ""
+	if chainConfig.Type == config.ChainTypeCosmosHub {
+		cosmosOption, err := newCosmosOption(hub, pools.Snapshot(), chainConfig, blockstorePath)
+		if err != nil {
+			return nil, err
+		}
+		chainConfig.Opts = cosmosOption
+		// ica pools sign on stafihub, the keystore is only opened for multisig pools
+		opensKeystore = len(cosmosOption.PoolNameSubKey) != 0
+	} else if options, err := chainConfig.Options(config.DefaultExternalChainType); err == nil {
+		chainConfig.Opts = options
+	} else if !errors.Is(err, config.ErrNoChainOptions) {
+		return nil, fmt.Errorf("%s opts: %w", chainConfig.Rsymbol, err)
+	}
+
+	initialize := func() error {
+		return newChain.Initialize(&chainConfig, log.NewLog("chain", chainConfig.Name), sysErr)
+	}
+	if opensKeystore {
+		err = keys.open(chainConfig.Name, chainConfig.KeystorePath, initialize)
+	} else {
+		err = initialize()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("newChain.Initialize failed: %s", err)
+	}
+	return newChain, nil
+}
+
+// newCosmosOption completes the configured opts with the rparams and account prefix queried from
+// stafihub and the pools of snapshot
+func newCosmosOption(hub *hubQuerier, snapshot *core.PoolSnapshot, chainConfig config.RawChainConfig, blockstorePath string) (*cosmosChain.ConfigOption, error) {
+	// load option config from file
+	options, err := chainConfig.Options(config.DefaultExternalChainType)
+	if err != nil {
+		return nil, fmt.Errorf("%s opts: %w", chainConfig.Rsymbol, err)
+	}
+	configOptions := options.(*config.CosmosHubOptions)
+	cosmosOption := cosmosChain.ConfigOption{
+		BlockstorePath:      blockstorePath,
+		StartBlock:          configOptions.StartBlock,
+		PoolNameSubKey:      configOptions.Pools,
+		MinUnDelegateAmount: configOptions.MinUnDelegateAmount,
+		GasPrice:            configOptions.GasPrice,
+	}
+
+	// prepare r params from stafihub
+	rParams, err := hub.GetRParams(chainConfig.Rsymbol)
+	if err != nil {
+		return nil, err
+	}
+
+	cosmosOption.PoolAddressThreshold = make(map[string]uint32)
+	cosmosOption.PoolTargetValidators = make(map[string][]string)
+	cosmosOption.IcaPoolWithdrawalAddr = make(map[string]string)
+	cosmosOption.IcaPoolHostChannel = make(map[string]string)
+	icaPools := 0
+	for _, pool := range snapshot.ActivePools(rParams.RParams.Denom) {
+		if pool.Ica {
+			icaPools++
+			cosmosOption.IcaPoolWithdrawalAddr[pool.Address] = pool.WithdrawalAddress
+			cosmosOption.IcaPoolHostChannel[pool.Address] = pool.HostChannelId
+		} else {
+			cosmosOption.PoolAddressThreshold[pool.Address] = pool.Threshold
+		}
+		cosmosOption.PoolTargetValidators[pool.Address] = pool.TargetValidators
+	}
+	if len(cosmosOption.PoolNameSubKey) == 0 && icaPools == 0 {
+		if pending := snapshot.PendingPools(rParams.RParams.Denom); len(pending) > 0 {
+			return nil, fmt.Errorf("no active pool, ica pool %s is %s, start again once stafihub sets its withdrawal address",
+				pending[0].Address, pending[0].IcaStatus)
+		}
+		return nil, fmt.Errorf("no pool")
+	}
+
+	cosmosOption.EraSeconds = rParams.RParams.EraSeconds
+	// the rparams of stafihub set the gas price, a gasPrice set in opts overrides it and is logged
+	switch cosmosOption.GasPrice {
+	case "":
+		cosmosOption.GasPrice = rParams.RParams.GasPrice
+	case rParams.RParams.GasPrice:
+	default:
+		logrus.Warnf("%s opts.gasPrice %s overrides the gas price %s of the stafihub rparams",
+			chainConfig.Rsymbol, cosmosOption.GasPrice, rParams.RParams.GasPrice)
+	}
+	cosmosOption.LeastBond = rParams.RParams.LeastBond
+	cosmosOption.Offset = rParams.RParams.Offset
+
+	// prepare account prefix from stafihub
+	prefixRes, err := hub.GetAddressPrefix(chainConfig.Rsymbol)
+	if err != nil {
+		return nil, err
+	}
+	cosmosOption.AccountPrefix = prefixRes.GetAccAddressPrefix()
+
+	return &cosmosOption, nil
+}